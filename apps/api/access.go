@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+// canAccessChannel reports whether a user may read and manage a channel.
+// DMs ("dm:alice:bob") are restricted to their two participants, and user
+// channels only carry server events; every other channel is public.
+func canAccessChannel(userID, channelID string) bool {
+	if strings.HasPrefix(channelID, model.UserChannelPrefix) {
+		return false
+	}
+	if !strings.HasPrefix(channelID, "dm:") {
+		return true
+	}
+	parts := strings.Split(channelID, ":")
+	return len(parts) == 3 && (parts[1] == userID || parts[2] == userID)
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/digest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Consecutive failed logins before an account is locked.
+	maxFailedLogins = 5
+
+	// How long a locked account refuses logins.
+	lockoutDuration = 15 * time.Minute
+
+	// How long a password reset token stays valid.
+	resetTokenTTL = time.Hour
+
+	minPasswordLength = 8
+
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordLength = 72
+)
+
+// Usernames double as user IDs, which appear in DM channel IDs
+// ("dm:alice:bob") and mentions, so they are limited to a safe alphabet.
+var usernamePattern = regexp.MustCompile(`^[a-z0-9_.-]{3,32}$`)
+
+// dummyHash is checked against when a username does not exist, so unknown
+// users take as long to reject as wrong passwords.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not-a-real-password"), bcrypt.DefaultCost)
+
+var errWeakPassword = errors.New("password must be between 8 and 72 characters")
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	// Deprecated: older clients send the username as user_id.
+	UserID   string `json:"user_id"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ResetRequest struct {
+	Username string `json:"username"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	// All ends every session of the user, not just this one.
+	All bool `json:"all"`
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func checkPassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return errWeakPassword
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if err := checkPassword(password); err != nil {
+		return "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// writeLoginResponse starts a new session and returns its token pair.
+func writeLoginResponse(w http.ResponseWriter, r *http.Request, sessions *auth.Sessions, status int, userID string) {
+	pair, err := sessions.Issue(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to issue tokens for %s: %v", userID, err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pair)
+}
+
+func RegisterHandler(session *db.Session, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req RegisterRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		username := normalizeUsername(req.Username)
+		if !usernamePattern.MatchString(username) {
+			http.Error(w, "username must be 3-32 characters of a-z, 0-9, '_', '.' or '-'", http.StatusBadRequest)
+			return
+		}
+
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The lightweight transaction makes concurrent registrations of the
+		// same username safe.
+		now := time.Now()
+		query := `INSERT INTO users (user_id, password_hash, created_at, password_changed_at, failed_attempts) VALUES (?, ?, ?, ?, 0) IF NOT EXISTS`
+		applied, err := session.Query(query, username, hash, now, now).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			log.Printf("Failed to create user %s: %v", username, err)
+			http.Error(w, "Failed to create user", http.StatusInternalServerError)
+			return
+		}
+		if !applied {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+
+		log.Printf("Registered user: %s", username)
+		writeLoginResponse(w, r, sessions, http.StatusCreated, username)
+	}
+}
+
+func LoginHandler(session *db.Session, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Username == "" {
+			req.Username = req.UserID
+		}
+		username := normalizeUsername(req.Username)
+		if username == "" || req.Password == "" {
+			http.Error(w, "username and password are required", http.StatusBadRequest)
+			return
+		}
+
+		var hash string
+		var failed int
+		var lockedUntil time.Time
+		err := session.Query(`SELECT password_hash, failed_attempts, locked_until FROM users WHERE user_id = ?`, username).
+			Scan(&hash, &failed, &lockedUntil)
+		if errors.Is(err, gocql.ErrNotFound) {
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to load user %s: %v", username, err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+
+		if wait := time.Until(lockedUntil); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			http.Error(w, "Too many failed logins, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+			recordFailedLogin(session, username, failed)
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+
+		if failed > 0 {
+			if err := session.Query(`UPDATE users SET failed_attempts = 0 WHERE user_id = ?`, username).Exec(); err != nil {
+				log.Printf("Failed to reset failed logins for %s: %v", username, err)
+			}
+		}
+
+		writeLoginResponse(w, r, sessions, http.StatusOK, username)
+	}
+}
+
+// recordFailedLogin counts a failed attempt on top of the failed count that
+// was read, and locks the account once maxFailedLogins is reached. The
+// update only applies if the count is unchanged, so concurrent guesses
+// cannot overwrite each other's attempts; a lost race retries with the
+// count that won.
+func recordFailedLogin(session *db.Session, username string, failed int) {
+	for i := 0; i < maxFailedLogins; i++ {
+		var q *gocql.Query
+		if failed+1 >= maxFailedLogins {
+			q = session.Query(`UPDATE users SET failed_attempts = 0, locked_until = ? WHERE user_id = ? IF failed_attempts = ?`,
+				time.Now().Add(lockoutDuration), username, failed)
+		} else {
+			q = session.Query(`UPDATE users SET failed_attempts = ? WHERE user_id = ? IF failed_attempts = ?`, failed+1, username, failed)
+		}
+		current := map[string]interface{}{}
+		applied, err := q.MapScanCAS(current)
+		if err != nil {
+			log.Printf("Failed to record failed login for %s: %v", username, err)
+			return
+		}
+		if applied {
+			if failed+1 >= maxFailedLogins {
+				log.Printf("Locking user %s after %d failed logins", username, failed+1)
+			}
+			return
+		}
+		failed, _ = current["failed_attempts"].(int)
+	}
+	log.Printf("Failed to record failed login for %s: too much contention", username)
+}
+
+// ChangePasswordHandler sets a new password and ends every other session.
+// The caller gets a fresh token pair.
+func ChangePasswordHandler(session *db.Session, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req ChangePasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var hash string
+		if err := session.Query(`SELECT password_hash FROM users WHERE user_id = ?`, claims.UserID).Scan(&hash); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.CurrentPassword)) != nil {
+			http.Error(w, "Current password is incorrect", http.StatusForbidden)
+			return
+		}
+
+		if err := setPassword(session, claims.UserID, req.NewPassword); err != nil {
+			if errors.Is(err, errWeakPassword) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to change password", http.StatusInternalServerError)
+			return
+		}
+
+		if err := sessions.RevokeUser(r.Context(), claims.UserID); err != nil {
+			log.Printf("Failed to revoke sessions of %s: %v", claims.UserID, err)
+		}
+		writeLoginResponse(w, r, sessions, http.StatusOK, claims.UserID)
+	}
+}
+
+// setPassword replaces a user's password and clears any lockout.
+func setPassword(session *db.Session, userID, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	err = session.Query(`UPDATE users SET password_hash = ?, password_changed_at = ?, failed_attempts = 0, locked_until = null WHERE user_id = ?`,
+		hash, time.Now(), userID).Exec()
+	if err != nil {
+		log.Printf("Failed to set password for %s: %v", userID, err)
+	}
+	return err
+}
+
+// hashResetToken is what gets stored, so a leaked table cannot be used to
+// reset passwords.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueResetToken stores a new single-use reset token for a user.
+func issueResetToken(session *db.Session, userID string) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	err := session.Query(`INSERT INTO password_resets (token_hash, user_id) VALUES (?, ?) USING TTL ?`,
+		hashResetToken(token), userID, int(resetTokenTTL.Seconds())).Exec()
+	return token, err
+}
+
+// AdminPasswordResetHandler gives an admin a reset token for a user who has
+// no confirmed address, to pass on to them:
+//
+//	POST /admin/password-reset  {"username": "..."} -> {"token": "..."}
+func AdminPasswordResetHandler(session *db.Session, admins map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !admins[claims.UserID] {
+			http.Error(w, "Only admins can issue reset tokens", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		username := normalizeUsername(req.Username)
+		var exists string
+		err := session.Query(`SELECT user_id FROM users WHERE user_id = ?`, username).Scan(&exists)
+		if errors.Is(err, gocql.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up user %s: %v", username, err)
+			http.Error(w, "Failed to create reset token", http.StatusInternalServerError)
+			return
+		}
+
+		token, err := issueResetToken(session, username)
+		if err != nil {
+			log.Printf("Failed to store reset token for %s: %v", username, err)
+			http.Error(w, "Failed to create reset token", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Admin %s issued a password reset token for %s", claims.UserID, username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+	}
+}
+
+// PasswordResetRequestHandler issues a single-use reset token and mails it
+// to the address the user confirmed for e-mail digests, the only address
+// known to be theirs; users without one ask an admin for a token. It always
+// answers 202 so it cannot be used to probe which usernames exist.
+func PasswordResetRequestHandler(session *db.Session, mailer *digest.Mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		username := normalizeUsername(req.Username)
+
+		var exists string
+		if err := session.Query(`SELECT user_id FROM users WHERE user_id = ?`, username).Scan(&exists); err == nil {
+			email, err := digest.ConfirmedAddress(session, username)
+			if err != nil {
+				log.Printf("Failed to look up the address of %s: %v", username, err)
+				http.Error(w, "Failed to create reset token", http.StatusInternalServerError)
+				return
+			}
+			if email == "" {
+				log.Printf("Not issuing a password reset token for %s: no confirmed address", username)
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+
+			token, err := issueResetToken(session, username)
+			if err != nil {
+				log.Printf("Failed to store reset token for %s: %v", username, err)
+				http.Error(w, "Failed to create reset token", http.StatusInternalServerError)
+				return
+			}
+
+			// The token is a credential and must never be logged
+			body := fmt.Sprintf("Hi %s,\r\n\r\n"+
+				"Someone asked to reset your chat password. To choose a new one, POST\r\n"+
+				"{\"token\": \"%s\", \"new_password\": \"...\"} to /password/reset\r\n"+
+				"within %s.\r\n\r\n"+
+				"If it was not you, ignore this e-mail; your password stays the same.\r\n", username, token, resetTokenTTL)
+			if err := mailer.SendText(email, "Reset your chat password", body); err != nil {
+				// Answered like any other request, so it does not tell
+				// who has an address
+				log.Printf("Failed to mail a password reset token to %s: %v", username, err)
+			} else {
+				log.Printf("Mailed a password reset token to %s", username)
+			}
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func PasswordResetHandler(session *db.Session, sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req ResetPasswordRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// Checked before the token is used up, so a typo does not cost it.
+		if err := checkPassword(req.NewPassword); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tokenHash := hashResetToken(req.Token)
+		var userID string
+		if err := session.Query(`SELECT user_id FROM password_resets WHERE token_hash = ?`, tokenHash).Scan(&userID); err != nil {
+			http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+			return
+		}
+
+		// Only one of two concurrent requests with the same token consumes it.
+		consumed, err := session.Query(`DELETE FROM password_resets WHERE token_hash = ? IF EXISTS`, tokenHash).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			log.Printf("Failed to consume reset token for %s: %v", userID, err)
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+		if !consumed {
+			http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+			return
+		}
+
+		if err := setPassword(session, userID, req.NewPassword); err != nil {
+			if errors.Is(err, errWeakPassword) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		if err := sessions.RevokeUser(r.Context(), userID); err != nil {
+			log.Printf("Failed to revoke sessions of %s: %v", userID, err)
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// RefreshHandler exchanges a refresh token for a new token pair. Refresh
+// tokens rotate: the one presented stops working.
+func RefreshHandler(sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "refresh_token is required", http.StatusBadRequest)
+			return
+		}
+
+		pair, err := sessions.Refresh(r.Context(), req.RefreshToken)
+		if errors.Is(err, auth.ErrInvalidRefreshToken) {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to refresh token: %v", err)
+			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pair)
+	}
+}
+
+// LogoutHandler revokes the caller's access token and refresh token, or all
+// of the caller's sessions. Live websocket connections using them are closed.
+func LogoutHandler(sessions *auth.Sessions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// The body is optional.
+		var req LogoutRequest
+		json.NewDecoder(r.Body).Decode(&req)
+
+		var err error
+		if req.All {
+			err = sessions.RevokeUser(r.Context(), claims.UserID)
+		} else {
+			err = sessions.Logout(r.Context(), claims, req.RefreshToken)
+		}
+		if err != nil {
+			log.Printf("Failed to log out %s: %v", claims.UserID, err)
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
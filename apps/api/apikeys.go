@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// Number of audit entries returned by /apikeys/{id}/audit.
+const auditPageSize = 100
+
+type CreateBotRequest struct {
+	Username string `json:"username"`
+}
+
+type CreateAPIKeyRequest struct {
+	BotID    string   `json:"bot_id"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Channels []string `json:"channels"`
+}
+
+// CreateAPIKeyResponse carries the credential, which is only ever shown
+// here.
+type CreateAPIKeyResponse struct {
+	*auth.APIKey
+	Key string `json:"key"`
+}
+
+// APIKeys verifies API keys against the Redis copy shared with the gateway
+// and falls back to the database, re-populating Redis, when the copy is
+// missing.
+type APIKeys struct {
+	db    *db.Session
+	store *auth.APIKeyStore
+}
+
+func NewAPIKeys(session *db.Session, store *auth.APIKeyStore) *APIKeys {
+	return &APIKeys{db: session, store: store}
+}
+
+func (a *APIKeys) Verify(ctx context.Context, credential string) (*auth.APIKey, error) {
+	id, secret, err := auth.ParseAPIKey(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := a.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		k, err = a.load(id)
+		if errors.Is(err, gocql.ErrNotFound) {
+			return nil, auth.ErrInvalidAPIKey
+		}
+		if err != nil {
+			return nil, err
+		}
+		if k.RevokedAt != nil {
+			return nil, auth.ErrInvalidAPIKey
+		}
+		if err := a.store.Put(ctx, k); err != nil {
+			log.Printf("Failed to cache API key %s: %v", k.ID, err)
+		}
+	}
+
+	if !k.Matches(secret) {
+		return nil, auth.ErrInvalidAPIKey
+	}
+	return k, nil
+}
+
+func (a *APIKeys) load(id string) (*auth.APIKey, error) {
+	k := &auth.APIKey{ID: id}
+	var revokedAt time.Time
+	err := a.db.Query(`SELECT bot_id, owner_id, name, secret_hash, scopes, channels, created_at, revoked_at FROM api_keys WHERE key_id = ?`, id).
+		Scan(&k.BotID, &k.OwnerID, &k.Name, &k.SecretHash, &k.Scopes, &k.Channels, &k.CreatedAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	if !revokedAt.IsZero() {
+		k.RevokedAt = &revokedAt
+	}
+	return k, nil
+}
+
+// audit records an API request made with a key.
+func (a *APIKeys) audit(r *http.Request, k *auth.APIKey, status int) {
+	err := a.store.Audit(context.Background(), k.ID, auth.AuditEntry{
+		Action:     "http",
+		Detail:     fmt.Sprintf("%s %s %d", r.Method, r.URL.RequestURI(), status),
+		RemoteAddr: r.RemoteAddr,
+	})
+	if err != nil {
+		log.Printf("Failed to audit API key %s: %v", k.ID, err)
+	}
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// ownedBot checks that botID is a bot account owned by userID.
+func ownedBot(session *db.Session, botID, userID string) bool {
+	var isBot bool
+	var owner string
+	err := session.Query(`SELECT is_bot, owner_id FROM users WHERE user_id = ?`, botID).Scan(&isBot, &owner)
+	return err == nil && isBot && owner == userID
+}
+
+// BotsHandler creates a bot account owned by the caller. Bots have no
+// password; they authenticate with API keys only.
+func BotsHandler(session *db.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req CreateBotRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		username := normalizeUsername(req.Username)
+		if !usernamePattern.MatchString(username) {
+			http.Error(w, "username must be 3-32 characters of a-z, 0-9, '_', '.' or '-'", http.StatusBadRequest)
+			return
+		}
+
+		query := `INSERT INTO users (user_id, created_at, failed_attempts, is_bot, owner_id) VALUES (?, ?, 0, true, ?) IF NOT EXISTS`
+		applied, err := session.Query(query, username, time.Now(), claims.UserID).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			log.Printf("Failed to create bot %s: %v", username, err)
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+		if !applied {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+
+		log.Printf("User %s created bot %s", claims.UserID, username)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"user_id": username, "owner_id": claims.UserID})
+	}
+}
+
+// APIKeysHandler manages the API keys of the caller's bots:
+//
+//	POST   /apikeys              create a key
+//	GET    /apikeys              list keys, without secrets
+//	DELETE /apikeys/{id}         revoke a key
+//	GET    /apikeys/{id}/audit   recent uses of a key
+type APIKeysHandler struct {
+	db   *db.Session
+	keys *APIKeys
+}
+
+func NewAPIKeysHandler(session *db.Session, keys *APIKeys) *APIKeysHandler {
+	return &APIKeysHandler{db: session, keys: keys}
+}
+
+func (h *APIKeysHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Path: /apikeys[/{id}[/audit]]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		h.create(w, r, claims)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.list(w, claims)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		h.revoke(w, r, claims, parts[1])
+	case len(parts) == 3 && parts[2] == "audit" && r.Method == http.MethodGet:
+		h.auditLog(w, r, claims, parts[1])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *APIKeysHandler) create(w http.ResponseWriter, r *http.Request, claims *auth.Claims) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !ownedBot(h.db, req.BotID, claims.UserID) {
+		http.Error(w, "Not a bot you own", http.StatusForbidden)
+		return
+	}
+
+	k, credential, err := auth.NewAPIKey(req.BotID, claims.UserID, req.Name, req.Scopes, req.Channels)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.Query(`INSERT INTO api_keys (key_id, bot_id, owner_id, name, secret_hash, scopes, channels, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.ID, k.BotID, k.OwnerID, k.Name, k.SecretHash, k.Scopes, k.Channels, k.CreatedAt).Exec()
+	if err == nil {
+		err = h.db.Query(`INSERT INTO api_keys_by_owner (owner_id, key_id) VALUES (?, ?)`, k.OwnerID, k.ID).Exec()
+	}
+	if err != nil {
+		log.Printf("Failed to store API key for %s: %v", k.BotID, err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	if err := h.keys.store.Put(r.Context(), k); err != nil {
+		log.Printf("Failed to cache API key %s: %v", k.ID, err)
+	}
+
+	log.Printf("User %s created API key %s for bot %s with scopes %v", claims.UserID, k.ID, k.BotID, k.Scopes)
+	k.SecretHash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: k, Key: credential})
+}
+
+func (h *APIKeysHandler) list(w http.ResponseWriter, claims *auth.Claims) {
+	iter := h.db.Query(`SELECT key_id FROM api_keys_by_owner WHERE owner_id = ?`, claims.UserID).Iter()
+
+	keys := []*auth.APIKey{}
+	var id string
+	for iter.Scan(&id) {
+		k, err := h.keys.load(id)
+		if err != nil {
+			log.Printf("Failed to load API key %s: %v", id, err)
+			continue
+		}
+		k.SecretHash = ""
+		keys = append(keys, k)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list API keys of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to list API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// owned loads a key and checks that the caller owns it.
+func (h *APIKeysHandler) owned(w http.ResponseWriter, claims *auth.Claims, id string) *auth.APIKey {
+	k, err := h.keys.load(id)
+	if err != nil || k.OwnerID != claims.UserID {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return nil
+	}
+	return k
+}
+
+func (h *APIKeysHandler) revoke(w http.ResponseWriter, r *http.Request, claims *auth.Claims, id string) {
+	k := h.owned(w, claims, id)
+	if k == nil {
+		return
+	}
+
+	if err := h.db.Query(`UPDATE api_keys SET revoked_at = ? WHERE key_id = ?`, time.Now(), id).Exec(); err != nil {
+		log.Printf("Failed to revoke API key %s: %v", id, err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if err := h.keys.store.Revoke(r.Context(), k); err != nil {
+		log.Printf("Failed to remove API key %s from Redis: %v", id, err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s revoked API key %s", claims.UserID, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *APIKeysHandler) auditLog(w http.ResponseWriter, r *http.Request, claims *auth.Claims, id string) {
+	if h.owned(w, claims, id) == nil {
+		return
+	}
+
+	entries, err := h.keys.store.AuditLog(r.Context(), id, auditPageSize)
+	if err != nil {
+		log.Printf("Failed to read audit log of API key %s: %v", id, err)
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
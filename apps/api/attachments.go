@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/blob"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// Defaults for MAX_UPLOAD_BYTES and UPLOAD_TYPES.
+	defaultMaxUploadSize = 25 << 20
+	defaultUploadTypes   = "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain,application/zip,audio/mpeg,video/mp4"
+
+	// Images larger than this are stored without a thumbnail, so a small
+	// file that decodes to a huge bitmap cannot exhaust memory.
+	maxThumbnailSourcePixels = 50_000_000
+
+	// Thumbnails fit in a square of this size.
+	thumbnailSize = 320
+
+	maxAttachmentName = 255
+)
+
+// AttachmentsHandler stores uploaded files and serves them back to members
+// of the channel they were uploaded to.
+//
+//	POST /channels/{id}/attachments     multipart upload, field "file"
+//	GET  /attachments/{id}              the file
+//	GET  /attachments/{id}/thumbnail    a small preview of an image
+//
+// The returned attachment ID is then sent over the gateway with a message:
+// {"type": "message", "content": "...", "attachments": ["<id>"]}.
+type AttachmentsHandler struct {
+	db    *db.Session
+	redis *redis.Client
+	store blob.Store
+
+	maxSize int64
+	types   map[string]bool
+}
+
+func NewAttachmentsHandler(session *db.Session, rdb *redis.Client, store blob.Store, maxSize int64, types []string) *AttachmentsHandler {
+	h := &AttachmentsHandler{db: session, redis: rdb, store: store, maxSize: maxSize, types: make(map[string]bool)}
+	for _, t := range types {
+		if t = strings.TrimSpace(t); t != "" {
+			h.types[t] = true
+		}
+	}
+	return h
+}
+
+func (h *AttachmentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "channels" && len(parts) == 3 && r.Method == http.MethodPost:
+		h.upload(w, r, claims, parts[1])
+	case parts[0] == "attachments" && len(parts) == 2 && r.Method == http.MethodGet:
+		h.download(w, r, claims, parts[1], false)
+	case parts[0] == "attachments" && len(parts) == 3 && parts[2] == "thumbnail" && r.Method == http.MethodGet:
+		h.download(w, r, claims, parts[1], true)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *AttachmentsHandler) upload(w http.ResponseWriter, r *http.Request, claims *auth.Claims, channelID string) {
+	if !canAccessChannel(claims.UserID, channelID) || !claims.Allows(auth.ScopeMessagesWrite, channelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+
+	// Leave room for the multipart framing around the file.
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "File is too large, the limit is "+strconv.FormatInt(h.maxSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Expected a multipart form with a file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	defer r.MultipartForm.RemoveAll()
+
+	if header.Size > h.maxSize {
+		http.Error(w, "File is too large, the limit is "+strconv.FormatInt(h.maxSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The declared type is not trusted; look at the content.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	if !h.types[contentType] {
+		http.Error(w, "Files of type "+contentType+" are not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	idBuf := make([]byte, 8)
+	if _, err := rand.Read(idBuf); err != nil {
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	att := model.Attachment{
+		ID:          hex.EncodeToString(idBuf),
+		Name:        attachmentName(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		if err := h.storeThumbnail(r.Context(), file, &att); err != nil {
+			log.Printf("Failed to make thumbnail for attachment %s: %v", att.ID, err)
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	if err := h.store.Put(r.Context(), blob.OriginalKey(att.ID), file, att.Size, contentType); err != nil {
+		log.Printf("Failed to store attachment %s: %v", att.ID, err)
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+
+	query := `INSERT INTO attachments (attachment_id, channel_id, uploader_id, name, content_type, size, width, height, thumbnail, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	err = h.db.Query(query, att.ID, channelID, claims.UserID, att.Name, att.ContentType, att.Size, att.Width, att.Height, att.Thumbnail, time.Now()).Exec()
+	if err != nil {
+		log.Printf("Failed to save attachment %s: %v", att.ID, err)
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Let the gateway attach it to a message
+	pending, _ := json.Marshal(blob.Upload{Attachment: att, ChannelID: channelID, UploaderID: claims.UserID})
+	if err := h.redis.Set(r.Context(), blob.UploadKey(att.ID), pending, blob.UploadTTL).Err(); err != nil {
+		log.Printf("Failed to record upload %s: %v", att.ID, err)
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s uploaded attachment %s (%s, %d bytes) to %s", claims.UserID, att.ID, contentType, att.Size, channelID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(att)
+}
+
+// storeThumbnail records an image's dimensions and stores a preview that
+// fits in thumbnailSize. PNG and GIF previews stay PNG to keep transparency.
+func (h *AttachmentsHandler) storeThumbnail(ctx context.Context, file multipart.File, att *model.Attachment) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	att.Width, att.Height = cfg.Width, cfg.Height
+	if cfg.Width*cfg.Height > maxThumbnailSourcePixels {
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > thumbnailSize || height > thumbnailSize {
+		if width >= height {
+			width, height = thumbnailSize, max(1, height*thumbnailSize/width)
+		} else {
+			width, height = max(1, width*thumbnailSize/height), thumbnailSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	thumbType := "image/jpeg"
+	if att.ContentType == "image/png" || att.ContentType == "image/gif" {
+		thumbType = "image/png"
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := h.store.Put(ctx, blob.ThumbnailKey(att.ID), &buf, int64(buf.Len()), thumbType); err != nil {
+		return err
+	}
+	att.Thumbnail = true
+	return nil
+}
+
+// attachmentName keeps the base name of an uploaded file without control
+// characters.
+func attachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if utf8.RuneCountInString(name) > maxAttachmentName {
+		name = string([]rune(name)[:maxAttachmentName])
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	return name
+}
+
+func (h *AttachmentsHandler) download(w http.ResponseWriter, r *http.Request, claims *auth.Claims, id string, thumbnail bool) {
+	var channelID, name, contentType string
+	var hasThumbnail bool
+	err := h.db.Query(`SELECT channel_id, name, content_type, thumbnail FROM attachments WHERE attachment_id = ?`, id).
+		Scan(&channelID, &name, &contentType, &hasThumbnail)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		log.Printf("Failed to load attachment %s: %v", id, err)
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+	// Attachments in channels the caller cannot read look like missing ones.
+	if err != nil || !canAccessChannel(claims.UserID, channelID) || !claims.Allows(auth.ScopeHistoryRead, channelID) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if thumbnail && !hasThumbnail {
+		http.Error(w, "Attachment has no thumbnail", http.StatusNotFound)
+		return
+	}
+
+	key := blob.OriginalKey(id)
+	if thumbnail {
+		key = blob.ThumbnailKey(id)
+	}
+	body, info, err := h.store.Get(r.Context(), key)
+	if errors.Is(err, blob.ErrNotFound) {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read attachment %s: %v", id, err)
+		http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	if thumbnail {
+		contentType = info.ContentType
+	}
+	disposition := "attachment"
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Failed to send attachment %s: %v", id, err)
+	}
+}
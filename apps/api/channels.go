@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ChannelsHandler routes /channels/{id}/{resource}/... to the handler of the
+// resource.
+type ChannelsHandler struct {
+	resources map[string]http.Handler
+}
+
+func NewChannelsHandler(resources map[string]http.Handler) *ChannelsHandler {
+	return &ChannelsHandler{resources: resources}
+}
+
+func (h *ChannelsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.Path, "/")
+	if len(pathParts) < 4 {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	handler, ok := h.resources[pathParts[3]]
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/commands"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/netguard"
+	"github.com/redis/go-redis/v9"
+)
+
+type RegisterCommandRequest struct {
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+const maxCommandDescription = 100
+
+// CommandsHandler manages slash commands served by external bots. The
+// gateway invokes them.
+//
+//	POST   /commands         register a command, returns its signing secret
+//	GET    /commands         list commands
+//	DELETE /commands/{name}  remove a command
+//
+// Only a command's owner may remove it.
+type CommandsHandler struct {
+	db    *db.Session
+	redis *redis.Client
+}
+
+func NewCommandsHandler(session *db.Session, rdb *redis.Client) *CommandsHandler {
+	return &CommandsHandler{db: session, redis: rdb}
+}
+
+func (h *CommandsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		h.create(w, r, claims)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		h.list(w, r)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		h.remove(w, r, claims, parts[1])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *CommandsHandler) create(w http.ResponseWriter, r *http.Request, claims *auth.Claims) {
+	var req RegisterCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(req.Name, "/"))
+	// In-channel replies are posted under the command's name, which must
+	// not pass for a user's.
+	var existing string
+	err := h.db.Query(`SELECT user_id FROM users WHERE user_id = ?`, normalizeUsername(name)).Scan(&existing)
+	if err == nil {
+		http.Error(w, "name belongs to a user", http.StatusBadRequest)
+		return
+	}
+	if !errors.Is(err, gocql.ErrNotFound) {
+		log.Printf("Failed to check command /%s against users: %v", name, err)
+		http.Error(w, "Failed to register command", http.StatusInternalServerError)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	// The gateway checks again when it connects, in case the name is
+	// pointed somewhere else later.
+	if err := netguard.CheckHost(r.Context(), u.Hostname()); err != nil {
+		http.Error(w, "url must point to a public address", http.StatusBadRequest)
+		return
+	}
+	if len(req.Description) > maxCommandDescription {
+		http.Error(w, "description is too long", http.StatusBadRequest)
+		return
+	}
+
+	secretBuf := make([]byte, 32)
+	if _, err := rand.Read(secretBuf); err != nil {
+		http.Error(w, "Failed to register command", http.StatusInternalServerError)
+		return
+	}
+	reg := &commands.Registration{
+		Name:        name,
+		URL:         req.URL,
+		Description: req.Description,
+		OwnerID:     claims.UserID,
+		CreatedAt:   time.Now(),
+		Secret:      "whsec_" + base64.RawURLEncoding.EncodeToString(secretBuf),
+	}
+
+	err = commands.Save(r.Context(), h.redis, reg)
+	switch {
+	case errors.Is(err, commands.ErrInvalidName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, commands.ErrTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to register command /%s: %v", name, err)
+		http.Error(w, "Failed to register command", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s registered command /%s", claims.UserID, name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(reg)
+}
+
+func (h *CommandsHandler) list(w http.ResponseWriter, r *http.Request) {
+	list, err := commands.List(r.Context(), h.redis)
+	if err != nil {
+		log.Printf("Failed to list commands: %v", err)
+		http.Error(w, "Failed to list commands", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *CommandsHandler) remove(w http.ResponseWriter, r *http.Request, claims *auth.Claims, name string) {
+	reg, err := commands.Get(r.Context(), h.redis, name)
+	if err != nil && !errors.Is(err, commands.ErrNotFound) {
+		log.Printf("Failed to load command /%s: %v", name, err)
+		http.Error(w, "Failed to delete command", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || reg.OwnerID != claims.UserID {
+		http.Error(w, "Command not found", http.StatusNotFound)
+		return
+	}
+
+	if err := commands.Delete(r.Context(), h.redis, name); err != nil {
+		log.Printf("Failed to delete command /%s: %v", name, err)
+		http.Error(w, "Failed to delete command", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s removed command /%s", claims.UserID, name)
+	w.WriteHeader(http.StatusNoContent)
+}
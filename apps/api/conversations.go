@@ -2,11 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/mahaj/networking-minor/pkg/auth"
 	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/unread"
 )
 
 type Conversation struct {
@@ -31,11 +33,11 @@ func ConversationsHandler(session *db.Session) http.HandlerFunc {
 		var conversations []Conversation
 		var c Conversation
 		for iter.Scan(&c.UserID, &c.OtherUserID, &c.LastUpdated) {
-			// Fetch unread count for this conversation
-			var count int64
-			if err := session.Query(`SELECT unread_count FROM conversation_counters WHERE user_id = ? AND other_user_id = ?`, c.UserID, c.OtherUserID).Scan(&count); err == nil {
-				c.UnreadCount = count
+			count, err := unread.Count(session, c.UserID, c.OtherUserID)
+			if err != nil {
+				log.Printf("Failed to count unread messages for %s from %s: %v", c.UserID, c.OtherUserID, err)
 			}
+			c.UnreadCount = count
 			conversations = append(conversations, c)
 		}
 
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/netguard"
+	"github.com/mahaj/networking-minor/pkg/push"
+)
+
+const (
+	// Limits on push devices.
+	maxDevices     = 20
+	maxDeviceToken = 4096
+)
+
+type RegisterDeviceRequest struct {
+	Provider string `json:"provider"`
+	Token    string `json:"token"`
+}
+
+// DevicesHandler manages the devices the notifier pushes to:
+//
+//	POST   /devices       register a device, again if its token changed
+//	GET    /devices       list them
+//	DELETE /devices/{id}  stop pushing to one, e.g. on logout
+func DevicesHandler(session *db.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			registerDevice(w, r, session, claims)
+		case id == "" && r.Method == http.MethodGet:
+			devices, err := push.List(session, claims.UserID)
+			if err != nil {
+				log.Printf("Failed to list devices of %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to list devices", http.StatusInternalServerError)
+				return
+			}
+			if devices == nil {
+				devices = []*push.Device{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(devices)
+		case id != "" && r.Method == http.MethodDelete:
+			if err := push.Delete(session, claims.UserID, id); err != nil {
+				log.Printf("Failed to delete device %s of %s: %v", id, claims.UserID, err)
+				http.Error(w, "Failed to delete device", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func registerDevice(w http.ResponseWriter, r *http.Request, session *db.Session, claims *auth.Claims) {
+	var req RegisterDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(push.Providers, req.Provider) {
+		http.Error(w, "provider must be one of "+strings.Join(push.Providers, ", "), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" || len(req.Token) > maxDeviceToken {
+		http.Error(w, "token must be 1-"+strconv.Itoa(maxDeviceToken)+" bytes", http.StatusBadRequest)
+		return
+	}
+	// The notifier posts to webpush endpoints, which the browser chose.
+	// It checks again when it connects, in case the name is pointed
+	// somewhere else later.
+	if req.Provider == push.ProviderWebPush {
+		endpoint, err := push.WebPushEndpoint(req.Token)
+		if err != nil {
+			http.Error(w, "token must be a PushSubscription with an https endpoint", http.StatusBadRequest)
+			return
+		}
+		if err := netguard.CheckHost(r.Context(), endpoint.Hostname()); err != nil {
+			http.Error(w, "endpoint must point to a public address", http.StatusBadRequest)
+			return
+		}
+	}
+
+	existing, err := push.List(session, claims.UserID)
+	if err != nil {
+		log.Printf("Failed to list devices of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	d := &push.Device{
+		ID:        push.DeviceID(req.Provider, req.Token),
+		UserID:    claims.UserID,
+		Provider:  req.Provider,
+		Token:     req.Token,
+		CreatedAt: time.Now().UTC(),
+	}
+	known := slices.ContainsFunc(existing, func(e *push.Device) bool { return e.ID == d.ID })
+	if !known && len(existing) >= maxDevices {
+		http.Error(w, "Too many devices, the limit is "+strconv.Itoa(maxDevices), http.StatusConflict)
+		return
+	}
+
+	if err := push.Register(session, d); err != nil {
+		log.Printf("Failed to register device for %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to register device", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s registered %s device %s", claims.UserID, d.Provider, d.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/digest"
+)
+
+// A confirmation mail is sent at most this often per user, so the API
+// cannot be used to flood an address.
+const confirmationInterval = time.Minute
+
+// DigestHandler serves the caller's e-mail digest settings:
+//
+//	GET /digest  the settings, frequency "off" if never set
+//	PUT /digest  {"email": "...", "frequency": "off|hourly|daily|weekly"}
+//
+// Digests only start once the address is confirmed through a link mailed
+// to it, signed with secret and served at publicURL.
+func DigestHandler(session *db.Session, mailer *digest.Mailer, secret []byte, publicURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			s, err := digest.Get(session, claims.UserID)
+			if errors.Is(err, digest.ErrNotFound) {
+				s, err = &digest.Settings{Frequency: digest.FrequencyOff}, nil
+			}
+			if err != nil {
+				log.Printf("Failed to load digest settings of %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to load digest settings", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s)
+		case http.MethodPut:
+			var s digest.Settings
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if !digest.ValidFrequency(s.Frequency) {
+				http.Error(w, "frequency must be one of off, hourly, daily, weekly", http.StatusBadRequest)
+				return
+			}
+			if s.Frequency != digest.FrequencyOff {
+				addr, err := mail.ParseAddress(s.Email)
+				if err != nil {
+					http.Error(w, "Invalid email address", http.StatusBadRequest)
+					return
+				}
+				s.Email = addr.Address
+			}
+
+			// The first digest covers what happens from now on
+			s.UserID = claims.UserID
+			s.LastSentAt = time.Now().UTC()
+			if err := digest.Save(session, &s); err != nil {
+				log.Printf("Failed to save digest settings of %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to save digest settings", http.StatusInternalServerError)
+				return
+			}
+			saved, err := digest.Get(session, claims.UserID)
+			if err != nil {
+				log.Printf("Failed to load digest settings of %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to save digest settings", http.StatusInternalServerError)
+				return
+			}
+
+			now := time.Now()
+			if saved.Frequency != digest.FrequencyOff && !saved.Confirmed && now.Sub(saved.ConfirmationSentAt) >= confirmationInterval {
+				if err := sendConfirmation(mailer, saved, digest.ConfirmURL(publicURL, secret, saved.UserID, saved.Email)); err != nil {
+					log.Printf("Failed to send digest confirmation to %s: %v", claims.UserID, err)
+					http.Error(w, "Failed to send confirmation e-mail", http.StatusBadGateway)
+					return
+				}
+				if err := digest.ConfirmationSent(session, claims.UserID, now); err != nil {
+					log.Printf("Failed to record digest confirmation of %s: %v", claims.UserID, err)
+				}
+				log.Printf("Sent digest confirmation to %s", claims.UserID)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(saved)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}<p>You will no longer get e-mail digests. You can turn them back on in your settings.</p>
+{{else}}<form method="post">
+<p>Stop getting e-mail digests?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}</body></html>
+`))
+
+// DigestUnsubscribeHandler serves the unsubscribe links in digests, which
+// carry a signed user ID instead of a login. GET asks for confirmation so
+// link scanners in mail systems do not unsubscribe anyone; POST
+// unsubscribes, which is also what mail clients send for one-click
+// unsubscribe (RFC 8058).
+func DigestUnsubscribeHandler(session *db.Session, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("user")
+		token := r.URL.Query().Get("token")
+		if userID == "" || !digest.VerifyUnsubscribe(secret, userID, token) {
+			http.Error(w, "Invalid unsubscribe link", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			unsubscribePage.Execute(w, struct{ Done bool }{false})
+		case http.MethodPost:
+			if err := digest.Unsubscribe(session, userID); err != nil {
+				log.Printf("Failed to unsubscribe %s from digests: %v", userID, err)
+				http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s unsubscribed from digests", userID)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			unsubscribePage.Execute(w, struct{ Done bool }{true})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// sendConfirmation mails the link that confirms a user's digest address.
+func sendConfirmation(mailer *digest.Mailer, s *digest.Settings, link string) error {
+	body := fmt.Sprintf("Hi %s,\r\n\r\n"+
+		"Someone asked for %s e-mail digests of unread chat messages to be sent\r\n"+
+		"to this address. Confirm to start getting them:\r\n\r\n%s\r\n\r\n"+
+		"If it was not you, ignore this e-mail and you will not get any.\r\n", s.UserID, s.Frequency, link)
+	return mailer.SendText(s.Email, "Confirm your e-mail digests", body)
+}
+
+var confirmPage = template.Must(template.New("confirm").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Confirm e-mail digests</title></head>
+<body>
+{{if .Done}}<p>Confirmed. You will get e-mail digests at {{.Email}}.</p>
+{{else}}<form method="post">
+<p>Get e-mail digests at {{.Email}}?</p>
+<button type="submit">Confirm</button>
+</form>
+{{end}}</body></html>
+`))
+
+// DigestConfirmHandler serves the links in confirmation mails, which carry
+// a signed user ID and address. Like unsubscribing, GET asks and POST
+// confirms, so link scanners do not confirm anything. A link stops working
+// once the user's settings move to another address.
+func DigestConfirmHandler(session *db.Session, secret []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("user")
+		email := r.URL.Query().Get("email")
+		token := r.URL.Query().Get("token")
+		if userID == "" || email == "" || !digest.VerifyConfirm(secret, userID, email, token) {
+			http.Error(w, "Invalid confirmation link", http.StatusForbidden)
+			return
+		}
+		page := struct {
+			Done  bool
+			Email string
+		}{false, email}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			confirmPage.Execute(w, page)
+		case http.MethodPost:
+			applied, err := digest.Confirm(session, userID, email)
+			if err != nil {
+				log.Printf("Failed to confirm digests of %s: %v", userID, err)
+				http.Error(w, "Failed to confirm", http.StatusInternalServerError)
+				return
+			}
+			if !applied {
+				http.Error(w, "This address is no longer in your digest settings", http.StatusGone)
+				return
+			}
+			log.Printf("User %s confirmed their digest address", userID)
+			page.Done = true
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			confirmPage.Execute(w, page)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"time"
@@ -25,22 +27,23 @@ func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		channelID = "general" // Default to general
 	}
 
+	// API keys may be limited to some channels, and bots only read the DMs
+	// they are part of
+	if claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims); ok && claims.APIKey != nil {
+		if !canAccessChannel(claims.UserID, channelID) || !claims.Allows(auth.ScopeHistoryRead, channelID) {
+			http.Error(w, "Not allowed to read this channel", http.StatusForbidden)
+			return
+		}
+	}
+
 	var messages []model.Message
 	// Query by channel_id (Partition Key)
-	iter := h.db.Query("SELECT channel_id, id, user_id, content, timestamp FROM messages WHERE channel_id = ?", channelID).Iter()
-
-	var id int64
-	var userID, content, chID string
-	var timestamp time.Time
-
-	for iter.Scan(&chID, &id, &userID, &content, &timestamp) {
-		messages = append(messages, model.Message{
-			ID:        id,
-			ChannelID: chID,
-			UserID:    userID,
-			Content:   content,
-			Timestamp: timestamp,
-		})
+	iter := h.db.Query("SELECT "+messageColumns+" FROM messages WHERE channel_id = ?", channelID).Iter()
+
+	var row messageRow
+	now := time.Now()
+	for iter.Scan(row.fields()...) {
+		messages = append(messages, row.message(now))
 	}
 
 	if err := iter.Close(); err != nil {
@@ -53,58 +56,130 @@ func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
-type LoginRequest struct {
-	UserID string `json:"user_id"`
+// messageColumns are the messages columns a messageRow is scanned from.
+const messageColumns = "channel_id, id, user_id, content, timestamp, display_name, bot, attachments, mentions, TTL(content)"
+
+type messageRow struct {
+	msg         model.Message
+	attachments string
+	mentions    string
+	ttl         int
 }
 
-type LoginResponse struct {
-	Token string `json:"token"`
+func (r *messageRow) fields() []interface{} {
+	return []interface{}{&r.msg.ChannelID, &r.msg.ID, &r.msg.UserID, &r.msg.Content, &r.msg.Timestamp, &r.msg.DisplayName, &r.msg.Bot, &r.attachments, &r.mentions, &r.ttl}
 }
 
-func LoginHandler(w http.ResponseWriter, r *http.Request) {
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// message returns the scanned row as a message.
+func (r *messageRow) message(now time.Time) model.Message {
+	msg := r.msg
+	msg.Type = model.TypeMessage
+	// Messages under a retention policy expire with their TTL
+	if r.ttl > 0 {
+		expiresAt := now.Add(time.Duration(r.ttl) * time.Second)
+		msg.ExpiresAt = &expiresAt
 	}
-
-	if req.UserID == "" {
-		http.Error(w, "user_id is required", http.StatusBadRequest)
-		return
+	if r.attachments != "" {
+		if err := json.Unmarshal([]byte(r.attachments), &msg.Attachments); err != nil {
+			log.Printf("Invalid attachments on message %d: %v", msg.ID, err)
+		}
 	}
+	if r.mentions != "" {
+		if err := json.Unmarshal([]byte(r.mentions), &msg.Mentions); err != nil {
+			log.Printf("Invalid mentions on message %d: %v", msg.ID, err)
+		}
+	}
+	return msg
+}
 
-	token, err := auth.GenerateToken(req.UserID)
+// loadMessage returns a stored message, or gocql.ErrNotFound.
+func loadMessage(session *db.Session, channelID string, id int64) (*model.Message, error) {
+	var row messageRow
+	err := session.Query("SELECT "+messageColumns+" FROM messages WHERE channel_id = ? AND id = ?", channelID, id).Scan(row.fields()...)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
+	msg := row.message(time.Now())
+	return &msg, nil
+}
 
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoginResponse{Token: token})
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(auth.Keys().JWKS())
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString := r.Header.Get("Authorization")
-		if tokenString == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Remove "Bearer " prefix if present
-		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-			tokenString = tokenString[7:]
-		}
-
-		claims, err := auth.ValidateToken(tokenString)
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Add user_id to context (optional, for future use)
-		log.Printf("Authenticated user: %s", claims.UserID)
-
-		next.ServeHTTP(w, r)
-	})
+// AuthMiddleware returns a middleware that requires a valid, unrevoked
+// access token. API keys are only accepted on routes wrapped with the scopes
+// that admit them, and only if the key has one of those scopes; every request
+// made with a key is audited.
+func AuthMiddleware(sessions *auth.Sessions, keys *APIKeys) func(http.Handler, ...string) http.Handler {
+	return func(next http.Handler, scopes ...string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString := r.Header.Get("Authorization")
+			if tokenString == "" {
+				http.Error(w, "Authorization header required", http.StatusUnauthorized)
+				return
+			}
+
+			// Remove "Bearer " prefix if present
+			if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
+				tokenString = tokenString[7:]
+			}
+
+			if auth.IsAPIKey(tokenString) {
+				k, err := keys.Verify(r.Context(), tokenString)
+				if errors.Is(err, auth.ErrInvalidAPIKey) {
+					http.Error(w, "Invalid API key", http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					log.Printf("Failed to verify API key: %v", err)
+					http.Error(w, "Failed to verify API key", http.StatusServiceUnavailable)
+					return
+				}
+
+				rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+				defer func() { keys.audit(r, k, rec.status) }()
+
+				allowed := false
+				for _, scope := range scopes {
+					allowed = allowed || k.HasScope(scope)
+				}
+				if !allowed {
+					http.Error(rec, "API key lacks the scope for this endpoint", http.StatusForbidden)
+					return
+				}
+
+				ctx := context.WithValue(r.Context(), auth.UserKey, k.Claims())
+				next.ServeHTTP(rec, r.WithContext(ctx))
+				return
+			}
+
+			claims, err := auth.ValidateToken(tokenString)
+			if err != nil {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			// Fail closed: without the revocation list we cannot tell whether
+			// the token was logged out.
+			revoked, err := sessions.IsRevoked(r.Context(), claims)
+			if err != nil {
+				log.Printf("Failed to check revocation for %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to verify token", http.StatusServiceUnavailable)
+				return
+			}
+			if revoked {
+				http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+				return
+			}
+
+			log.Printf("Authenticated user: %s", claims.UserID)
+
+			// Handlers read the caller from the request context
+			ctx := context.WithValue(r.Context(), auth.UserKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+const (
+	// Limits on what an incoming webhook may post.
+	maxHookBodySize    = 64 << 10
+	maxHookTextLength  = 4000
+	maxHookAttachments = 20
+	maxHookUsername    = 80
+
+	// Incoming webhook messages are sent as this user ID prefix followed by
+	// the webhook ID. ':' cannot appear in usernames, so it never collides
+	// with a real user.
+	hookUserPrefix = "webhook:"
+)
+
+// IncomingWebhook is a URL that posts into a channel.
+type IncomingWebhook struct {
+	ID        string    `json:"id"`
+	ChannelID string    `json:"channel_id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// Only returned when the webhook is created.
+	URL string `json:"url,omitempty"`
+}
+
+type CreateIncomingWebhookRequest struct {
+	Name string `json:"name"`
+}
+
+// HookPayload is what integrations POST to an incoming webhook. It follows
+// the widely used Slack format so existing CI and monitoring integrations
+// work unchanged.
+type HookPayload struct {
+	Text        string           `json:"text"`
+	Username    string           `json:"username"`
+	Attachments []HookAttachment `json:"attachments"`
+}
+
+type HookAttachment struct {
+	Title     string      `json:"title"`
+	TitleLink string      `json:"title_link"`
+	Text      string      `json:"text"`
+	Fields    []HookField `json:"fields"`
+}
+
+type HookField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+func hashHookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IncomingWebhooksHandler manages a channel's incoming webhooks:
+//
+//	POST   /channels/{id}/incoming-webhooks            create, returns the URL
+//	GET    /channels/{id}/incoming-webhooks            list
+//	DELETE /channels/{id}/incoming-webhooks/{webhook}  remove
+//
+// Anyone who can access the channel may create and list them; only the
+// creator may remove one.
+type IncomingWebhooksHandler struct {
+	db *db.Session
+
+	// Public base URL of the API, used to build webhook URLs.
+	baseURL string
+}
+
+func NewIncomingWebhooksHandler(session *db.Session, baseURL string) *IncomingWebhooksHandler {
+	return &IncomingWebhooksHandler{db: session, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (h *IncomingWebhooksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Path: /channels/{id}/incoming-webhooks[/{webhook}]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	channelID := parts[1]
+	if !canAccessChannel(claims.UserID, channelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		h.create(w, r, claims, channelID)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		h.list(w, channelID)
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		h.remove(w, claims, channelID, parts[3])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *IncomingWebhooksHandler) create(w http.ResponseWriter, r *http.Request, claims *auth.Claims, channelID string) {
+	var req CreateIncomingWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	idBuf := make([]byte, 8)
+	tokenBuf := make([]byte, 24)
+	if _, err := rand.Read(idBuf); err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	if _, err := rand.Read(tokenBuf); err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBuf)
+
+	hook := IncomingWebhook{
+		ID:        hex.EncodeToString(idBuf),
+		ChannelID: channelID,
+		Name:      req.Name,
+		CreatedBy: claims.UserID,
+		CreatedAt: time.Now(),
+	}
+	hook.URL = h.baseURL + "/hooks/" + hook.ID + "/" + token
+
+	err := h.db.Query(`INSERT INTO incoming_webhooks (webhook_id, channel_id, token_hash, name, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		hook.ID, channelID, hashHookToken(token), hook.Name, hook.CreatedBy, hook.CreatedAt).Exec()
+	if err == nil {
+		err = h.db.Query(`INSERT INTO incoming_webhooks_by_channel (channel_id, webhook_id) VALUES (?, ?)`, channelID, hook.ID).Exec()
+	}
+	if err != nil {
+		log.Printf("Failed to create incoming webhook for %s: %v", channelID, err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s added incoming webhook %s to channel %s", claims.UserID, hook.ID, channelID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func (h *IncomingWebhooksHandler) list(w http.ResponseWriter, channelID string) {
+	iter := h.db.Query(`SELECT webhook_id FROM incoming_webhooks_by_channel WHERE channel_id = ?`, channelID).Iter()
+
+	hooks := []IncomingWebhook{}
+	var id string
+	for iter.Scan(&id) {
+		hook := IncomingWebhook{ID: id, ChannelID: channelID}
+		err := h.db.Query(`SELECT name, created_by, created_at FROM incoming_webhooks WHERE webhook_id = ?`, id).
+			Scan(&hook.Name, &hook.CreatedBy, &hook.CreatedAt)
+		if err != nil {
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list incoming webhooks for %s: %v", channelID, err)
+		http.Error(w, "Failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+func (h *IncomingWebhooksHandler) remove(w http.ResponseWriter, claims *auth.Claims, channelID, webhookID string) {
+	var hookChannel, createdBy string
+	err := h.db.Query(`SELECT channel_id, created_by FROM incoming_webhooks WHERE webhook_id = ?`, webhookID).Scan(&hookChannel, &createdBy)
+	if err != nil || hookChannel != channelID || createdBy != claims.UserID {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	err = h.db.Query(`DELETE FROM incoming_webhooks WHERE webhook_id = ?`, webhookID).Exec()
+	if err == nil {
+		err = h.db.Query(`DELETE FROM incoming_webhooks_by_channel WHERE channel_id = ? AND webhook_id = ?`, channelID, webhookID).Exec()
+	}
+	if err != nil {
+		log.Printf("Failed to delete incoming webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s removed incoming webhook %s from channel %s", claims.UserID, webhookID, channelID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HookHandler accepts posts to incoming webhook URLs, /hooks/{id}/{token}.
+// The token in the URL is the only credential.
+type HookHandler struct {
+	db        *db.Session
+	publisher *MessagePublisher
+}
+
+func NewHookHandler(session *db.Session, publisher *MessagePublisher) *HookHandler {
+	return &HookHandler{db: session, publisher: publisher}
+}
+
+func (h *HookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	webhookID, token := parts[1], parts[2]
+
+	var channelID, tokenHash string
+	err := h.db.Query(`SELECT channel_id, token_hash FROM incoming_webhooks WHERE webhook_id = ?`, webhookID).Scan(&channelID, &tokenHash)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		log.Printf("Failed to load incoming webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to post message", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashHookToken(token))) != 1 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var payload HookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxHookBodySize)).Decode(&payload); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Attachments) > maxHookAttachments {
+		http.Error(w, "Too many attachments", http.StatusBadRequest)
+		return
+	}
+
+	content := strings.TrimSpace(payload.Text)
+	cards, err := hookCards(payload.Attachments)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if content == "" && len(cards) == 0 {
+		http.Error(w, "text or attachments are required", http.StatusBadRequest)
+		return
+	}
+	if hookLength(content, cards) > maxHookTextLength {
+		http.Error(w, "Message is too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	username := strings.TrimSpace(payload.Username)
+	if utf8.RuneCountInString(username) > maxHookUsername {
+		username = string([]rune(username)[:maxHookUsername])
+	}
+	// Posts are marked as bot posts, but a user's own name would still
+	// invite mistaking one for them.
+	if username != "" {
+		var existing string
+		err := h.db.Query(`SELECT user_id FROM users WHERE user_id = ?`, normalizeUsername(username)).Scan(&existing)
+		if err == nil {
+			http.Error(w, "username belongs to a user", http.StatusBadRequest)
+			return
+		}
+		if !errors.Is(err, gocql.ErrNotFound) {
+			log.Printf("Failed to check webhook username %q: %v", username, err)
+			http.Error(w, "Failed to post message", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	msg := &model.Message{
+		ChannelID:   channelID,
+		UserID:      hookUserPrefix + webhookID,
+		Content:     content,
+		Type:        model.TypeMessage,
+		DisplayName: username,
+		Bot:         true,
+		Attachments: cards,
+	}
+	if err := h.publisher.Publish(r.Context(), msg); err != nil {
+		log.Printf("Failed to publish message from incoming webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to post message", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": msg.ID})
+}
+
+// hookCards turns Slack attachments into message attachments of the card
+// kind.
+func hookCards(attachments []HookAttachment) ([]model.Attachment, error) {
+	var cards []model.Attachment
+	for _, a := range attachments {
+		if a.TitleLink != "" {
+			u, err := url.Parse(a.TitleLink)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, errors.New("title_link must be an http or https URL")
+			}
+		}
+		card := model.Attachment{Title: a.Title, TitleLink: a.TitleLink, Text: a.Text}
+		for _, f := range a.Fields {
+			card.Fields = append(card.Fields, model.AttachmentField{Title: f.Title, Value: f.Value})
+		}
+		if card.Title == "" && card.Text == "" && len(card.Fields) == 0 {
+			continue
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// hookLength is how much text a webhook post carries, for the length limit.
+func hookLength(content string, cards []model.Attachment) int {
+	n := len(content)
+	for _, c := range cards {
+		n += len(c.Title) + len(c.TitleLink) + len(c.Text)
+		for _, f := range c.Fields {
+			n += len(f.Title) + len(f.Value)
+		}
+	}
+	return n
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/blob"
 	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/digest"
+	"github.com/mahaj/networking-minor/pkg/search"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/redis/go-redis/v9"
 )
 
 func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow all for dev, or specific origin
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
 
 		if r.Method == "OPTIONS" {
@@ -24,6 +32,12 @@ func CORSMiddleware(next http.Handler) http.Handler {
 }
 
 func main() {
+	keys, err := auth.Load()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	auth.SetKeys(keys)
+
 	scyllaHostsStr := os.Getenv("SCYLLA_HOSTS")
 	if scyllaHostsStr == "" {
 		scyllaHostsStr = "localhost:9042"
@@ -37,28 +51,207 @@ func main() {
 	}
 	defer session.Close()
 
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer rdb.Close()
+
+	kafkaBrokersStr := os.Getenv("KAFKA_BROKERS")
+	if kafkaBrokersStr == "" {
+		kafkaBrokersStr = "localhost:19092"
+	}
+
+	// Each replica leases a snowflake node of its own unless SNOWFLAKE_NODE
+	// sets one.
+	var ids *snowflake.Node
+	ids, err = snowflake.Load(context.Background(), rdb, snowflake.FirstAPINode, snowflake.LastAPINode, func(err error) {
+		log.Fatalf("Lost the lease of snowflake node %d: %v", ids.Number(), err)
+	})
+	if err != nil {
+		log.Fatalf("Failed to get a snowflake node: %v", err)
+	}
+	log.Printf("Generating IDs as snowflake node %d", ids.Number())
+	publisher := NewMessagePublisher(strings.Split(kafkaBrokersStr, ","), "chat-messages", ids)
+	defer publisher.Close()
+
+	// Public URL of this service, used in incoming webhook URLs
+	publicURL := os.Getenv("API_PUBLIC_URL")
+	if publicURL == "" {
+		publicURL = "http://localhost:8081"
+	}
+
+	// Uploaded attachments, in a local directory or an S3 bucket
+	store, err := blob.FromEnv(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to open blob store: %v", err)
+	}
+	maxUploadSize := int64(defaultMaxUploadSize)
+	if v := os.Getenv("MAX_UPLOAD_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid MAX_UPLOAD_BYTES %q", v)
+		}
+		maxUploadSize = n
+	}
+	uploadTypes := os.Getenv("UPLOAD_TYPES")
+	if uploadTypes == "" {
+		uploadTypes = defaultUploadTypes
+	}
+	attachments := NewAttachmentsHandler(session, rdb, store, maxUploadSize, strings.Split(uploadTypes, ","))
+
+	// Messaging service, which holds the search index
+	searchURL := os.Getenv("SEARCH_URL")
+	if searchURL == "" {
+		searchURL = "http://localhost:8082"
+	}
+	searchSecret, err := search.LoadSecret()
+	if err != nil {
+		log.Fatalf("Failed to load search secret: %v", err)
+	}
+
+	// Users who may set workspace-wide and channel retention policies
+	admins := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+	retentionHandler := RetentionHandler(session, admins)
+
+	// Refresh tokens and the revocation list live in Redis
+	sessions := auth.NewSessions(rdb)
+	apiKeys := NewAPIKeys(session, auth.NewAPIKeyStore(rdb))
+	requireAuth := AuthMiddleware(sessions, apiKeys)
+
+	// Confirmation and password reset mails go through the same SMTP server
+	// as digests
+	smtpAddr := os.Getenv("SMTP_ADDR")
+	if smtpAddr == "" {
+		smtpAddr = "localhost:1025"
+	}
+	smtpFrom := os.Getenv("SMTP_FROM")
+	if smtpFrom == "" {
+		smtpFrom = "chat@localhost"
+	}
+	mailer := digest.NewMailer(smtpAddr, smtpFrom, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+
 	log.Println("API Service Starting on :8081...")
 
-	// Public endpoint
-	http.Handle("/login", CORSMiddleware(http.HandlerFunc(LoginHandler)))
+	// Public account endpoints
+	http.Handle("/register", CORSMiddleware(RegisterHandler(session, sessions)))
+	http.Handle("/login", CORSMiddleware(LoginHandler(session, sessions)))
+	http.Handle("/token/refresh", CORSMiddleware(RefreshHandler(sessions)))
+	http.Handle("/password/reset/request", CORSMiddleware(PasswordResetRequestHandler(session, mailer)))
+	http.Handle("/password/reset", CORSMiddleware(PasswordResetHandler(session, sessions)))
 
-	// Protected endpoint
-	historyHandler := NewHistoryHandler(session)
-	http.Handle("/history", CORSMiddleware(AuthMiddleware(historyHandler)))
+	// Single sign-on through an external OpenID Connect provider
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+		if redirectURL == "" {
+			redirectURL = "http://localhost:8081/oidc/callback"
+		}
+		oidc, err := NewOIDC(issuer, os.Getenv("OIDC_CLIENT_ID"), os.Getenv("OIDC_CLIENT_SECRET"), redirectURL, session, rdb, sessions)
+		if err != nil {
+			log.Fatalf("Failed to set up OIDC provider %s: %v", issuer, err)
+		}
+		oidc.successURL = os.Getenv("OIDC_SUCCESS_URL")
+		http.HandleFunc("/oidc/login", oidc.Login)
+		http.HandleFunc("/oidc/callback", oidc.Callback)
+		log.Printf("OIDC login enabled for %s", issuer)
+	}
 
-	// Presence endpoint
-	// Route: /channels/{id}/users
-	// We need a router for path params, but for now we can use a prefix handler and parse manually in handler
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	// Incoming webhooks authenticate with the token in their URL
+	http.Handle("/hooks/", NewHookHandler(session, publisher))
+
+	// Unsubscribe links in e-mail digests carry a signed user ID, and
+	// confirmation links a signed user ID and address
+	digestSecret, err := digest.LoadSecret()
+	if err != nil {
+		log.Fatalf("Failed to load digest secret: %v", err)
 	}
-	presenceHandler := NewPresenceHandler(redisAddr)
-	http.Handle("/channels/", CORSMiddleware(AuthMiddleware(presenceHandler)))
+	http.Handle("/digest/unsubscribe", DigestUnsubscribeHandler(session, digestSecret))
+	http.Handle("/digest/confirm", DigestConfirmHandler(session, digestSecret))
+
+	// Public keys for services that verify our tokens without sharing a secret
+	http.Handle("/.well-known/jwks.json", CORSMiddleware(http.HandlerFunc(JWKSHandler)))
+
+	// Protected endpoints
+	http.Handle("/password", CORSMiddleware(requireAuth(ChangePasswordHandler(session, sessions))))
+	http.Handle("/admin/password-reset", CORSMiddleware(requireAuth(AdminPasswordResetHandler(session, admins))))
+	http.Handle("/logout", CORSMiddleware(requireAuth(LogoutHandler(sessions))))
+
+	historyHandler := NewHistoryHandler(session)
+	http.Handle("/history", CORSMiddleware(requireAuth(historyHandler, auth.ScopeHistoryRead)))
+	http.Handle("/search", CORSMiddleware(requireAuth(NewSearchHandler(searchURL, searchSecret), auth.ScopeHistoryRead)))
+
+	// Bot accounts and their API keys
+	http.Handle("/bots", CORSMiddleware(requireAuth(BotsHandler(session))))
+	apiKeysHandler := NewAPIKeysHandler(session, apiKeys)
+	http.Handle("/apikeys", CORSMiddleware(requireAuth(apiKeysHandler)))
+	http.Handle("/apikeys/", CORSMiddleware(requireAuth(apiKeysHandler)))
+
+	// Slash commands served by external bots
+	commandsHandler := NewCommandsHandler(session, rdb)
+	http.Handle("/commands", CORSMiddleware(requireAuth(commandsHandler)))
+	http.Handle("/commands/", CORSMiddleware(requireAuth(commandsHandler)))
+
+	// Scheduled messages and reminders, sent by the messaging service
+	schedulesHandler := SchedulesHandler(session)
+	http.Handle("/schedules", CORSMiddleware(requireAuth(schedulesHandler, auth.ScopeMessagesWrite)))
+	http.Handle("/schedules/", CORSMiddleware(requireAuth(schedulesHandler, auth.ScopeMessagesWrite)))
+
+	// Devices the notifier sends push notifications to
+	devicesHandler := DevicesHandler(session)
+	http.Handle("/devices", CORSMiddleware(requireAuth(devicesHandler)))
+	http.Handle("/devices/", CORSMiddleware(requireAuth(devicesHandler)))
+
+	// Mutes, notification levels and do not disturb
+	preferencesHandler := PreferencesHandler(session, rdb)
+	http.Handle("/preferences", CORSMiddleware(requireAuth(preferencesHandler)))
+	http.Handle("/preferences/", CORSMiddleware(requireAuth(preferencesHandler)))
+
+	// E-mail digests of unread messages, sent by the notifier
+	http.Handle("/digest", CORSMiddleware(requireAuth(DigestHandler(session, mailer, digestSecret, publicURL))))
+
+	// Messages that mention the caller
+	mentionsHandler := MentionsHandler(session)
+	http.Handle("/mentions", CORSMiddleware(requireAuth(mentionsHandler, auth.ScopeHistoryRead)))
+	http.Handle("/mentions/", CORSMiddleware(requireAuth(mentionsHandler, auth.ScopeHistoryRead)))
+
+	// Messages the caller saved for later
+	savedHandler := SavedHandler(session)
+	http.Handle("/saved", CORSMiddleware(requireAuth(savedHandler)))
+	http.Handle("/saved/", CORSMiddleware(requireAuth(savedHandler)))
+
+	// Channel endpoints
+	// Routes: /channels/{id}/users (presence), /channels/{id}/webhooks/...
+	channelsHandler := NewChannelsHandler(map[string]http.Handler{
+		"users":       NewPresenceHandler(redisAddr),
+		"webhooks":    NewWebhooksHandler(session),
+		"attachments": attachments,
+		"retention":   retentionHandler,
+		"pins":        NewPinsHandler(session, publisher),
+
+		"incoming-webhooks": NewIncomingWebhooksHandler(session, publicURL),
+	})
+	http.Handle("/channels/", CORSMiddleware(requireAuth(channelsHandler)))
+	// Uploads are the one channel route API keys may use.
+	http.Handle("POST /channels/{id}/attachments", CORSMiddleware(requireAuth(attachments, auth.ScopeMessagesWrite)))
+
+	// Workspace default retention policy
+	http.Handle("/retention", CORSMiddleware(requireAuth(retentionHandler)))
+
+	// Attachment downloads: /attachments/{id}[/thumbnail]
+	http.Handle("/attachments/", CORSMiddleware(requireAuth(attachments, auth.ScopeHistoryRead)))
+
+	// User status endpoint: /users/status?ids=a,b,c
+	http.Handle("/users/status", CORSMiddleware(requireAuth(NewStatusHandler(redisAddr))))
 
 	// Conversations endpoint
-	http.Handle("/conversations", CORSMiddleware(AuthMiddleware(ConversationsHandler(session))))
-	http.Handle("/conversations/read", CORSMiddleware(AuthMiddleware(ReadHandler(session))))
+	http.Handle("/conversations", CORSMiddleware(requireAuth(ConversationsHandler(session))))
+	http.Handle("/conversations/read", CORSMiddleware(requireAuth(ReadHandler(session))))
 
 	if err := http.ListenAndServe(":8081", nil); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+// Mentions returned per page by default, and at most.
+const (
+	defaultMentionsPage = 50
+	maxMentionsPage     = 200
+)
+
+// MentionsHandler serves the caller's mentions inbox, which the messaging
+// service fills:
+//
+//	GET    /mentions               messages that mention the caller, newest first; ?before={id}&limit=
+//	DELETE /mentions/{message_id}  dismiss one
+func MentionsHandler(session *db.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mentions"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listMentions(w, r, session, claims)
+		case id != "" && r.Method == http.MethodDelete:
+			messageID, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid message ID", http.StatusBadRequest)
+				return
+			}
+			if err := session.Query(`DELETE FROM mentions WHERE user_id = ? AND message_id = ?`, claims.UserID, messageID).Exec(); err != nil {
+				log.Printf("Failed to dismiss mention %d of %s: %v", messageID, claims.UserID, err)
+				http.Error(w, "Failed to dismiss mention", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func listMentions(w http.ResponseWriter, r *http.Request, session *db.Session, claims *auth.Claims) {
+	limit := defaultMentionsPage
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= maxMentionsPage {
+		limit = l
+	}
+	query := session.Query(`SELECT message_id, channel_id FROM mentions WHERE user_id = ? LIMIT ?`, claims.UserID, limit)
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		query = session.Query(`SELECT message_id, channel_id FROM mentions WHERE user_id = ? AND message_id < ? LIMIT ?`, claims.UserID, before, limit)
+	}
+
+	type ref struct {
+		messageID int64
+		channelID string
+	}
+	var refs []ref
+	var rf ref
+	iter := query.Iter()
+	for iter.Scan(&rf.messageID, &rf.channelID) {
+		refs = append(refs, rf)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list mentions of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to list mentions", http.StatusInternalServerError)
+		return
+	}
+
+	messages := []model.Message{}
+	for _, rf := range refs {
+		// Access may have changed since the mention, e.g. an API key's channels
+		if !canAccessChannel(claims.UserID, rf.channelID) || !claims.Allows(auth.ScopeHistoryRead, rf.channelID) {
+			continue
+		}
+		msg, err := loadMessage(session, rf.channelID, rf.messageID)
+		if errors.Is(err, gocql.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load mentioning message %d: %v", rf.messageID, err)
+			continue
+		}
+		messages = append(messages, *msg)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long a user has to finish logging in at the identity provider.
+	oidcStateTTL = 10 * time.Minute
+
+	oidcStateCookie = "oidc_state"
+	oidcStatePrefix = "oidc:state:"
+)
+
+// OIDC logs users in through an external OpenID Connect provider using the
+// authorization code flow with PKCE. Provider subjects are mapped to chat
+// user IDs in oidc_identities; first-time users get an account without a
+// password. After a successful login the caller receives our own tokens, as
+// from /login.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+
+	// Where browsers are sent after login, with the tokens in the fragment.
+	// Without it the callback answers with JSON.
+	successURL string
+
+	authURL  string
+	tokenURL string
+	keys     *auth.KeySet
+
+	db       *db.Session
+	redis    *redis.Client
+	sessions *auth.Sessions
+	client   *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+}
+
+// oidcLogin is kept in Redis between the redirect to the provider and the
+// callback.
+type oidcLogin struct {
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+}
+
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// NewOIDC discovers the provider's endpoints and signing keys.
+func NewOIDC(issuer, clientID, clientSecret, redirectURL string, session *db.Session, rdb *redis.Client, sessions *auth.Sessions) (*OIDC, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	issuer = strings.TrimSuffix(issuer, "/")
+	resp, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery failed: %s", resp.Status)
+	}
+
+	var doc oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != issuer {
+		return nil, fmt.Errorf("discovery returned issuer %q, expected %q", doc.Issuer, issuer)
+	}
+
+	keys, err := auth.NewRemoteKeySet(doc.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch provider keys: %w", err)
+	}
+
+	return &OIDC{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURL:  redirectURL,
+		authURL:      doc.AuthURL,
+		tokenURL:     doc.TokenURL,
+		keys:         keys,
+		db:           session,
+		redis:        rdb,
+		sessions:     sessions,
+		client:       client,
+	}, nil
+}
+
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Login redirects to the provider. state ties the callback to this browser
+// (via a cookie) and to the PKCE verifier and nonce stored in Redis.
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	state, err1 := randomString()
+	nonce, err2 := randomString()
+	verifier, err3 := randomString()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	data, _ := json.Marshal(oidcLogin{Verifier: verifier, Nonce: nonce})
+	if err := o.redis.Set(r.Context(), oidcStatePrefix+state, data, oidcStateTTL).Err(); err != nil {
+		log.Printf("Failed to store OIDC state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.clientID},
+		"redirect_uri":          {o.redirectURL},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, o.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// Callback finishes the login: it exchanges the code, verifies the ID token
+// and issues our own tokens for the mapped user.
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e+" "+q.Get("error_description"), http.StatusUnauthorized)
+		return
+	}
+
+	state := q.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if state == "" || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/oidc", MaxAge: -1})
+
+	// GETDEL makes the state single use.
+	data, err := o.redis.GetDel(r.Context(), oidcStatePrefix+state).Bytes()
+	if err != nil {
+		http.Error(w, "Login expired, start again", http.StatusBadRequest)
+		return
+	}
+	var login oidcLogin
+	if err := json.Unmarshal(data, &login); err != nil {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := o.exchange(r.Context(), q.Get("code"), login)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := o.userFor(claims)
+	if err != nil {
+		log.Printf("Failed to map OIDC subject %s: %v", claims.Subject, err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	pair, err := o.sessions.Issue(r.Context(), userID)
+	if err != nil {
+		log.Printf("Failed to issue tokens for %s: %v", userID, err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("OIDC login: %s (subject %s)", userID, claims.Subject)
+
+	if o.successURL != "" {
+		fragment := url.Values{
+			"token":         {pair.AccessToken},
+			"refresh_token": {pair.RefreshToken},
+			"user_id":       {pair.UserID},
+		}
+		http.Redirect(w, r, o.successURL+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// exchange trades the authorization code for an ID token and verifies it.
+func (o *OIDC) exchange(ctx context.Context, code string, login oidcLogin) (*idTokenClaims, error) {
+	if code == "" {
+		return nil, errors.New("no authorization code")
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.redirectURL},
+		"client_id":     {o.clientID},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var tok oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token endpoint returned %s: %w", resp.Status, err)
+	}
+	if tok.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", tok.Error, tok.ErrorDescription)
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("no id_token in token response")
+	}
+
+	claims := &idTokenClaims{}
+	_, err = o.keys.Parse(tok.IDToken, claims,
+		jwt.WithIssuer(o.issuer),
+		jwt.WithAudience(o.clientID),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, fmt.Errorf("invalid id_token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(login.Nonce)) != 1 {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	return claims, nil
+}
+
+// userFor returns the chat user linked to a provider subject, creating the
+// user and the link on first login.
+func (o *OIDC) userFor(claims *idTokenClaims) (string, error) {
+	var userID string
+	err := o.db.Query(`SELECT user_id FROM oidc_identities WHERE issuer = ? AND subject = ?`, o.issuer, claims.Subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, gocql.ErrNotFound) {
+		return "", err
+	}
+
+	userID, err = o.createUser(suggestUsername(claims))
+	if err != nil {
+		return "", err
+	}
+
+	// A concurrent first login may have linked the subject already; use the
+	// winner's user. The account created here stays unused.
+	existing := map[string]interface{}{}
+	applied, err := o.db.Query(`INSERT INTO oidc_identities (issuer, subject, user_id, email, created_at) VALUES (?, ?, ?, ?, ?) IF NOT EXISTS`,
+		o.issuer, claims.Subject, userID, claims.Email, time.Now()).MapScanCAS(existing)
+	if err != nil {
+		return "", err
+	}
+	if !applied {
+		userID, _ = existing["user_id"].(string)
+	}
+	return userID, nil
+}
+
+// createUser creates a password-less account, adding a numeric suffix when
+// the preferred username is taken.
+func (o *OIDC) createUser(base string) (string, error) {
+	candidate := base
+	for attempt := 0; attempt < 5; attempt++ {
+		applied, err := o.db.Query(`INSERT INTO users (user_id, created_at, failed_attempts) VALUES (?, ?, 0) IF NOT EXISTS`,
+			candidate, time.Now()).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return "", err
+		}
+		if applied {
+			log.Printf("Registered user via OIDC: %s", candidate)
+			return candidate, nil
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(10000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%.27s-%04d", base, n.Int64())
+	}
+	return "", errors.New("no free username found")
+}
+
+// suggestUsername derives a valid username from the provider's claims.
+func suggestUsername(claims *idTokenClaims) string {
+	name := claims.PreferredUsername
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + ('a' - 'A')
+		}
+		return '_'
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	if !usernamePattern.MatchString(name) {
+		name = "user"
+	}
+	return name
+}
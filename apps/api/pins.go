@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/pins"
+)
+
+// Pin is a pinned message with who pinned it.
+type Pin struct {
+	Message  model.Message `json:"message"`
+	PinnedBy string        `json:"pinned_by"`
+	PinnedAt time.Time     `json:"pinned_at"`
+}
+
+// PinsHandler manages a channel's pinned messages:
+//
+//	GET    /channels/{id}/pins          list, newest message first
+//	PUT    /channels/{id}/pins/{msgid}  pin
+//	DELETE /channels/{id}/pins/{msgid}  unpin
+//
+// Anyone who can access the channel may pin and unpin. Both are announced
+// to the channel as pin and unpin events.
+type PinsHandler struct {
+	db        *db.Session
+	publisher *MessagePublisher
+}
+
+func NewPinsHandler(session *db.Session, publisher *MessagePublisher) *PinsHandler {
+	return &PinsHandler{db: session, publisher: publisher}
+}
+
+func (h *PinsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Path: /channels/{id}/pins[/{msgid}]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	channelID := parts[1]
+	if !canAccessChannel(claims.UserID, channelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+
+	if len(parts) == 3 && r.Method == http.MethodGet {
+		h.list(w, channelID)
+		return
+	}
+	if len(parts) != 4 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	messageID, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		h.pin(w, r, claims, channelID, messageID)
+	case http.MethodDelete:
+		h.unpin(w, r, claims, channelID, messageID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *PinsHandler) list(w http.ResponseWriter, channelID string) {
+	list := []Pin{}
+	iter := h.db.Query(`SELECT message_id, pinned_by, pinned_at FROM channel_pins WHERE channel_id = ?`, channelID).Iter()
+	var messageID int64
+	var pin Pin
+	for iter.Scan(&messageID, &pin.PinnedBy, &pin.PinnedAt) {
+		msg, err := loadMessage(h.db, channelID, messageID)
+		if errors.Is(err, gocql.ErrNotFound) {
+			// Expired or purged since it was pinned, before the messaging
+			// service unpinned it.
+			if _, err := pins.Remove(h.db, channelID, messageID); err != nil {
+				log.Printf("Failed to unpin removed message %d: %v", messageID, err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load pinned message %d: %v", messageID, err)
+			continue
+		}
+		pin.Message = *msg
+		list = append(list, pin)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list pins of %s: %v", channelID, err)
+		http.Error(w, "Failed to list pins", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *PinsHandler) pin(w http.ResponseWriter, r *http.Request, claims *auth.Claims, channelID string, messageID int64) {
+	msg, err := loadMessage(h.db, channelID, messageID)
+	if errors.Is(err, gocql.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load message %d: %v", messageID, err)
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+
+	// Take one of the channel's pins before pinning, and give it back if
+	// the message turns out to be pinned already.
+	err = pins.Count(h.db, channelID, 1)
+	if errors.Is(err, pins.ErrTooMany) {
+		http.Error(w, "Channel already has "+strconv.Itoa(pins.Max)+" pinned messages", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to count pins of %s: %v", channelID, err)
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+
+	pin := Pin{Message: *msg, PinnedBy: claims.UserID, PinnedAt: time.Now()}
+	applied, err := h.db.Query(`INSERT INTO channel_pins (channel_id, message_id, pinned_by, pinned_at) VALUES (?, ?, ?, ?) IF NOT EXISTS`,
+		channelID, messageID, pin.PinnedBy, pin.PinnedAt).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		if err := pins.Count(h.db, channelID, -1); err != nil {
+			log.Printf("Failed to count pins of %s: %v", channelID, err)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to pin message %d: %v", messageID, err)
+		http.Error(w, "Failed to pin message", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		// Already pinned
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.announce(r, claims, channelID, messageID, model.TypePin)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pin)
+}
+
+func (h *PinsHandler) unpin(w http.ResponseWriter, r *http.Request, claims *auth.Claims, channelID string, messageID int64) {
+	removed, err := pins.Remove(h.db, channelID, messageID)
+	if !removed && err != nil {
+		log.Printf("Failed to unpin message %d: %v", messageID, err)
+		http.Error(w, "Failed to unpin message", http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Message is not pinned", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to unpin message %d: %v", messageID, err)
+	}
+	h.announce(r, claims, channelID, messageID, model.TypeUnpin)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// announce tells the channel's clients about a pin or unpin through Kafka,
+// from which every gateway's hub fans it out.
+func (h *PinsHandler) announce(r *http.Request, claims *auth.Claims, channelID string, messageID int64, t model.MessageType) {
+	event := &model.Message{ChannelID: channelID, UserID: claims.UserID, Type: t, TargetID: messageID}
+	if err := h.publisher.Publish(r.Context(), event); err != nil {
+		log.Printf("Failed to announce %s of message %d: %v", t, messageID, err)
+	}
+	log.Printf("User %s %sned message %d in %s", claims.UserID, t, messageID, channelID)
+}
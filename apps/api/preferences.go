@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/prefs"
+	"github.com/redis/go-redis/v9"
+)
+
+// PreferencesHandler serves the caller's notification preferences:
+//
+//	GET    /preferences                 all of them
+//	PUT    /preferences/dnd             set the do-not-disturb schedule
+//	DELETE /preferences/dnd             remove it
+//	PUT    /preferences/channels/{id}   set level and mute for a channel or DM
+//	DELETE /preferences/channels/{id}   back to the defaults
+func PreferencesHandler(session *db.Session, rdb *redis.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/preferences"), "/")
+		channelID, isChannel := strings.CutPrefix(path, "channels/")
+		switch {
+		case path == "" && r.Method == http.MethodGet:
+			p, err := prefs.Get(r.Context(), session, rdb, claims.UserID)
+			if err != nil {
+				log.Printf("Failed to load preferences of %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to load preferences", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(p)
+		case path == "dnd" && r.Method == http.MethodPut:
+			var s prefs.Schedule
+			if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := s.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := prefs.SetDND(r.Context(), session, rdb, claims.UserID, &s); err != nil {
+				log.Printf("Failed to set do not disturb for %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s)
+		case path == "dnd" && r.Method == http.MethodDelete:
+			if err := prefs.SetDND(r.Context(), session, rdb, claims.UserID, nil); err != nil {
+				log.Printf("Failed to clear do not disturb for %s: %v", claims.UserID, err)
+				http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case isChannel && channelID != "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+			setChannelPrefs(w, r, session, rdb, claims, channelID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func setChannelPrefs(w http.ResponseWriter, r *http.Request, session *db.Session, rdb *redis.Client, claims *auth.Claims, channelID string) {
+	if !canAccessChannel(claims.UserID, channelID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	c := prefs.Channel{ChannelID: channelID}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		c.ChannelID = channelID
+		if c.MutedUntil != nil && !c.MutedUntil.After(time.Now()) {
+			http.Error(w, "muted_until must be in the future", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := prefs.SetChannel(r.Context(), session, rdb, claims.UserID, &c)
+	if errors.Is(err, prefs.ErrInvalidLevel) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set preferences of %s for %s: %v", claims.UserID, channelID, err)
+		http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
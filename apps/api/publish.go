@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/segmentio/kafka-go"
+)
+
+// MessagePublisher injects messages into chat-messages, the topic gateways
+// fan out from and the messaging service persists, exactly like messages
+// sent over a websocket.
+type MessagePublisher struct {
+	writer *kafka.Writer
+	ids    *snowflake.Node
+}
+
+// NewMessagePublisher returns a publisher generating message IDs with ids.
+// Every process producing messages needs its own node.
+func NewMessagePublisher(brokers []string, topic string, ids *snowflake.Node) *MessagePublisher {
+	return &MessagePublisher{
+		writer: &kafka.Writer{
+			Addr:  kafka.TCP(brokers...),
+			Topic: topic,
+			// Keyed by channel like the gateway, so the channel's order holds.
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 10 * time.Millisecond,
+		},
+		ids: ids,
+	}
+}
+
+// Publish assigns an ID and timestamp and writes the message, returning once
+// Kafka has it.
+func (p *MessagePublisher) Publish(ctx context.Context, msg *model.Message) error {
+	msg.ID = p.ids.Generate()
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return p.writer.WriteMessages(ctx, kafka.Message{Key: []byte(msg.ChannelID), Value: payload})
+}
+
+func (p *MessagePublisher) Close() error {
+	return p.writer.Close()
+}
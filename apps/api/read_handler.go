@@ -2,14 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/mahaj/networking-minor/pkg/auth"
 	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/mahaj/networking-minor/pkg/unread"
 )
 
+// Message IDs are generated from the clock of the service that sent them,
+// which may run a little ahead of ours.
+const maxClockSkew = time.Minute
+
 type ReadRequest struct {
 	OtherUserID string `json:"other_user_id"`
+
+	// Last message the user has seen. Defaults to the newest unread one.
+	LastReadID int64 `json:"last_read_id,omitempty"`
 }
 
 func ReadHandler(session *db.Session) http.HandlerFunc {
@@ -26,15 +39,37 @@ func ReadHandler(session *db.Session) http.HandlerFunc {
 		}
 
 		var req ReadRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OtherUserID == "" || req.LastReadID < 0 {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		// Delete the row from conversation_counters to reset count to 0
-		// In ScyllaDB counters, deletion is the way to reset.
-		query := `DELETE FROM conversation_counters WHERE user_id = ? AND other_user_id = ?`
-		if err := session.Query(query, claims.UserID, req.OtherUserID).Exec(); err != nil {
+		// The ID is also the write timestamp of the cursor, so an ID from the
+		// future would pin it there. Only messages of this DM will do.
+		if req.LastReadID != 0 {
+			if req.LastReadID >= snowflake.MinID(time.Now().Add(maxClockSkew)) {
+				http.Error(w, "last_read_id is not a message of this conversation", http.StatusBadRequest)
+				return
+			}
+			u1, u2 := claims.UserID, req.OtherUserID
+			if u1 > u2 {
+				u1, u2 = u2, u1
+			}
+			var id int64
+			err := session.Query(`SELECT id FROM messages WHERE channel_id = ? AND id = ?`, "dm:"+u1+":"+u2, req.LastReadID).Scan(&id)
+			if errors.Is(err, gocql.ErrNotFound) {
+				http.Error(w, "last_read_id is not a message of this conversation", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("Failed to load message %d for %s: %v", req.LastReadID, claims.UserID, err)
+				http.Error(w, "Failed to reset unread count", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if err := unread.Read(session, claims.UserID, req.OtherUserID, req.LastReadID); err != nil {
+			log.Printf("Failed to move read cursor for %s: %v", claims.UserID, err)
 			http.Error(w, "Failed to reset unread count", http.StatusInternalServerError)
 			return
 		}
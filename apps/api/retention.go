@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/retention"
+)
+
+// RetentionResponse is the policy that applies to a channel, or to the
+// workspace for GET /retention.
+type RetentionResponse struct {
+	ChannelID string `json:"channel_id"`
+	retention.Policy
+
+	// Set when the channel has no policy of its own and uses the
+	// workspace default.
+	Inherited bool `json:"inherited,omitempty"`
+}
+
+// RetentionHandler reads and sets how long messages are kept.
+//
+//	GET|PUT /retention                       workspace default, admins only
+//	GET|PUT|DELETE /channels/{id}/retention  one channel
+//
+// Either participant of a DM may set its policy, e.g. to make its messages
+// disappear, within the workspace's limits; other channels need an admin.
+// DELETE goes back to the workspace default. The messaging service picks up
+// changes within 30 seconds.
+func RetentionHandler(session *db.Session, admins map[string]bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		channelID := retention.Workspace
+		if parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/"); parts[0] == "channels" {
+			if len(parts) != 3 {
+				http.Error(w, "Not found", http.StatusNotFound)
+				return
+			}
+			channelID = parts[1]
+		}
+		if !canAccessChannel(claims.UserID, channelID) {
+			http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			getRetention(w, session, channelID)
+			return
+		}
+
+		isDM := strings.HasPrefix(channelID, "dm:")
+		if !isDM && !admins[claims.UserID] {
+			http.Error(w, "Only admins can change this retention policy", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPut:
+			var p retention.Policy
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := p.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Participants may shorten the workspace's retention of their
+			// DM, not lengthen it.
+			if isDM {
+				workspace, _, err := retention.Get(session, retention.Workspace)
+				if err != nil {
+					log.Printf("Failed to load workspace retention policy: %v", err)
+					http.Error(w, "Failed to save retention policy", http.StatusInternalServerError)
+					return
+				}
+				p = p.Within(workspace)
+			}
+			p.UpdatedBy, p.UpdatedAt = claims.UserID, time.Now()
+			if err := retention.Save(session, channelID, p); err != nil {
+				log.Printf("Failed to save retention policy for %s: %v", channelID, err)
+				http.Error(w, "Failed to save retention policy", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s set retention of %s to %d days, disappearing after %ds", claims.UserID, channelID, p.RetentionDays, p.DisappearSeconds)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(RetentionResponse{ChannelID: channelID, Policy: p})
+
+		case r.Method == http.MethodDelete && channelID != retention.Workspace:
+			if err := retention.Delete(session, channelID); err != nil {
+				log.Printf("Failed to delete retention policy for %s: %v", channelID, err)
+				http.Error(w, "Failed to delete retention policy", http.StatusInternalServerError)
+				return
+			}
+			log.Printf("User %s reset retention of %s to the workspace default", claims.UserID, channelID)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func getRetention(w http.ResponseWriter, session *db.Session, channelID string) {
+	p, ok, err := retention.Get(session, channelID)
+	inherited := false
+	if err == nil && !ok && channelID != retention.Workspace {
+		p, _, err = retention.Get(session, retention.Workspace)
+		inherited = true
+	}
+	if err != nil {
+		log.Printf("Failed to load retention policy for %s: %v", channelID, err)
+		http.Error(w, "Failed to load retention policy", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RetentionResponse{ChannelID: channelID, Policy: p, Inherited: inherited})
+}
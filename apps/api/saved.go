@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+const (
+	// Maximum number of messages a user can save.
+	maxSaved = 500
+
+	// Saved messages returned per page by default, and at most.
+	defaultSavedPage = 50
+	maxSavedPage     = 200
+)
+
+// SavedMessage is a message the caller saved.
+type SavedMessage struct {
+	Message model.Message `json:"message"`
+	SavedAt time.Time     `json:"saved_at"`
+}
+
+// SavedHandler manages the caller's saved messages:
+//
+//	GET    /saved                           list, most recently saved first; ?limit=&offset=
+//	PUT    /saved/{channel_id}/{message_id} save
+//	DELETE /saved/{channel_id}/{message_id} unsave
+//
+// Messages in channels the caller can no longer access are left out.
+func SavedHandler(session *db.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/saved"), "/")
+		if path == "" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			listSaved(w, r, session, claims)
+			return
+		}
+
+		// Channel IDs have no slashes, so the message ID is what follows the last one
+		i := strings.LastIndex(path, "/")
+		if i <= 0 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		channelID := path[:i]
+		messageID, err := strconv.ParseInt(path[i+1:], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			saveMessage(w, session, claims, channelID, messageID)
+		case http.MethodDelete:
+			err := session.Query(`DELETE FROM saved_messages WHERE user_id = ? AND channel_id = ? AND message_id = ?`, claims.UserID, channelID, messageID).Exec()
+			if err != nil {
+				log.Printf("Failed to unsave message %d for %s: %v", messageID, claims.UserID, err)
+				http.Error(w, "Failed to unsave message", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+type savedRef struct {
+	channelID string
+	messageID int64
+	savedAt   time.Time
+}
+
+func loadSaved(session *db.Session, userID string) ([]savedRef, error) {
+	var refs []savedRef
+	var ref savedRef
+	iter := session.Query(`SELECT channel_id, message_id, saved_at FROM saved_messages WHERE user_id = ?`, userID).Iter()
+	for iter.Scan(&ref.channelID, &ref.messageID, &ref.savedAt) {
+		refs = append(refs, ref)
+	}
+	return refs, iter.Close()
+}
+
+func listSaved(w http.ResponseWriter, r *http.Request, session *db.Session, claims *auth.Claims) {
+	limit := defaultSavedPage
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= maxSavedPage {
+		limit = l
+	}
+	offset := 0
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	refs, err := loadSaved(session, claims.UserID)
+	if err != nil {
+		log.Printf("Failed to list saved messages of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to list saved messages", http.StatusInternalServerError)
+		return
+	}
+	refs = slices.DeleteFunc(refs, func(ref savedRef) bool { return !canAccessChannel(claims.UserID, ref.channelID) })
+	slices.SortFunc(refs, func(a, b savedRef) int { return b.savedAt.Compare(a.savedAt) })
+	refs = refs[min(offset, len(refs)):min(offset+limit, len(refs))]
+
+	saved := []SavedMessage{}
+	for _, ref := range refs {
+		msg, err := loadMessage(session, ref.channelID, ref.messageID)
+		if errors.Is(err, gocql.ErrNotFound) {
+			// Expired or purged since it was saved.
+			unsaveRemoved(session, claims.UserID, ref)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to load saved message %d: %v", ref.messageID, err)
+			continue
+		}
+		saved = append(saved, SavedMessage{Message: *msg, SavedAt: ref.savedAt})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
+
+func saveMessage(w http.ResponseWriter, session *db.Session, claims *auth.Claims, channelID string, messageID int64) {
+	if !canAccessChannel(claims.UserID, channelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+	msg, err := loadMessage(session, channelID, messageID)
+	if errors.Is(err, gocql.ErrNotFound) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load message %d: %v", messageID, err)
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
+	}
+
+	refs, err := loadSaved(session, claims.UserID)
+	if err != nil {
+		log.Printf("Failed to list saved messages of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
+	}
+	for _, ref := range refs {
+		if ref.channelID == channelID && ref.messageID == messageID {
+			// Already saved
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(SavedMessage{Message: *msg, SavedAt: ref.savedAt})
+			return
+		}
+	}
+	if len(refs) >= maxSaved {
+		refs = pruneSaved(session, claims.UserID, refs)
+	}
+	if len(refs) >= maxSaved {
+		http.Error(w, "Too many saved messages, the limit is "+strconv.Itoa(maxSaved), http.StatusConflict)
+		return
+	}
+
+	saved := SavedMessage{Message: *msg, SavedAt: time.Now()}
+	err = session.Query(`INSERT INTO saved_messages (user_id, channel_id, message_id, saved_at) VALUES (?, ?, ?, ?)`, claims.UserID, channelID, messageID, saved.SavedAt).Exec()
+	if err != nil {
+		log.Printf("Failed to save message %d for %s: %v", messageID, claims.UserID, err)
+		http.Error(w, "Failed to save message", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// pruneSaved unsaves the user's messages that were expired or purged since
+// they were saved, so they stop counting against maxSaved, and returns the
+// rest.
+func pruneSaved(session *db.Session, userID string, refs []savedRef) []savedRef {
+	return slices.DeleteFunc(refs, func(ref savedRef) bool {
+		_, err := loadMessage(session, ref.channelID, ref.messageID)
+		if !errors.Is(err, gocql.ErrNotFound) {
+			return false
+		}
+		unsaveRemoved(session, userID, ref)
+		return true
+	})
+}
+
+// unsaveRemoved deletes a saved message that no longer exists.
+func unsaveRemoved(session *db.Session, userID string, ref savedRef) {
+	err := session.Query(`DELETE FROM saved_messages WHERE user_id = ? AND channel_id = ? AND message_id = ?`, userID, ref.channelID, ref.messageID).Exec()
+	if err != nil {
+		log.Printf("Failed to unsave removed message %d for %s: %v", ref.messageID, userID, err)
+	}
+}
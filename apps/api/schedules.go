@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/schedule"
+)
+
+const (
+	// Limits on schedules.
+	maxScheduledLength  = 4000
+	maxReminderNote     = 500
+	maxPendingSchedules = 100
+	maxScheduleAhead    = 365 * 24 * time.Hour
+)
+
+type CreateScheduleRequest struct {
+	// schedule.KindMessage (the default) or schedule.KindReminder.
+	Kind      string    `json:"kind"`
+	ChannelID string    `json:"channel_id"`
+	Content   string    `json:"content"`
+	TargetID  int64     `json:"target_id"`
+	SendAt    time.Time `json:"send_at"`
+}
+
+// UpdateScheduleRequest changes the fields that are set.
+type UpdateScheduleRequest struct {
+	Content *string    `json:"content"`
+	SendAt  *time.Time `json:"send_at"`
+}
+
+// SchedulesHandler manages the caller's scheduled messages and reminders:
+//
+//	POST   /schedules       schedule a message, or a reminder of a message
+//	GET    /schedules       list them, optionally ?status=pending
+//	PATCH  /schedules/{id}  change the content or send time
+//	DELETE /schedules/{id}  cancel
+//
+// Only pending schedules can be changed or cancelled.
+func SchedulesHandler(session *db.Session) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/schedules"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			createSchedule(w, r, session, claims)
+		case id == "" && r.Method == http.MethodGet:
+			listSchedules(w, r, session, claims)
+		case id != "" && r.Method == http.MethodPatch:
+			updateSchedule(w, r, session, claims, id)
+		case id != "" && r.Method == http.MethodDelete:
+			cancelSchedule(w, session, claims, id)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// validSendAt checks that a send time is in the future, but not too far.
+func validSendAt(t time.Time) bool {
+	return t.After(time.Now()) && time.Until(t) <= maxScheduleAhead
+}
+
+func createSchedule(w http.ResponseWriter, r *http.Request, session *db.Session, claims *auth.Claims) {
+	var req CreateScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = schedule.KindMessage
+	}
+	if req.ChannelID == "" || !validSendAt(req.SendAt) {
+		http.Error(w, "channel_id and a send_at in the next year are required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessChannel(claims.UserID, req.ChannelID) || !claims.Allows(auth.ScopeMessagesWrite, req.ChannelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+
+	switch req.Kind {
+	case schedule.KindMessage:
+		if req.Content == "" || len(req.Content) > maxScheduledLength {
+			http.Error(w, "content must be 1-"+strconv.Itoa(maxScheduledLength)+" bytes", http.StatusBadRequest)
+			return
+		}
+		req.TargetID = 0
+	case schedule.KindReminder:
+		if len(req.Content) > maxReminderNote {
+			http.Error(w, "content must be at most "+strconv.Itoa(maxReminderNote)+" bytes", http.StatusBadRequest)
+			return
+		}
+		var found int64
+		err := session.Query(`SELECT id FROM messages WHERE channel_id = ? AND id = ?`, req.ChannelID, req.TargetID).Scan(&found)
+		if errors.Is(err, gocql.ErrNotFound) {
+			http.Error(w, "target_id is not a message in this channel", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up message %d: %v", req.TargetID, err)
+			http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "kind must be message or reminder", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := schedule.List(session, claims.UserID)
+	if err != nil {
+		log.Printf("Failed to list schedules of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+		return
+	}
+	pending := 0
+	for _, sc := range existing {
+		if sc.Status == schedule.StatusPending {
+			pending++
+		}
+	}
+	if pending >= maxPendingSchedules {
+		http.Error(w, "Too many pending schedules, the limit is "+strconv.Itoa(maxPendingSchedules), http.StatusConflict)
+		return
+	}
+
+	idBuf := make([]byte, 8)
+	if _, err := rand.Read(idBuf); err != nil {
+		http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+		return
+	}
+	sc := &schedule.Schedule{
+		ID:        hex.EncodeToString(idBuf),
+		UserID:    claims.UserID,
+		Kind:      req.Kind,
+		ChannelID: req.ChannelID,
+		Content:   req.Content,
+		TargetID:  req.TargetID,
+		SendAt:    req.SendAt.UTC(),
+		Status:    schedule.StatusPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := schedule.Create(session, sc); err != nil {
+		log.Printf("Failed to create schedule for %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to create schedule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s scheduled %s %s in %s for %s", claims.UserID, sc.Kind, sc.ID, sc.ChannelID, sc.SendAt.Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sc)
+}
+
+func listSchedules(w http.ResponseWriter, r *http.Request, session *db.Session, claims *auth.Claims) {
+	schedules, err := schedule.List(session, claims.UserID)
+	if err != nil {
+		log.Printf("Failed to list schedules of %s: %v", claims.UserID, err)
+		http.Error(w, "Failed to list schedules", http.StatusInternalServerError)
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		schedules = slices.DeleteFunc(schedules, func(sc *schedule.Schedule) bool { return sc.Status != status })
+	}
+	slices.SortFunc(schedules, func(a, b *schedule.Schedule) int { return a.SendAt.Compare(b.SendAt) })
+	if schedules == nil {
+		schedules = []*schedule.Schedule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func updateSchedule(w http.ResponseWriter, r *http.Request, session *db.Session, claims *auth.Claims, id string) {
+	var req UpdateScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	sc, err := schedule.Get(session, claims.UserID, id)
+	if errors.Is(err, schedule.ErrNotFound) {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load schedule %s: %v", id, err)
+		http.Error(w, "Failed to update schedule", http.StatusInternalServerError)
+		return
+	}
+
+	moved := false
+	if req.SendAt != nil {
+		if !validSendAt(*req.SendAt) {
+			http.Error(w, "send_at must be in the next year", http.StatusBadRequest)
+			return
+		}
+		moved = !req.SendAt.Equal(sc.SendAt)
+		sc.SendAt = req.SendAt.UTC()
+	}
+	if req.Content != nil {
+		limit := maxScheduledLength
+		if sc.Kind == schedule.KindReminder {
+			limit = maxReminderNote
+		}
+		if len(*req.Content) > limit || (*req.Content == "" && sc.Kind == schedule.KindMessage) {
+			http.Error(w, "content must be 1-"+strconv.Itoa(limit)+" bytes", http.StatusBadRequest)
+			return
+		}
+		sc.Content = *req.Content
+	}
+
+	applied, err := schedule.Update(session, sc)
+	if err != nil {
+		log.Printf("Failed to update schedule %s: %v", id, err)
+		http.Error(w, "Failed to update schedule", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		http.Error(w, "Schedule was already sent or cancelled", http.StatusConflict)
+		return
+	}
+	// The entry under the old time is dropped when it comes due.
+	if moved {
+		if err := schedule.Enqueue(session, sc); err != nil {
+			log.Printf("Failed to queue schedule %s: %v", id, err)
+			http.Error(w, "Failed to update schedule", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sc)
+}
+
+func cancelSchedule(w http.ResponseWriter, session *db.Session, claims *auth.Claims, id string) {
+	if _, err := schedule.Get(session, claims.UserID, id); errors.Is(err, schedule.ErrNotFound) {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load schedule %s: %v", id, err)
+		http.Error(w, "Failed to cancel schedule", http.StatusInternalServerError)
+		return
+	}
+
+	applied, err := schedule.Cancel(session, claims.UserID, id)
+	if err != nil {
+		log.Printf("Failed to cancel schedule %s: %v", id, err)
+		http.Error(w, "Failed to cancel schedule", http.StatusInternalServerError)
+		return
+	}
+	if !applied {
+		http.Error(w, "Schedule was already sent or cancelled", http.StatusConflict)
+		return
+	}
+	log.Printf("User %s cancelled schedule %s", claims.UserID, id)
+	w.WriteHeader(http.StatusNoContent)
+}
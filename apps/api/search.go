@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/search"
+)
+
+// SearchHandler serves GET /search. The index lives in the messaging
+// service; this handler authorizes the query and forwards it there.
+//
+//	q       terms and "quoted phrases" (required)
+//	channel only this channel
+//	user    only messages by this user
+//	after   only messages sent at or after this time (RFC 3339 or YYYY-MM-DD)
+//	before  only messages sent at or before this time
+//	sort    relevance (default) or recent
+//	limit, offset
+//
+// Results only include channels the caller can read. API keys need
+// history:read and, if they are limited to channels, a channel filter.
+type SearchHandler struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewSearchHandler(searchURL, secret string) *SearchHandler {
+	return &SearchHandler{
+		url:    strings.TrimSuffix(searchURL, "/") + "/internal/search",
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// parseSearchTime accepts RFC 3339 times and plain dates. A plain date used
+// as an upper bound covers the whole day.
+func parseSearchTime(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	params := r.URL.Query()
+	q := search.Query{
+		Text:      params.Get("q"),
+		ChannelID: params.Get("channel"),
+		UserID:    params.Get("user"),
+		Sort:      params.Get("sort"),
+		Reader:    claims.UserID,
+	}
+	if strings.TrimSpace(q.Text) == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if q.Sort != "" && q.Sort != search.SortRelevance && q.Sort != search.SortRecent {
+		http.Error(w, "sort must be relevance or recent", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if v := params.Get("after"); v != "" {
+		if q.After, err = parseSearchTime(v, false); err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("before"); v != "" {
+		if q.Before, err = parseSearchTime(v, true); err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > search.MaxLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(search.MaxLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if q.ChannelID != "" && !canAccessChannel(claims.UserID, q.ChannelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+	if k := claims.APIKey; k != nil && len(k.Channels) > 0 && q.ChannelID == "" {
+		http.Error(w, "This API key must search one of its channels", http.StatusForbidden)
+		return
+	}
+	if !claims.Allows(auth.ScopeHistoryRead, q.ChannelID) {
+		http.Error(w, "API key is not allowed on this channel", http.StatusForbidden)
+		return
+	}
+
+	body, err := json.Marshal(q)
+	if err != nil {
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(search.SecretHeader, h.secret)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		log.Printf("Search service unavailable: %v", err)
+		http.Error(w, "Search is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		log.Printf("Search service returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+		if resp.StatusCode == http.StatusBadRequest {
+			http.Error(w, string(bytes.TrimSpace(msg)), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Search failed", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, resp.Body)
+}
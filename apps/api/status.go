@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mahaj/networking-minor/pkg/status"
+	"github.com/redis/go-redis/v9"
+)
+
+// Maximum number of users per bulk status request.
+const maxStatusBatch = 500
+
+type StatusHandler struct {
+	redis *redis.Client
+}
+
+func NewStatusHandler(redisAddr string) *StatusHandler {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+	return &StatusHandler{redis: rdb}
+}
+
+// ServeHTTP returns the status of every user in ?ids=a,b,c.
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxStatusBatch {
+		http.Error(w, "Too many ids", http.StatusBadRequest)
+		return
+	}
+
+	statuses, err := status.Get(context.Background(), h.redis, ids...)
+	if err != nil {
+		log.Printf("Failed to fetch statuses: %v", err)
+		http.Error(w, "Failed to fetch statuses", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
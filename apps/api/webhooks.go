@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/netguard"
+	"github.com/mahaj/networking-minor/pkg/webhook"
+)
+
+// Number of entries returned by the delivery log and dead-letter endpoints.
+const webhookLogPageSize = 100
+
+type Webhook struct {
+	ID        string    `json:"id"`
+	ChannelID string    `json:"channel_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	// Only returned when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type WebhookDelivery struct {
+	DeliveryID string    `json:"delivery_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int       `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+}
+
+type WebhookDeadLetter struct {
+	DeliveryID string          `json:"delivery_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+// WebhooksHandler manages a channel's outgoing webhooks. The messaging
+// service delivers the events.
+//
+//	POST   /channels/{id}/webhooks                        register a webhook
+//	GET    /channels/{id}/webhooks                        list webhooks
+//	DELETE /channels/{id}/webhooks/{webhook}              remove a webhook
+//	GET    /channels/{id}/webhooks/{webhook}/deliveries   recent attempts
+//	GET    /channels/{id}/webhooks/{webhook}/dead-letters failed deliveries
+//
+// Anyone who can access the channel may register and list webhooks; only a
+// webhook's creator may remove it or read its logs.
+type WebhooksHandler struct {
+	db *db.Session
+}
+
+func NewWebhooksHandler(session *db.Session) *WebhooksHandler {
+	return &WebhooksHandler{db: session}
+}
+
+func (h *WebhooksHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, ok := r.Context().Value(auth.UserKey).(*auth.Claims)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Path: /channels/{id}/webhooks[/{webhook}[/deliveries|/dead-letters]]
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	channelID := parts[1]
+	if !canAccessChannel(claims.UserID, channelID) {
+		http.Error(w, "Unauthorized to access this channel", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		h.create(w, r, claims, channelID)
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		h.list(w, channelID)
+	case len(parts) == 4 && r.Method == http.MethodDelete:
+		h.remove(w, claims, channelID, parts[3])
+	case len(parts) == 5 && parts[4] == "deliveries" && r.Method == http.MethodGet:
+		h.deliveries(w, claims, channelID, parts[3])
+	case len(parts) == 5 && parts[4] == "dead-letters" && r.Method == http.MethodGet:
+		h.deadLetters(w, claims, channelID, parts[3])
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (h *WebhooksHandler) create(w http.ResponseWriter, r *http.Request, claims *auth.Claims, channelID string) {
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	// The messaging service checks again when it connects, in case the
+	// name is pointed somewhere else later.
+	if err := netguard.CheckHost(r.Context(), u.Hostname()); err != nil {
+		http.Error(w, "url must point to a public address", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = webhook.Events
+	}
+	for _, e := range req.Events {
+		if !webhook.ValidEvent(e) {
+			http.Error(w, "unknown event "+e+", expected one of "+strings.Join(webhook.Events, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+
+	idBuf := make([]byte, 8)
+	secretBuf := make([]byte, 32)
+	if _, err := rand.Read(idBuf); err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	if _, err := rand.Read(secretBuf); err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	hook := Webhook{
+		ID:        hex.EncodeToString(idBuf),
+		ChannelID: channelID,
+		URL:       req.URL,
+		Events:    req.Events,
+		CreatedBy: claims.UserID,
+		CreatedAt: time.Now(),
+		Secret:    "whsec_" + base64.RawURLEncoding.EncodeToString(secretBuf),
+	}
+	query := `INSERT INTO channel_webhooks (channel_id, webhook_id, url, secret, events, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if err := h.db.Query(query, channelID, hook.ID, hook.URL, hook.Secret, hook.Events, hook.CreatedBy, hook.CreatedAt).Exec(); err != nil {
+		log.Printf("Failed to create webhook for %s: %v", channelID, err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s added webhook %s to channel %s", claims.UserID, hook.ID, channelID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+func (h *WebhooksHandler) list(w http.ResponseWriter, channelID string) {
+	iter := h.db.Query(`SELECT webhook_id, url, events, created_by, created_at FROM channel_webhooks WHERE channel_id = ?`, channelID).Iter()
+
+	hooks := []Webhook{}
+	hook := Webhook{ChannelID: channelID}
+	for iter.Scan(&hook.ID, &hook.URL, &hook.Events, &hook.CreatedBy, &hook.CreatedAt) {
+		hooks = append(hooks, hook)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list webhooks for %s: %v", channelID, err)
+		http.Error(w, "Failed to list webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// owned checks that the webhook exists and was created by the caller.
+func (h *WebhooksHandler) owned(w http.ResponseWriter, claims *auth.Claims, channelID, webhookID string) bool {
+	var createdBy string
+	err := h.db.Query(`SELECT created_by FROM channel_webhooks WHERE channel_id = ? AND webhook_id = ?`, channelID, webhookID).Scan(&createdBy)
+	if err != nil || createdBy != claims.UserID {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+func (h *WebhooksHandler) remove(w http.ResponseWriter, claims *auth.Claims, channelID, webhookID string) {
+	if !h.owned(w, claims, channelID, webhookID) {
+		return
+	}
+	if err := h.db.Query(`DELETE FROM channel_webhooks WHERE channel_id = ? AND webhook_id = ?`, channelID, webhookID).Exec(); err != nil {
+		log.Printf("Failed to delete webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s removed webhook %s from channel %s", claims.UserID, webhookID, channelID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *WebhooksHandler) deliveries(w http.ResponseWriter, claims *auth.Claims, channelID, webhookID string) {
+	if !h.owned(w, claims, channelID, webhookID) {
+		return
+	}
+
+	iter := h.db.Query(`SELECT attempt_id, delivery_id, event, attempt, status_code, error, duration_ms FROM webhook_deliveries WHERE webhook_id = ? LIMIT ?`,
+		webhookID, webhookLogPageSize).Iter()
+
+	deliveries := []WebhookDelivery{}
+	var attemptID gocql.UUID
+	var d WebhookDelivery
+	for iter.Scan(&attemptID, &d.DeliveryID, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.DurationMS) {
+		d.Time = attemptID.Time()
+		deliveries = append(deliveries, d)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to read deliveries of webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to read deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+func (h *WebhooksHandler) deadLetters(w http.ResponseWriter, claims *auth.Claims, channelID, webhookID string) {
+	if !h.owned(w, claims, channelID, webhookID) {
+		return
+	}
+
+	iter := h.db.Query(`SELECT failed_id, delivery_id, event, payload, attempts, last_error FROM webhook_dead_letters WHERE webhook_id = ? LIMIT ?`,
+		webhookID, webhookLogPageSize).Iter()
+
+	letters := []WebhookDeadLetter{}
+	var failedID gocql.UUID
+	var payload string
+	var d WebhookDeadLetter
+	for iter.Scan(&failedID, &d.DeliveryID, &d.Event, &payload, &d.Attempts, &d.LastError) {
+		d.FailedAt = failedID.Time()
+		d.Payload = json.RawMessage(payload)
+		letters = append(letters, d)
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to read dead letters of webhook %s: %v", webhookID, err)
+		http.Error(w, "Failed to read dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+)
+
+// Bots connect with API keys instead of access tokens. The key's scopes and
+// channel list limit what the connection may do, and every connection and
+// message is recorded in the key's audit log.
+
+// allows reports whether the client may use scope in its channel.
+func (c *Client) allows(scope string) bool {
+	return c.claims.Allows(scope, c.ChannelID)
+}
+
+// audit records an action taken with the client's API key. Clients using
+// access tokens are not audited.
+func (c *Client) audit(action, detail string) {
+	if c.claims.APIKey == nil {
+		return
+	}
+	err := c.hub.apiKeys.Audit(context.Background(), c.claims.APIKey.ID, auth.AuditEntry{
+		Action:     action,
+		Detail:     detail,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+	})
+	if err != nil {
+		log.Printf("Failed to audit API key %s: %v", c.claims.APIKey.ID, err)
+	}
+}
+
+// authenticate verifies an access token or API key.
+func (h *Hub) authenticate(ctx context.Context, credential string) (*auth.Claims, error) {
+	if auth.IsAPIKey(credential) {
+		k, err := h.apiKeys.Verify(ctx, credential)
+		if err != nil {
+			return nil, err
+		}
+		return k.Claims(), nil
+	}
+	return h.sessions.Validate(ctx, credential)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/blob"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// Maximum number of attachments on one message.
+const maxAttachments = 10
+
+var errUnknownAttachment = errors.New("unknown or expired attachment")
+
+// resolveAttachments turns the attachment IDs of a message into their
+// metadata. Each one must have been uploaded by the sender to the channel
+// the message is sent to.
+func (h *Hub) resolveAttachments(c *Client, ids []string) ([]model.Attachment, error) {
+	if len(ids) > maxAttachments {
+		return nil, fmt.Errorf("at most %d attachments per message", maxAttachments)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = blob.UploadKey(id)
+	}
+	values, err := h.redis.MGet(ctx, keys...).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("looking up attachments: %w", err)
+	}
+
+	attachments := make([]model.Attachment, 0, len(ids))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			return nil, errUnknownAttachment
+		}
+		var up blob.Upload
+		if err := json.Unmarshal([]byte(data), &up); err != nil {
+			return nil, errUnknownAttachment
+		}
+		if up.ChannelID != c.ChannelID || up.UploaderID != c.ID {
+			return nil, errUnknownAttachment
+		}
+		attachments = append(attachments, up.Attachment)
+	}
+	return attachments, nil
+}
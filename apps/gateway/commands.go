@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/bot"
+	"github.com/mahaj/networking-minor/pkg/commands"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/netguard"
+	"github.com/mahaj/networking-minor/pkg/prefs"
+	"github.com/mahaj/networking-minor/pkg/webhook"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long an external command has to answer.
+	commandTimeout = 3 * time.Second
+
+	// Replies to commands are sent as this user ID prefix followed by the
+	// command name.
+	commandUserPrefix = "command:"
+
+	maxTopicLength = 250
+
+	// Invites a user may send per inviteWindow.
+	maxInvites   = 20
+	inviteWindow = time.Hour
+)
+
+// Command URLs are user-supplied, so invocations only ever connect to
+// public addresses.
+var commandClient = netguard.Client(commandTimeout)
+
+// builtinCommand is a command the gateway implements itself.
+type builtinCommand struct {
+	usage string
+	run   func(c *Client, args string)
+}
+
+var builtinRuns = map[string]func(c *Client, args string){
+	"help":   (*Client).cmdHelp,
+	"me":     (*Client).cmdMe,
+	"topic":  (*Client).cmdTopic,
+	"invite": (*Client).cmdInvite,
+	"mute":   (*Client).cmdMute,
+	"unmute": (*Client).cmdUnmute,
+	"notify": (*Client).cmdNotify,
+}
+
+// builtinCommands pairs commands.Builtins, which the API keeps from being
+// registered, with their implementations.
+var builtinCommands map[string]builtinCommand
+
+func init() {
+	builtinCommands = make(map[string]builtinCommand, len(commands.Builtins))
+	for name, usage := range commands.Builtins {
+		run, ok := builtinRuns[name]
+		if !ok {
+			panic("built-in command /" + name + " is not implemented")
+		}
+		builtinCommands[name] = builtinCommand{usage, run}
+	}
+	for name := range builtinRuns {
+		if _, ok := commands.Builtins[name]; !ok {
+			panic("built-in command /" + name + " is missing from commands.Builtins")
+		}
+	}
+}
+
+// Messages starting with "/" are commands. They are handled here instead of
+// being broadcast; replies go only to the caller's connection. Commands the
+// gateway does not implement are looked up among the ones registered
+// through the API and forwarded to their bot over HTTP.
+
+func topicKey(channelID string) string {
+	return "channel:" + channelID + ":topic"
+}
+
+// handleCommand runs a message starting with "/".
+func (c *Client) handleCommand(content string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(content, "/"), " ")
+	name = strings.ToLower(name)
+	args = strings.TrimSpace(args)
+
+	c.audit("ws.command", "/"+name+" in "+c.ChannelID)
+	if cmd, ok := builtinCommands[name]; ok {
+		cmd.run(c, args)
+		return
+	}
+	// External commands make a network call; don't hold up the read loop.
+	go c.runExternal(name, args)
+}
+
+// reply sends an ephemeral message to the caller.
+func (c *Client) reply(command, text string) {
+	c.hub.SendTo(c, &model.Message{
+		ChannelID: c.ChannelID,
+		UserID:    commandUserPrefix + command,
+		Content:   text,
+		Type:      model.TypeEphemeral,
+	})
+}
+
+func (c *Client) cmdHelp(string) {
+	var lines []string
+	for _, cmd := range builtinCommands {
+		lines = append(lines, cmd.usage)
+	}
+	sort.Strings(lines)
+
+	registered, err := commands.List(context.Background(), c.hub.redis)
+	if err != nil {
+		log.Printf("Failed to list commands: %v", err)
+	}
+	sort.Slice(registered, func(i, j int) bool { return registered[i].Name < registered[j].Name })
+	for _, r := range registered {
+		lines = append(lines, "/"+r.Name+" - "+r.Description)
+	}
+	c.reply("help", strings.Join(lines, "\n"))
+}
+
+func (c *Client) cmdMe(args string) {
+	if args == "" {
+		c.reply("me", "Usage: "+builtinCommands["me"].usage)
+		return
+	}
+	c.hub.Publish(&model.Message{
+		ChannelID: c.ChannelID,
+		UserID:    c.ID,
+		Content:   "_" + args + "_",
+		Type:      model.TypeMessage,
+	})
+}
+
+func (c *Client) cmdTopic(args string) {
+	ctx := context.Background()
+	if args == "" {
+		topic, err := c.hub.redis.Get(ctx, topicKey(c.ChannelID)).Result()
+		switch {
+		case errors.Is(err, redis.Nil):
+			c.reply("topic", "No topic is set.")
+		case err != nil:
+			log.Printf("Failed to read topic of %s: %v", c.ChannelID, err)
+			c.reply("topic", "Could not read the topic, try again.")
+		default:
+			c.reply("topic", "Topic: "+topic)
+		}
+		return
+	}
+
+	// The topic is shown to everyone in the channel.
+	if !c.allows(auth.ScopeMessagesWrite) || !canJoin(c.ID, c.ChannelID) {
+		c.reply("topic", "You cannot set the topic of "+c.ChannelID+".")
+		return
+	}
+	if len(args) > maxTopicLength {
+		c.reply("topic", fmt.Sprintf("Topics are limited to %d characters.", maxTopicLength))
+		return
+	}
+	if err := c.hub.redis.Set(ctx, topicKey(c.ChannelID), args, 0).Err(); err != nil {
+		log.Printf("Failed to set topic of %s: %v", c.ChannelID, err)
+		c.reply("topic", "Could not set the topic, try again.")
+		return
+	}
+	c.hub.Publish(&model.Message{
+		ChannelID: c.ChannelID,
+		UserID:    c.ID,
+		Content:   args,
+		Type:      model.TypeTopic,
+	})
+}
+
+// cmdInvite sends the invitee an invite event in the DM channel shared with
+// the inviter, which reaches them wherever they are connected.
+func (c *Client) cmdInvite(args string) {
+	invitee := strings.TrimPrefix(args, "@")
+	switch {
+	case invitee == "" || strings.ContainsAny(invitee, ": "):
+		c.reply("invite", "Usage: "+builtinCommands["invite"].usage)
+		return
+	case invitee == c.ID:
+		c.reply("invite", "You are already here.")
+		return
+	case strings.HasPrefix(c.ChannelID, "dm:"):
+		c.reply("invite", "Direct messages are between two people; invite them to a channel instead.")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	invitee = strings.ToLower(invitee)
+	var exists string
+	err := c.hub.db.Query(`SELECT user_id FROM users WHERE user_id = ?`, invitee).WithContext(ctx).Scan(&exists)
+	if errors.Is(err, gocql.ErrNotFound) {
+		c.reply("invite", "There is no user named "+invitee+".")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up user %s: %v", invitee, err)
+		c.reply("invite", "Could not invite "+invitee+", try again.")
+		return
+	}
+
+	// Invites land in the invitee's DMs, so they are limited per sender
+	key := "invites:" + c.ID
+	pipe := c.hub.redis.TxPipeline()
+	sent := pipe.Incr(ctx, key)
+	pipe.ExpireNX(ctx, key, inviteWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to count invites of %s: %v", c.ID, err)
+		c.reply("invite", "Could not invite "+invitee+", try again.")
+		return
+	}
+	if sent.Val() > maxInvites {
+		c.reply("invite", "You have sent too many invites, try again later.")
+		return
+	}
+
+	u1, u2 := c.ID, invitee
+	if u1 > u2 {
+		u1, u2 = u2, u1
+	}
+	c.hub.Publish(&model.Message{
+		ChannelID: "dm:" + u1 + ":" + u2,
+		UserID:    c.ID,
+		Content:   c.ChannelID,
+		Type:      model.TypeInvite,
+	})
+	c.reply("invite", "Invited "+invitee+" to "+c.ChannelID+".")
+}
+
+func (c *Client) cmdMute(args string) {
+	var until *time.Time
+	if args != "" {
+		d, err := time.ParseDuration(args)
+		if err != nil || d <= 0 {
+			c.reply("mute", "Usage: "+builtinCommands["mute"].usage)
+			return
+		}
+		t := time.Now().Add(d).UTC()
+		until = &t
+	}
+
+	err := c.updatePrefs(func(ch *prefs.Channel) {
+		ch.Muted, ch.MutedUntil = true, until
+	})
+	if err != nil {
+		log.Printf("Failed to mute %s for %s: %v", c.ChannelID, c.ID, err)
+		c.reply("mute", "Could not mute the channel, try again.")
+		return
+	}
+	if until != nil {
+		c.reply("mute", "Muted "+c.ChannelID+" until "+until.Format(time.RFC1123)+".")
+		return
+	}
+	c.reply("mute", "Muted "+c.ChannelID+".")
+}
+
+func (c *Client) cmdUnmute(string) {
+	err := c.updatePrefs(func(ch *prefs.Channel) {
+		ch.Muted, ch.MutedUntil = false, nil
+	})
+	if err != nil {
+		log.Printf("Failed to unmute %s for %s: %v", c.ChannelID, c.ID, err)
+		c.reply("unmute", "Could not unmute the channel, try again.")
+		return
+	}
+	c.reply("unmute", "Unmuted "+c.ChannelID+".")
+}
+
+func (c *Client) cmdNotify(args string) {
+	level := prefs.Level(strings.ToLower(args))
+	if level == "" {
+		p, err := prefs.Get(context.Background(), c.hub.db, c.hub.redis, c.ID)
+		if err != nil {
+			log.Printf("Failed to load preferences of %s: %v", c.ID, err)
+			c.reply("notify", "Could not load your preferences, try again.")
+			return
+		}
+		c.reply("notify", c.ChannelID+" notifies you of "+describeLevel(p.Level(c.ChannelID))+".")
+		return
+	}
+
+	err := c.updatePrefs(func(ch *prefs.Channel) {
+		ch.Level = level
+	})
+	if errors.Is(err, prefs.ErrInvalidLevel) {
+		c.reply("notify", "Usage: "+builtinCommands["notify"].usage)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set notification level of %s for %s: %v", c.ChannelID, c.ID, err)
+		c.reply("notify", "Could not change your notifications, try again.")
+		return
+	}
+	c.reply("notify", c.ChannelID+" now notifies you of "+describeLevel(level)+".")
+}
+
+// updatePrefs changes the caller's preferences for the current channel.
+func (c *Client) updatePrefs(change func(*prefs.Channel)) error {
+	ctx := context.Background()
+	p, err := prefs.Get(ctx, c.hub.db, c.hub.redis, c.ID)
+	if err != nil {
+		return err
+	}
+	ch := p.Channel(c.ChannelID)
+	change(ch)
+	return prefs.SetChannel(ctx, c.hub.db, c.hub.redis, c.ID, ch)
+}
+
+func describeLevel(l prefs.Level) string {
+	switch l {
+	case prefs.LevelAll:
+		return "every message"
+	case prefs.LevelMentions:
+		return "mentions only"
+	default:
+		return "nothing"
+	}
+}
+
+// runExternal invokes a command registered through the API.
+func (c *Client) runExternal(name, args string) {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	reg, err := commands.Get(ctx, c.hub.redis, name)
+	if errors.Is(err, commands.ErrNotFound) {
+		c.reply(name, "Unknown command /"+name+". Try /help.")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up command /%s: %v", name, err)
+		c.reply(name, "Could not run /"+name+", try again.")
+		return
+	}
+
+	resp, err := invoke(ctx, reg, &bot.CommandRequest{
+		Command:   name,
+		Text:      args,
+		UserID:    c.ID,
+		ChannelID: c.ChannelID,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Command /%s failed: %v", name, err)
+		c.reply(name, "/"+name+" did not respond.")
+		return
+	}
+	if resp == nil || resp.Text == "" {
+		return
+	}
+
+	if resp.ResponseType == bot.ResponseInChannel {
+		// The API refuses command names that belong to users, but a user
+		// may have registered since; their name is not posted under.
+		var user string
+		err := c.hub.db.Query(`SELECT user_id FROM users WHERE user_id = ?`, name).WithContext(ctx).Scan(&user)
+		if err == nil {
+			c.reply(name, resp.Text)
+			return
+		}
+		if !errors.Is(err, gocql.ErrNotFound) {
+			log.Printf("Failed to check command /%s against users: %v", name, err)
+			c.reply(name, "Could not run /"+name+", try again.")
+			return
+		}
+		c.hub.Publish(&model.Message{
+			ChannelID:   c.ChannelID,
+			UserID:      commandUserPrefix + name,
+			Content:     resp.Text,
+			Type:        model.TypeMessage,
+			DisplayName: name,
+			Bot:         true,
+		})
+		return
+	}
+	c.reply(name, resp.Text)
+}
+
+// invoke POSTs a signed invocation to the command's bot. A 204 or empty
+// body means no response.
+func invoke(ctx context.Context, reg *commands.Registration, req *bot.CommandRequest) (*bot.CommandResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, reg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("User-Agent", "chat-commands/1")
+	httpReq.Header.Set(webhook.HeaderSignature, webhook.Sign(reg.Secret, time.Now(), body))
+
+	resp, err := commandClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	var out bot.CommandResponse
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -3,34 +3,126 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"hash/fnv"
 	"log"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
 	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/prefs"
 	"github.com/mahaj/networking-minor/pkg/snowflake"
 	"github.com/redis/go-redis/v9"
 	"github.com/segmentio/kafka-go"
 )
 
+const (
+	// Maximum number of messages buffered by the Kafka writer before a batch is sent.
+	producerBatchSize = 100
+
+	// Maximum time a partially filled batch waits before it is sent to Kafka.
+	producerBatchTimeout = 5 * time.Millisecond
+
+	// Buffer size of each shard's inbound channels.
+	shardQueueSize = 1024
+
+	// Goroutines that check mention events against their recipients'
+	// preferences, and the buffer of each.
+	alertWorkers   = 8
+	alertQueueSize = 256
+
+	// Kafka header carrying the message type of records the gateway
+	// produces, so fanout can skip records without decoding them.
+	typeHeader = "type"
+)
+
+// envelope is a fanout payload together with the channel it was keyed by.
+type envelope struct {
+	channelID string
+	payload   []byte
+}
+
+// directMessage is a payload for a single connection, such as a reply to a
+// slash command.
+type directMessage struct {
+	client  *Client
+	payload []byte
+}
+
+// publisher is the subset of *kafka.Writer used by the hub. It lets the
+// benchmark swap Kafka out for an in-memory loopback.
+type publisher interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Hub routes traffic between websocket clients and Kafka. Clients are
+// partitioned into shards by channel ID so that registration, publishing and
+// fanout for unrelated channels never contend on the same goroutine or lock.
 type Hub struct {
+	shards    []*shard
+	producer  publisher
+	consumer  *kafka.Reader
+	redis     *redis.Client
+	db        *db.Session
+	snowflake *snowflake.Node
+	typing    *typingTracker
+	sessions  *auth.Sessions
+	apiKeys   *auth.APIKeyStore
+
+	// Events for users' own channels wait here while their preferences are
+	// read, so the dispatch loop does not. A user's events always go to the
+	// same queue, which keeps them in order.
+	alerts []chan envelope
+
+	// Joins and leaves waiting for Redis, by user, and how many have not
+	// run yet.
+	presence        []chan presenceOp
+	presencePending atomic.Int64
+
+	// Identifies this gateway in connection IDs.
+	nodeID string
+
+	// Set once Shutdown starts; new upgrades are refused from then on.
+	draining atomic.Bool
+
+	// Closed by Shutdown to stop background loops.
+	done chan struct{}
+}
+
+// shard owns the clients of every channel that hashes to it. All map
+// mutations happen on the shard's own goroutine; mu only guards readers
+// running elsewhere.
+type shard struct {
+	hub         *Hub
 	clients     map[string]map[*Client]bool // channel_id -> clients
 	userClients map[string]map[*Client]bool // user_id -> clients (Global tracking)
 	broadcast   chan *model.Message
+	fanout      chan envelope
+	direct      chan directMessage
 	register    chan *Client
 	unregister  chan *Client
 	mu          sync.RWMutex
-	producer    *kafka.Writer
-	redis       *redis.Client
-	snowflake   *snowflake.Node
 }
 
-func NewHub(kafkaBrokers []string, topic string, redisAddr string) *Hub {
+func NewHub(kafkaBrokers []string, topic string, redisAddr string, session *db.Session, nodeID string, shards int) *Hub {
 	producer := &kafka.Writer{
-		Addr:     kafka.TCP(kafkaBrokers...),
-		Topic:    topic,
-		Balancer: &kafka.LeastBytes{},
+		Addr:  kafka.TCP(kafkaBrokers...),
+		Topic: topic,
+		// Keying by channel keeps each channel's messages in order on one partition.
+		Balancer:     &kafka.Hash{},
+		BatchSize:    producerBatchSize,
+		BatchTimeout: producerBatchTimeout,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Printf("Failed to write %d messages to Kafka: %v", len(messages), err)
+			}
+		},
 	}
 
 	rdb := redis.NewClient(&redis.Options{
@@ -47,190 +139,354 @@ func NewHub(kafkaBrokers []string, topic string, redisAddr string) *Hub {
 		MaxBytes:    10e6,
 	})
 
-	// Initialize Snowflake Node
-	// In production, node ID should be unique per instance (e.g., from env var or service discovery)
-	node, err := snowflake.NewNode(1)
+	// Each gateway leases a snowflake node of its own unless SNOWFLAKE_NODE
+	// sets one.
+	var ids *snowflake.Node
+	ids, err := snowflake.Load(context.Background(), rdb, snowflake.FirstGatewayNode, snowflake.LastGatewayNode, func(err error) {
+		log.Fatalf("Lost the lease of snowflake node %d: %v", ids.Number(), err)
+	})
 	if err != nil {
-		log.Fatalf("Failed to initialize snowflake node: %v", err)
+		log.Fatalf("Failed to get a snowflake node: %v", err)
+	}
+	log.Printf("Generating IDs as snowflake node %d", ids.Number())
+
+	h := newHub(producer, rdb, ids, shards)
+	h.consumer = consumer
+	h.db = session
+	h.nodeID = nodeID
+	return h
+}
+
+func newHub(producer publisher, rdb *redis.Client, ids *snowflake.Node, shards int) *Hub {
+	if shards < 1 {
+		shards = 1
 	}
 
 	h := &Hub{
-		broadcast:   make(chan *model.Message),
-		register:    make(chan *Client),
-		unregister:  make(chan *Client),
-		clients:     make(map[string]map[*Client]bool),
-		userClients: make(map[string]map[*Client]bool),
-		producer:    producer,
-		redis:       rdb,
-		snowflake:   node,
-	}
-
-	// Start consumer
-	go func() {
-		defer consumer.Close()
-		for {
-			m, err := consumer.ReadMessage(context.Background())
-			if err != nil {
-				log.Printf("Gateway consumer error: %v", err)
-				break
-			}
+		producer:  producer,
+		redis:     rdb,
+		snowflake: ids,
+		sessions:  auth.NewSessions(rdb),
+		apiKeys:   auth.NewAPIKeyStore(rdb),
+		done:      make(chan struct{}),
+	}
+	h.typing = newTypingTracker(h)
+	for i := 0; i < shards; i++ {
+		h.shards = append(h.shards, &shard{
+			hub:         h,
+			clients:     make(map[string]map[*Client]bool),
+			userClients: make(map[string]map[*Client]bool),
+			broadcast:   make(chan *model.Message, shardQueueSize),
+			fanout:      make(chan envelope, shardQueueSize),
+			direct:      make(chan directMessage, shardQueueSize),
+			register:    make(chan *Client),
+			unregister:  make(chan *Client),
+		})
+	}
+	for i := 0; i < alertWorkers; i++ {
+		h.alerts = append(h.alerts, make(chan envelope, alertQueueSize))
+	}
+	for i := 0; i < presenceWorkers; i++ {
+		h.presence = append(h.presence, make(chan presenceOp, presenceQueueSize))
+	}
+	return h
+}
 
-			// Parse JSON message to get channel_id
-			var msg model.Message
-			if err := json.Unmarshal(m.Value, &msg); err != nil {
-				log.Printf("Failed to unmarshal message from Kafka: %v", err)
-				continue
-			}
+// shardFor returns the shard responsible for a channel.
+func (h *Hub) shardFor(channelID string) *shard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	f := fnv.New32a()
+	f.Write([]byte(channelID))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
 
-			h.mu.RLock()
-			// DM Routing: If channel starts with "dm:", route to participants globally
-			if len(msg.ChannelID) > 3 && msg.ChannelID[:3] == "dm:" {
-				parts := strings.Split(msg.ChannelID, ":")
-				if len(parts) == 3 {
-					// parts[1] and parts[2] are user IDs
-					recipients := []string{parts[1], parts[2]}
-					for _, userID := range recipients {
-						if clients, ok := h.userClients[userID]; ok {
-							for client := range clients {
-								select {
-								case client.send <- m.Value:
-								default:
-									close(client.send)
-									delete(clients, client)
-								}
-							}
-						}
-					}
-				}
-			} else {
-				// Standard Channel Routing
-				if clients, ok := h.clients[msg.ChannelID]; ok {
-					for client := range clients {
-						select {
-						case client.send <- m.Value:
-						default:
-							close(client.send)
-							delete(clients, client)
-						}
-					}
-				}
-			}
-			h.mu.RUnlock()
+// newConnID returns an ID for a websocket connection that is unique across
+// gateways.
+func (h *Hub) newConnID() string {
+	return h.nodeID + "-" + strconv.FormatInt(h.snowflake.Generate(), 10)
+}
+
+// Register adds a client to the shard that owns its channel.
+func (h *Hub) Register(c *Client) {
+	h.shardFor(c.ChannelID).register <- c
+}
+
+// Unregister removes a client from the shard that owns its channel.
+func (h *Hub) Unregister(c *Client) {
+	h.shardFor(c.ChannelID).unregister <- c
+}
+
+// Publish queues a message for delivery to Kafka.
+func (h *Hub) Publish(msg *model.Message) {
+	h.shardFor(msg.ChannelID).broadcast <- msg
+}
+
+// SendTo delivers a message to one connection only. It goes through the
+// client's shard, which owns the send channel and knows whether the client
+// is still connected.
+func (h *Hub) SendTo(c *Client, msg *model.Message) {
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
+		return
+	}
+	h.shardFor(c.ChannelID).direct <- directMessage{client: c, payload: payload}
+}
+
+// dispatch hands a message read from Kafka to the shards that hold its
+// recipients. The channel ID travels as the Kafka key, so routing does not
+// need to decode the payload.
+func (h *Hub) dispatch(m kafka.Message) {
+	channelID := string(m.Key)
+	if channelID == "" {
+		// Messages produced before keys were introduced.
+		var msg model.Message
+		if err := json.Unmarshal(m.Value, &msg); err != nil {
+			log.Printf("Failed to unmarshal message from Kafka: %v", err)
+			return
+		}
+		channelID = msg.ChannelID
+	}
+	// Edits are only fanned out once the messaging service has checked
+	// them and sent a TypeEdited event.
+	for _, hdr := range m.Headers {
+		if hdr.Key == typeHeader && string(hdr.Value) == string(model.TypeEdit) {
+			return
+		}
+	}
+	if userID, ok := strings.CutPrefix(channelID, model.UserChannelPrefix); ok {
+		f := fnv.New32a()
+		f.Write([]byte(userID))
+		h.alerts[f.Sum32()%uint32(len(h.alerts))] <- envelope{channelID: channelID, payload: m.Value}
+		return
+	}
+	h.route(channelID, m.Value)
+}
+
+// runAlerts routes the events of users' own channels that their
+// preferences do not silence.
+func (h *Hub) runAlerts(queue chan envelope) {
+	for env := range queue {
+		userID := strings.TrimPrefix(env.channelID, model.UserChannelPrefix)
+		if !h.silenced(userID, env.payload) {
+			h.route(env.channelID, env.payload)
 		}
-	}()
+	}
+}
 
-	return h
+// silenced reports whether a user event is a mention the user does not want
+// to be alerted of: the channel is muted or set to notify of nothing, or
+// their do-not-disturb schedule is on. The mention stays in their inbox.
+// If the preferences cannot be read, the event goes through.
+func (h *Hub) silenced(userID string, payload []byte) bool {
+	var msg model.Message
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Type != model.TypeMention {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	p, err := prefs.Get(ctx, h.db, h.redis, userID)
+	if err != nil {
+		log.Printf("Failed to load preferences of %s: %v", userID, err)
+		return false
+	}
+	now := time.Now()
+	return p.InDND(now) || !p.Allows(msg.TargetChannelID, true, now)
 }
 
+// route hands a payload to the shards that hold the channel's recipients.
+func (h *Hub) route(channelID string, payload []byte) {
+	env := envelope{channelID: channelID, payload: payload}
+
+	// DM participants and users with events of their own may be connected to
+	// any channel, so every shard checks its own user index.
+	if strings.HasPrefix(channelID, "dm:") || strings.HasPrefix(channelID, model.UserChannelPrefix) {
+		for _, s := range h.shards {
+			s.fanout <- env
+		}
+		return
+	}
+	h.shardFor(channelID).fanout <- env
+}
+
+// Run starts the shard loops and consumes the fanout topic until the reader
+// fails or is closed by Shutdown.
 func (h *Hub) Run() {
-	defer h.producer.Close()
-	defer h.redis.Close()
+	for _, s := range h.shards {
+		go s.run()
+	}
+	for _, q := range h.alerts {
+		go h.runAlerts(q)
+	}
+	for _, q := range h.presence {
+		go h.runPresenceQueue(q)
+	}
+	go h.runPresence()
+	go h.typing.run()
+	go h.runRevocations()
 
 	for {
-		select {
-		case client := <-h.register:
-			h.mu.Lock()
-			// Register in Channel Map
-			if h.clients[client.ChannelID] == nil {
-				h.clients[client.ChannelID] = make(map[*Client]bool)
-			}
-			h.clients[client.ChannelID][client] = true
-
-			// Register in Global User Map
-			if h.userClients[client.ID] == nil {
-				h.userClients[client.ID] = make(map[*Client]bool)
+		m, err := h.consumer.ReadMessage(context.Background())
+		if err != nil {
+			if !h.draining.Load() {
+				log.Printf("Gateway consumer error: %v", err)
 			}
-			h.userClients[client.ID][client] = true
-			h.mu.Unlock()
+			break
+		}
+		h.dispatch(m)
+	}
+}
 
-			// Set presence in Redis Set
-			err := h.redis.SAdd(context.Background(), "channel:"+client.ChannelID+":users", client.ID).Err()
-			if err != nil {
-				log.Printf("Failed to set presence for %s: %v", client.ID, err)
-			}
+func (s *shard) run() {
+	for {
+		select {
+		case client := <-s.register:
+			s.addClient(client)
 			log.Printf("Client registered: %s in channel %s", client.ID, client.ChannelID)
 
-			// Broadcast Join Event
-			go func() {
-				h.broadcast <- &model.Message{
-					ChannelID: client.ChannelID,
-					UserID:    client.ID,
-					Type:      model.TypePresence,
-					Content:   "joined",
-					Timestamp: time.Now(),
-				}
-			}()
-
-		case client := <-h.unregister:
-			h.mu.Lock()
-			// Unregister from Channel Map
-			if clients, ok := h.clients[client.ChannelID]; ok {
-				if _, ok := clients[client]; ok {
-					delete(clients, client)
-					close(client.send)
-					if len(clients) == 0 {
-						delete(h.clients, client.ChannelID)
-					}
-
-					// Remove presence from Redis Set
-					err := h.redis.SRem(context.Background(), "channel:"+client.ChannelID+":users", client.ID).Err()
-					if err != nil {
-						log.Printf("Failed to delete presence for %s: %v", client.ID, err)
-					}
-					log.Printf("Client unregistered: %s from channel %s", client.ID, client.ChannelID)
-
-					// Broadcast Leave Event
-					go func() {
-						h.broadcast <- &model.Message{
-							ChannelID: client.ChannelID,
-							UserID:    client.ID,
-							Type:      model.TypePresence,
-							Content:   "left",
-							Timestamp: time.Now(),
-						}
-					}()
-				}
-			}
+			// Broadcast Join Event, unless the user already had a connection
+			s.hub.queuePresence(presenceOp{client: client, userID: client.ID, channelID: client.ChannelID})
+
+		case client := <-s.unregister:
+			s.removeClient(client)
 
-			// Unregister from Global User Map
-			if clients, ok := h.userClients[client.ID]; ok {
-				if _, ok := clients[client]; ok {
-					delete(clients, client)
-					if len(clients) == 0 {
-						delete(h.userClients, client.ID)
-					}
+		case msg := <-s.broadcast:
+			s.publish(msg)
+
+		case env := <-s.fanout:
+			s.deliver(env)
+
+		case d := <-s.direct:
+			// The client may have disconnected since the message was queued.
+			if s.clients[d.client.ChannelID][d.client] {
+				for _, client := range s.send(map[*Client]bool{d.client: true}, d.payload, nil) {
+					s.removeClient(client)
 				}
 			}
-			h.mu.Unlock()
+		}
+	}
+}
 
-		case msg := <-h.broadcast:
-			// Assign ID and Timestamp if not present
-			if msg.ID == 0 {
-				msg.ID = h.snowflake.Generate()
-			}
-			if msg.Timestamp.IsZero() {
-				msg.Timestamp = time.Now()
-			}
+// addClient indexes a client by channel and user.
+func (s *shard) addClient(client *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-			// Marshal to JSON
-			jsonMsg, err := json.Marshal(msg)
-			if err != nil {
-				log.Printf("Failed to marshal message: %v", err)
-				continue
-			}
+	// Register in Channel Map
+	if s.clients[client.ChannelID] == nil {
+		s.clients[client.ChannelID] = make(map[*Client]bool)
+	}
+	s.clients[client.ChannelID][client] = true
 
-			// Publish to Kafka
-			err = h.producer.WriteMessages(context.Background(),
-				kafka.Message{
-					Value: jsonMsg,
-					Time:  time.Now(),
-				},
-			)
-			if err != nil {
-				log.Printf("Failed to write message to Kafka: %v", err)
-			} else {
-				log.Printf("Message published to Kafka: %s", string(jsonMsg))
+	// Register in Global User Map
+	if s.userClients[client.ID] == nil {
+		s.userClients[client.ID] = make(map[*Client]bool)
+	}
+	s.userClients[client.ID][client] = true
+}
+
+// removeClient drops a client from both indexes, closes its send channel and
+// releases its presence. It is a no-op for clients that were already removed.
+func (s *shard) removeClient(client *Client) {
+	s.mu.Lock()
+	clients, ok := s.clients[client.ChannelID]
+	if !ok || !clients[client] {
+		s.mu.Unlock()
+		return
+	}
+
+	// Unregister from Channel Map
+	delete(clients, client)
+	close(client.send)
+	if len(clients) == 0 {
+		delete(s.clients, client.ChannelID)
+	}
+
+	// Unregister from Global User Map
+	if clients, ok := s.userClients[client.ID]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(s.userClients, client.ID)
+		}
+	}
+	s.mu.Unlock()
+
+	log.Printf("Client unregistered: %s from channel %s", client.ID, client.ChannelID)
+
+	// Broadcast Leave Event once the user's last connection is gone
+	s.hub.queuePresence(presenceOp{connID: client.connID, userID: client.ID, channelID: client.ChannelID, lastSeen: time.Now()})
+}
+
+// publish stamps a message and hands it to the asynchronous Kafka writer.
+func (s *shard) publish(msg *model.Message) {
+	// Assign ID and Timestamp if not present
+	if msg.ID == 0 {
+		msg.ID = s.hub.snowflake.Generate()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	// Marshal to JSON
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal message: %v", err)
+		return
+	}
+
+	// Publish to Kafka. The writer is async, so this only enqueues the
+	// message; failures are reported by the writer's Completion callback.
+	err = s.hub.producer.WriteMessages(context.Background(),
+		kafka.Message{
+			Key:     []byte(msg.ChannelID),
+			Value:   jsonMsg,
+			Time:    time.Now(),
+			Headers: []kafka.Header{{Key: typeHeader, Value: []byte(msg.Type)}},
+		},
+	)
+	if err != nil {
+		log.Printf("Failed to write message to Kafka: %v", err)
+	}
+}
+
+// deliver writes a fanout payload to the local recipients held by this shard.
+func (s *shard) deliver(env envelope) {
+	var slow []*Client
+	// DM Routing: If channel starts with "dm:", route to participants globally
+	if strings.HasPrefix(env.channelID, "dm:") {
+		parts := strings.Split(env.channelID, ":")
+		if len(parts) == 3 {
+			// parts[1] and parts[2] are user IDs
+			for _, userID := range []string{parts[1], parts[2]} {
+				slow = s.send(s.userClients[userID], env.payload, slow)
 			}
 		}
+	} else if userID, ok := strings.CutPrefix(env.channelID, model.UserChannelPrefix); ok {
+		// Events for one user go to all of their connections
+		slow = s.send(s.userClients[userID], env.payload, slow)
+	} else {
+		// Standard Channel Routing
+		slow = s.send(s.clients[env.channelID], env.payload, slow)
+	}
+
+	// Clients whose buffers are full are dropped so they cannot stall the shard.
+	for _, client := range slow {
+		s.removeClient(client)
+	}
+}
+
+func (s *shard) send(clients map[*Client]bool, payload []byte, slow []*Client) []*Client {
+	for client := range clients {
+		select {
+		case client.send <- payload:
+		default:
+			slow = append(slow, client)
+		}
 	}
+	return slow
 }
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Shape of the benchmark: channels, each with clients connected.
+	benchChannels   = 256
+	benchPerChannel = 4
+)
+
+// loopback stands in for Kafka during benchmarks: everything written to it
+// is dispatched back into the hub, the same way the fanout consumer would.
+// Messages are split into lanes by key, like partitions, and each lane is
+// dispatched by its own goroutine so dispatch does not serialize the shards.
+// Queues are unbounded so a busy shard can never block on its own fanout.
+type loopback struct {
+	hub   *Hub
+	lanes []*lane
+}
+
+type lane struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []kafka.Message
+}
+
+func newLoopback(lanes int) *loopback {
+	l := &loopback{lanes: make([]*lane, lanes)}
+	for i := range l.lanes {
+		ln := &lane{}
+		ln.cond = sync.NewCond(&ln.mu)
+		l.lanes[i] = ln
+	}
+	return l
+}
+
+func (l *loopback) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, m := range msgs {
+		f := fnv.New32a()
+		f.Write(m.Key)
+		ln := l.lanes[f.Sum32()%uint32(len(l.lanes))]
+		ln.mu.Lock()
+		ln.queue = append(ln.queue, m)
+		ln.mu.Unlock()
+		ln.cond.Signal()
+	}
+	return nil
+}
+
+func (l *loopback) Close() error {
+	return nil
+}
+
+func (l *loopback) run() {
+	for _, ln := range l.lanes {
+		go l.dispatch(ln)
+	}
+}
+
+func (l *loopback) dispatch(ln *lane) {
+	for {
+		ln.mu.Lock()
+		for len(ln.queue) == 0 {
+			ln.cond.Wait()
+		}
+		batch := ln.queue
+		ln.queue = nil
+		ln.mu.Unlock()
+
+		for _, m := range batch {
+			l.hub.dispatch(m)
+		}
+	}
+}
+
+// BenchmarkHub measures end-to-end hub throughput (publish, marshal,
+// produce, dispatch, fanout) with one shard per core. Every parallel
+// goroutine publishes as its own client, in channels of its own, e.g.
+//
+//	go test ./apps/gateway -run '^$' -bench Hub -cpu 1,2,4,8
+func BenchmarkHub(b *testing.B) {
+	shards := runtime.GOMAXPROCS(0)
+
+	lb := newLoopback(shards)
+	// Nothing in the benchmark path touches Redis unless a client is dropped.
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer rdb.Close()
+
+	// The node left for scripts and tests.
+	ids, err := snowflake.NewNode(1023)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	h := newHub(lb, rdb, ids, shards)
+	lb.hub = h
+	lb.run()
+
+	var delivered atomic.Int64
+	channelIDs := make([]string, benchChannels)
+	for i := range channelIDs {
+		channelIDs[i] = "bench-" + strconv.Itoa(i)
+		for j := 0; j < benchPerChannel; j++ {
+			c := &Client{
+				hub:       h,
+				send:      make(chan []byte, 1024),
+				ID:        fmt.Sprintf("user-%d-%d", i, j),
+				ChannelID: channelIDs[i],
+			}
+			c.claims = &auth.Claims{UserID: c.ID}
+			h.shardFor(c.ChannelID).addClient(c)
+			go func() {
+				for range c.send {
+					delivered.Add(1)
+				}
+			}()
+		}
+	}
+	for _, s := range h.shards {
+		go s.run()
+	}
+
+	// Publishers take every publishers-th channel from their own offset, so
+	// they never share a channel as long as there are fewer of them than
+	// benchChannels.
+	publishers := runtime.GOMAXPROCS(0)
+	var nextPublisher atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		p := int(nextPublisher.Add(1)-1) % publishers
+		userID := "bench-" + strconv.Itoa(p)
+		for i := p; pb.Next(); i += publishers {
+			if i >= benchChannels {
+				i = p % benchChannels
+			}
+			h.Publish(&model.Message{
+				ChannelID: channelIDs[i],
+				UserID:    userID,
+				Type:      model.TypeMessage,
+				Content:   "benchmark message",
+				Timestamp: time.Now(),
+			})
+		}
+	})
+
+	// Wait for fanout to finish so the measurement covers delivery too.
+	want := int64(b.N) * benchPerChannel
+	deadline := time.Now().Add(time.Minute)
+	for delivered.Load() < want {
+		if time.Now().After(deadline) {
+			b.Fatalf("delivered %d of %d messages; slow clients were dropped", delivered.Load(), want)
+		}
+		runtime.Gosched()
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+	"github.com/mahaj/networking-minor/pkg/db"
 )
 
 func main() {
@@ -15,6 +25,12 @@ func main() {
 	defer f.Close()
 	log.SetOutput(f)
 
+	keys, err := auth.Load()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+	auth.SetKeys(keys)
+
 	kafkaBrokersStr := os.Getenv("KAFKA_BROKERS")
 	if kafkaBrokersStr == "" {
 		kafkaBrokersStr = "localhost:19092"
@@ -26,17 +42,85 @@ func main() {
 		redisAddr = "localhost:6379"
 	}
 
+	// Notification preferences; the messaging service creates the schema
+	scyllaHostsStr := os.Getenv("SCYLLA_HOSTS")
+	if scyllaHostsStr == "" {
+		scyllaHostsStr = "localhost:9042"
+	}
+
 	kafkaTopic := "chat-messages"
 
-	hub := NewHub(kafkaBrokers, kafkaTopic, redisAddr)
+	// One shard per core by default
+	shards := runtime.NumCPU()
+	if v := os.Getenv("HUB_SHARDS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid HUB_SHARDS %q", v)
+		}
+		shards = n
+	}
+
+	// Time allowed for draining clients and flushing Kafka on SIGTERM
+	shutdownTimeout := 30 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT %q: %v", v, err)
+		}
+		shutdownTimeout = d
+	}
+
+	// Unique per gateway instance; defaults to the container hostname
+	nodeID := os.Getenv("GATEWAY_ID")
+	if nodeID == "" {
+		nodeID, err = os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to determine GATEWAY_ID: %v", err)
+		}
+	}
+
+	session, err := db.NewSession(strings.Split(scyllaHostsStr, ","), "chat")
+	if err != nil {
+		log.Fatalf("Failed to connect to ScyllaDB: %v", err)
+	}
+	defer session.Close()
+
+	hub := NewHub(kafkaBrokers, kafkaTopic, redisAddr, session, nodeID, shards)
 	go hub.Run()
 
+	// Pick up keys the API adds or retires
+	if os.Getenv("JWT_JWKS_URL") != "" {
+		go keys.WatchJWKS(10*time.Minute, hub.done)
+	}
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r)
 	})
 
-	log.Println("Gateway Service Starting on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatal(err)
+	srv := &http.Server{Addr: ":8080"}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Println("Gateway Service Starting on :8080...")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("Shutting down, draining for up to %s...", shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new connections; upgraded websockets are hijacked and
+	// are not affected, so the hub drains them separately.
+	hub.BeginDrain()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
 	}
+	hub.Shutdown(shutdownCtx)
+	log.Println("Gateway stopped")
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/status"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How long a connection stays present without a heartbeat. A crashed
+	// gateway's users are reaped once this runs out.
+	presenceTTL = 30 * time.Second
+
+	// How often live connections are refreshed. Must be well below presenceTTL.
+	heartbeatPeriod = presenceTTL / 3
+
+	// How often expired connections are looked for.
+	reapPeriod = presenceTTL / 2
+
+	// Maximum number of expired connections handled per reap pass.
+	reapBatch = 500
+
+	// Sorted set of every live connection, scored by expiry (unix ms).
+	presenceExpiryKey = "presence:expiry"
+
+	// Goroutines that run joins and leaves for the shards, and the buffer
+	// of each. A join or leave that does not fit is left to the heartbeat,
+	// which rejoins connections missing from Redis, or to the reaper.
+	presenceWorkers   = 8
+	presenceQueueSize = 1024
+
+	// Longest a presence script may take before it is given up on.
+	presenceTimeout = 2 * time.Second
+)
+
+// presenceOp is a join of client, or a leave of a connection when client is
+// nil.
+type presenceOp struct {
+	client    *Client
+	connID    string
+	userID    string
+	channelID string
+	lastSeen  time.Time
+}
+
+// Presence is tracked per connection so a user with several tabs, devices or
+// gateways stays online until the last one goes away:
+//
+//	channel:{id}:users               set of online users (read by the API)
+//	channel:{id}:user:{uid}:conns    zset connID -> expiry, the user's reference count in the channel
+//	presence:expiry                  zset "connID|uid|channel" -> expiry, scanned by the reaper
+//
+// plus the user-level keys described in pkg/status. Each transition runs as
+// a Lua script so concurrent gateways agree on who emits the "joined",
+// "left", online and offline events.
+//
+// Script keys are, in order: channel users, channel conns, presence:expiry,
+// user conns, user channels, user status.
+var (
+	// Returns {1 if the user was not yet online in the channel, 1 if the
+	// user was not online anywhere}.
+	joinScript = redis.NewScript(`
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[2])
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[4])
+redis.call('ZADD', KEYS[4], ARGV[3], ARGV[2])
+redis.call('SADD', KEYS[5], ARGV[5])
+return {redis.call('SADD', KEYS[1], ARGV[1]), redis.call('HSETNX', KEYS[6], 'online', '1')}
+`)
+
+	// Returns 0 when the connection was already reaped and must rejoin.
+	heartbeatScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+redis.call('ZADD', KEYS[3], 'XX', ARGV[2], ARGV[1])
+return 1
+`)
+
+	// Returns {1 if this was the user's last live connection in the channel,
+	// 1 if it was their last live connection anywhere}. Connections that were
+	// already removed (e.g. by another reaper) return {0, 0}.
+	leaveScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[3], ARGV[3]) == 0 then
+	return {0, 0}
+end
+redis.call('ZREM', KEYS[2], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[4])
+redis.call('ZREM', KEYS[4], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[4], '-inf', ARGV[4])
+local left = 0
+if redis.call('ZCARD', KEYS[2]) == 0 then
+	left = redis.call('SREM', KEYS[1], ARGV[1])
+	redis.call('SREM', KEYS[5], ARGV[5])
+end
+local offline = 0
+if redis.call('ZCARD', KEYS[4]) == 0 then
+	offline = redis.call('HDEL', KEYS[6], 'online')
+	if offline == 1 then
+		redis.call('HSET', KEYS[6], 'last_seen', ARGV[6])
+	end
+end
+return {left, offline}
+`)
+)
+
+func channelUsersKey(channelID string) string {
+	return "channel:" + channelID + ":users"
+}
+
+func channelConnsKey(channelID, userID string) string {
+	return "channel:" + channelID + ":user:" + userID + ":conns"
+}
+
+// presenceMember encodes a connection as a member of presence:expiry. The
+// channel goes last because channel IDs may contain any character.
+func presenceMember(connID, userID, channelID string) string {
+	return connID + "|" + userID + "|" + channelID
+}
+
+func expiryScore(now time.Time) int64 {
+	return now.Add(presenceTTL).UnixMilli()
+}
+
+func presenceKeys(userID, channelID string) []string {
+	return []string{
+		channelUsersKey(channelID),
+		channelConnsKey(channelID, userID),
+		presenceExpiryKey,
+		status.ConnsKey(userID),
+		status.ChannelsKey(userID),
+		status.Key(userID),
+	}
+}
+
+// transitions decodes the two flags returned by the join and leave scripts.
+func transitions(cmd *redis.Cmd) (channel, user bool, err error) {
+	flags, err := cmd.Int64Slice()
+	if err != nil {
+		return false, false, err
+	}
+	if len(flags) != 2 {
+		return false, false, fmt.Errorf("unexpected presence script reply %v", flags)
+	}
+	return flags[0] == 1, flags[1] == 1, nil
+}
+
+// joinPresence records a new connection. It reports whether the user just
+// came online in the channel, and whether they just came online at all.
+func (h *Hub) joinPresence(ctx context.Context, c *Client) (joined, online bool) {
+	cmd := joinScript.Run(ctx, h.redis, presenceKeys(c.ID, c.ChannelID),
+		c.ID, c.connID, expiryScore(time.Now()), presenceMember(c.connID, c.ID, c.ChannelID), c.ChannelID,
+	)
+	joined, online, err := transitions(cmd)
+	if err != nil {
+		log.Printf("Failed to set presence for %s: %v", c.ID, err)
+	}
+	return joined, online
+}
+
+// leavePresence removes a connection. It reports whether the user just went
+// offline in the channel, and whether they just went offline everywhere, in
+// which case lastSeen is recorded.
+func (h *Hub) leavePresence(ctx context.Context, connID, userID, channelID string, lastSeen time.Time) (left, offline bool) {
+	cmd := leaveScript.Run(ctx, h.redis, presenceKeys(userID, channelID),
+		userID, connID, presenceMember(connID, userID, channelID), time.Now().UnixMilli(), channelID, lastSeen.UnixMilli(),
+	)
+	left, offline, err := transitions(cmd)
+	if err != nil {
+		log.Printf("Failed to delete presence for %s: %v", userID, err)
+	}
+	return left, offline
+}
+
+// queuePresence hands a join or leave to the presence worker of its user,
+// which keeps each user's joins and leaves in order. Shards call it so a
+// slow Redis never holds up their loop; if the queue is full the op is
+// dropped and the heartbeat or the reaper catches up.
+func (h *Hub) queuePresence(op presenceOp) {
+	f := fnv.New32a()
+	f.Write([]byte(op.userID))
+	h.presencePending.Add(1)
+	select {
+	case h.presence[f.Sum32()%uint32(len(h.presence))] <- op:
+	default:
+		h.presencePending.Add(-1)
+		log.Printf("Presence queue full, leaving %s in channel %s to the heartbeat", op.userID, op.channelID)
+	}
+}
+
+func (h *Hub) runPresenceQueue(queue chan presenceOp) {
+	for op := range queue {
+		if op.client != nil {
+			h.join(op.client)
+		} else {
+			h.leave(op.connID, op.userID, op.channelID, op.lastSeen)
+		}
+		h.presencePending.Add(-1)
+	}
+}
+
+// waitForPresence blocks until every queued join and leave has run or ctx
+// expires.
+func (h *Hub) waitForPresence(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for h.presencePending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// join registers a connection's presence and announces any transition.
+func (h *Hub) join(c *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+	defer cancel()
+
+	// DM partners see each other's status from any channel
+	if parts := strings.Split(c.ChannelID, ":"); len(parts) == 3 && parts[0] == "dm" {
+		if err := status.AddContact(ctx, h.redis, parts[1], parts[2]); err != nil {
+			log.Printf("Failed to record contacts of %s: %v", c.ID, err)
+		}
+	}
+
+	joined, online := h.joinPresence(ctx, c)
+	if joined {
+		h.publishPresence(c.ChannelID, c.ID, "joined")
+	}
+	if online {
+		h.publishStatus(c.ID, []string{c.ChannelID})
+	}
+}
+
+// leave releases a connection's presence and announces any transition.
+func (h *Hub) leave(connID, userID, channelID string, lastSeen time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), presenceTimeout)
+	defer cancel()
+	left, offline := h.leavePresence(ctx, connID, userID, channelID, lastSeen)
+	if left {
+		h.publishPresence(channelID, userID, "left")
+	}
+	if offline {
+		h.publishStatus(userID, []string{channelID})
+	}
+}
+
+// heartbeat refreshes the expiry of every local connection.
+func (h *Hub) heartbeat() {
+	clients := h.connectedClients()
+	if len(clients) == 0 {
+		return
+	}
+
+	score := expiryScore(time.Now())
+	pipe := h.redis.Pipeline()
+	cmds := make([]*redis.Cmd, len(clients))
+	for i, c := range clients {
+		// Eval rather than Run: a pipeline cannot fall back from EVALSHA.
+		cmds[i] = heartbeatScript.Eval(context.Background(), pipe,
+			[]string{channelConnsKey(c.ChannelID, c.ID), presenceExpiryKey, status.ConnsKey(c.ID)},
+			c.connID, score, presenceMember(c.connID, c.ID, c.ChannelID),
+		)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		log.Printf("Failed to refresh presence for %d connections: %v", len(clients), err)
+	}
+
+	for i, cmd := range cmds {
+		// A connection can be reaped if this gateway stalled for longer than
+		// the TTL; it is still alive, so it joins again.
+		if n, err := cmd.Int(); err == nil && n == 0 {
+			h.join(clients[i])
+		}
+	}
+}
+
+// reap removes connections whose heartbeats stopped, typically because
+// their gateway crashed, and announces users that went offline as a result.
+// Any number of gateways may reap concurrently; the leave script makes sure
+// each connection is handled once.
+func (h *Hub) reap() {
+	now := time.Now().UnixMilli()
+	members, err := h.redis.ZRangeByScoreWithScores(context.Background(), presenceExpiryKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: reapBatch,
+	}).Result()
+	if err != nil {
+		log.Printf("Failed to scan expired presence: %v", err)
+		return
+	}
+
+	for _, z := range members {
+		member, _ := z.Member.(string)
+		parts := strings.SplitN(member, "|", 3)
+		if len(parts) != 3 {
+			h.redis.ZRem(context.Background(), presenceExpiryKey, z.Member)
+			continue
+		}
+		connID, userID, channelID := parts[0], parts[1], parts[2]
+
+		// The last heartbeat is the best guess for when the user was last seen.
+		lastSeen := time.UnixMilli(int64(z.Score)).Add(-presenceTTL)
+		log.Printf("Reaping expired presence: %s in channel %s", userID, channelID)
+		h.leave(connID, userID, channelID, lastSeen)
+	}
+}
+
+// runPresence refreshes and reaps presence until the hub shuts down.
+func (h *Hub) runPresence() {
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	reap := time.NewTicker(reapPeriod)
+	defer heartbeat.Stop()
+	defer reap.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-heartbeat.C:
+			h.heartbeat()
+		case <-reap.C:
+			h.reap()
+		}
+	}
+}
+
+// publishPresence announces a user joining or leaving a channel.
+func (h *Hub) publishPresence(channelID, userID, content string) {
+	h.shardFor(channelID).publish(&model.Message{
+		ChannelID: channelID,
+		UserID:    userID,
+		Type:      model.TypePresence,
+		Content:   content,
+		Timestamp: time.Now(),
+	})
+}
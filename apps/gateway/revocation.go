@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mahaj/networking-minor/pkg/auth"
+)
+
+// Reason sent with the close frame when a socket's token is revoked.
+const revokedCloseReason = "session revoked"
+
+// runRevocations disconnects local clients whose token was revoked, by
+// logout on any API instance or a password change, until the hub shuts down.
+// Tokens are only checked at upgrade time, so without this a socket would
+// outlive its session.
+func (h *Hub) runRevocations() {
+	sub := h.redis.Subscribe(context.Background(), auth.RevocationChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-h.done:
+			return
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			var rev auth.Revocation
+			if err := json.Unmarshal([]byte(m.Payload), &rev); err != nil {
+				log.Printf("Failed to unmarshal revocation: %v", err)
+				continue
+			}
+			h.revoke(rev)
+		}
+	}
+}
+
+// revoke closes the client sockets matching a revocation. An empty token ID
+// matches every socket of the user.
+func (h *Hub) revoke(rev auth.Revocation) {
+	var clients []*Client
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for c := range s.userClients[rev.UserID] {
+			if rev.TokenID == "" || c.claims.ID == rev.TokenID {
+				clients = append(clients, c)
+			}
+		}
+		s.mu.RUnlock()
+	}
+
+	for _, c := range clients {
+		log.Printf("Closing revoked session of %s (connection %s)", c.ID, c.connID)
+		c.closeRevoked()
+	}
+}
+
+// closeRevoked tells the peer why and drops the connection; the read pump
+// then unregisters the client.
+func (c *Client) closeRevoked() {
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, revokedCloseReason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.conn.Close()
+}
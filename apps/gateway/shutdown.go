@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reason sent with the close frame when the gateway drains. Clients should
+// treat it as a cue to reconnect, which the load balancer routes elsewhere.
+const drainCloseReason = "reconnect elsewhere"
+
+// Draining reports whether the hub has started shutting down.
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// BeginDrain makes serveWs refuse new upgrades. Shutdown calls it too; it is
+// exposed so the HTTP server can be stopped without racing new sockets in.
+func (h *Hub) BeginDrain() {
+	h.draining.Store(true)
+}
+
+// Shutdown drains the hub before the process exits:
+//
+//  1. new upgrades are refused,
+//  2. every client gets a 1012 (service restart) close frame, spread over the
+//     first half of the deadline so reconnects do not stampede another node,
+//  3. clients that ignore the close frame are disconnected,
+//  4. queued presence changes run, and presence entries still held by this
+//     node are removed from Redis,
+//  5. pending Kafka writes are flushed.
+//
+// It returns once everything is done or ctx expires, whichever is first.
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.BeginDrain()
+	close(h.done)
+	h.consumer.Close()
+
+	clients := h.connectedClients()
+	log.Printf("Draining %d clients", len(clients))
+
+	window := time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		window = time.Until(deadline) / 2
+	}
+	for _, c := range clients {
+		jitter := time.Duration(0)
+		if window > 0 {
+			jitter = time.Duration(rand.Int63n(int64(window)))
+		}
+		time.AfterFunc(jitter, c.closeForDrain)
+	}
+
+	// Clients unregister themselves once their read pump sees the close.
+	// Leave the second half of the deadline for stragglers and the flush.
+	closeCtx, cancel := context.WithTimeout(ctx, window+writeWait)
+	h.waitForClients(closeCtx)
+	cancel()
+
+	// Whoever is left did not answer in time; dropping the connection makes
+	// the read pump unregister them.
+	for _, c := range h.connectedClients() {
+		c.conn.Close()
+	}
+	h.waitForClients(ctx)
+
+	// Shards that could not finish in time still hold presence for their
+	// clients.
+	h.waitForPresence(ctx)
+	h.clearPresence(h.connectedClients())
+
+	h.flush(ctx)
+	h.redis.Close()
+}
+
+// connectedClients returns a snapshot of every client across all shards.
+func (h *Hub) connectedClients() []*Client {
+	var clients []*Client
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for _, channelClients := range s.clients {
+			for c := range channelClients {
+				clients = append(clients, c)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return clients
+}
+
+// waitForClients blocks until every shard is empty or ctx expires.
+func (h *Hub) waitForClients(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(h.connectedClients()) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// clearPresence releases the presence held by the given clients. Otherwise
+// they would only disappear once the reaper notices their TTL ran out.
+func (h *Hub) clearPresence(clients []*Client) {
+	for _, c := range clients {
+		h.leave(c.connID, c.ID, c.ChannelID, time.Now())
+	}
+}
+
+// flush closes the Kafka writer, which blocks until buffered batches have
+// been written, but gives up when ctx expires.
+func (h *Hub) flush(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		if err := h.producer.Close(); err != nil {
+			log.Printf("Failed to flush Kafka writer: %v", err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Shutdown deadline reached before Kafka writer flushed")
+	}
+}
+
+// closeForDrain asks the peer to reconnect to another gateway.
+func (c *Client) closeForDrain() {
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, drainCloseReason)
+	if err := c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait)); err != nil {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/status"
+)
+
+// setStatus stores the status a client picked and pushes it to every channel
+// the user is present in.
+func (h *Hub) setStatus(c *Client, st *model.UserStatus) error {
+	if err := status.Set(context.Background(), h.redis, c.ID, st.Status, st.Text); err != nil {
+		return err
+	}
+
+	channels, err := h.redis.SMembers(context.Background(), status.ChannelsKey(c.ID)).Result()
+	if err != nil {
+		log.Printf("Failed to fetch channels for %s: %v", c.ID, err)
+		channels = []string{c.ChannelID}
+	}
+	h.publishStatus(c.ID, channels)
+	return nil
+}
+
+// publishStatus announces a user's current status to the given channels
+// and to every DM the user has, which reach both participants wherever they
+// are connected.
+func (h *Hub) publishStatus(userID string, channels []string) {
+	dms, err := status.DMChannels(context.Background(), h.redis, userID)
+	if err != nil {
+		log.Printf("Failed to fetch contacts of %s: %v", userID, err)
+	}
+	for _, dm := range dms {
+		if !slices.Contains(channels, dm) {
+			channels = append(channels, dm)
+		}
+	}
+
+	statuses, err := status.Get(context.Background(), h.redis, userID)
+	if err != nil {
+		log.Printf("Failed to fetch status for %s: %v", userID, err)
+		return
+	}
+
+	for _, channelID := range channels {
+		st := statuses[0]
+		h.shardFor(channelID).publish(&model.Message{
+			ChannelID: channelID,
+			UserID:    userID,
+			Type:      model.TypeStatus,
+			Content:   string(st.Status),
+			Timestamp: time.Now(),
+			Status:    &st,
+		})
+	}
+}
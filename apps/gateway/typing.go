@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+const (
+	// How long a typing indicator stays up without being refreshed.
+	typingTTL = 6 * time.Second
+
+	// Minimum time between two "start" broadcasts for the same user and
+	// channel. Keystrokes in between only push the expiry back. Must be well
+	// below typingTTL so receivers get a refresh before their copy expires.
+	typingThrottle = 3 * time.Second
+
+	// Redis pub/sub channels carrying typing events, one per chat channel.
+	typingPrefix = "typing:"
+)
+
+// Typing indicators are ephemeral: they never touch Kafka. Each gateway
+// tracks the connections typing on its own sockets, throttles and expires
+// them, and publishes start/stop events over Redis pub/sub. Every gateway
+// subscribes and fans the events out through the normal shard routing.
+//
+// State is kept per connection, so one tab stopping does not clear the
+// indicator while another tab of the same user is still typing.
+type typingTracker struct {
+	hub    *Hub
+	mu     sync.Mutex
+	state  map[string]*typingState // conn_id -> state
+	typing map[string]int          // channel_id + "|" + user_id -> connections typing
+}
+
+type typingState struct {
+	lastSent time.Time
+	timer    *time.Timer
+}
+
+func newTypingTracker(h *Hub) *typingTracker {
+	return &typingTracker{hub: h, state: make(map[string]*typingState), typing: make(map[string]int)}
+}
+
+// start records that a connection is typing. It only broadcasts if the
+// connection's previous broadcast is older than typingThrottle.
+func (t *typingTracker) start(connID, channelID, userID string) {
+	now := time.Now()
+
+	t.mu.Lock()
+	st, ok := t.state[connID]
+	if !ok {
+		st = &typingState{}
+		st.timer = time.AfterFunc(typingTTL, func() { t.expire(connID, st, channelID, userID) })
+		t.state[connID] = st
+		t.typing[channelID+"|"+userID]++
+	} else {
+		st.timer.Reset(typingTTL)
+	}
+	throttled := now.Sub(st.lastSent) < typingThrottle
+	if !throttled {
+		st.lastSent = now
+	}
+	t.mu.Unlock()
+
+	if !throttled {
+		expiresAt := now.Add(typingTTL)
+		t.publish(channelID, userID, model.TypingStart, &expiresAt)
+	}
+}
+
+// stop clears a connection's typing, e.g. because the user sent the
+// message, deleted the draft or disconnected. Connections that are not
+// typing are ignored.
+func (t *typingTracker) stop(connID, channelID, userID string) {
+	t.mu.Lock()
+	st, ok := t.state[connID]
+	last := false
+	if ok {
+		st.timer.Stop()
+		last = t.remove(connID, channelID, userID)
+	}
+	t.mu.Unlock()
+
+	if last {
+		t.publish(channelID, userID, model.TypingStop, nil)
+	}
+}
+
+// expire runs when a connection stopped sending typing frames without
+// saying so.
+func (t *typingTracker) expire(connID string, st *typingState, channelID, userID string) {
+	t.mu.Lock()
+	// A newer state may have replaced this one in the meantime.
+	last := false
+	if t.state[connID] == st {
+		last = t.remove(connID, channelID, userID)
+	}
+	t.mu.Unlock()
+
+	if last {
+		t.publish(channelID, userID, model.TypingStop, nil)
+	}
+}
+
+// remove forgets a connection's typing and reports whether it was the
+// user's last connection typing in the channel. t.mu must be held.
+func (t *typingTracker) remove(connID, channelID, userID string) bool {
+	delete(t.state, connID)
+	key := channelID + "|" + userID
+	t.typing[key]--
+	if t.typing[key] > 0 {
+		return false
+	}
+	delete(t.typing, key)
+	return true
+}
+
+func (t *typingTracker) publish(channelID, userID, content string, expiresAt *time.Time) {
+	payload, err := json.Marshal(&model.Message{
+		ChannelID: channelID,
+		UserID:    userID,
+		Type:      model.TypeTyping,
+		Content:   content,
+		Timestamp: time.Now(),
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal typing event: %v", err)
+		return
+	}
+	if err := t.hub.redis.Publish(context.Background(), typingPrefix+channelID, payload).Err(); err != nil {
+		log.Printf("Failed to publish typing event for %s: %v", userID, err)
+	}
+}
+
+// run delivers typing events from every gateway to local clients until the
+// hub shuts down.
+func (t *typingTracker) run() {
+	sub := t.hub.redis.PSubscribe(context.Background(), typingPrefix+"*")
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-t.hub.done:
+			return
+		case m, ok := <-ch:
+			if !ok {
+				return
+			}
+			t.hub.route(strings.TrimPrefix(m.Channel, typingPrefix), []byte(m.Payload))
+		}
+	}
+}
+
+// handleTyping interprets a typing frame from a client. Anything other than
+// an explicit "stop" counts as a keystroke.
+func (c *Client) handleTyping(content string) {
+	if content == model.TypingStop {
+		c.hub.typing.stop(c.connID, c.ChannelID, c.ID)
+		return
+	}
+	c.hub.typing.start(c.connID, c.ChannelID, c.ID)
+}
@@ -32,6 +32,32 @@ var (
 	space   = []byte{' '}
 )
 
+// Frame types clients may send. Every other type is announced by the
+// gateway, the API or the messaging service themselves, so frames claiming
+// one are dropped.
+var clientEvents = map[model.MessageType]bool{
+	// Text, and slash commands
+	model.TypeMessage: true,
+	model.TypeTyping:  true,
+	model.TypeStatus:  true,
+	// Checked and applied by the messaging service
+	model.TypeEdit: true,
+}
+
+// canJoin reports whether a user may be in a channel, by the same rules
+// serveWs applies when they connect: DMs are for their two participants,
+// and user channels cannot be joined.
+func canJoin(userID, channelID string) bool {
+	if strings.HasPrefix(channelID, model.UserChannelPrefix) {
+		return false
+	}
+	if !strings.HasPrefix(channelID, "dm:") {
+		return true
+	}
+	parts := strings.Split(channelID, ":")
+	return len(parts) == 3 && (parts[1] == userID || parts[2] == userID)
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -55,12 +81,20 @@ type Client struct {
 
 	// Channel ID the client is connected to
 	ChannelID string
+
+	// Unique ID of this connection, used to reference-count presence
+	connID string
+
+	// Identity the connection was opened with. Its token ID lets revoking
+	// the token or API key close the connection.
+	claims *auth.Claims
 }
 
 // readPump pumps messages from the websocket connection to the hub.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.typing.stop(c.connID, c.ChannelID, c.ID)
+		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
@@ -69,7 +103,7 @@ func (c *Client) readPump() {
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
 				log.Printf("error: %v", err)
 			}
 			break
@@ -83,8 +117,11 @@ func (c *Client) readPump() {
 
 		// Try to parse as JSON to see if it has a type, else treat as raw content
 		var partialMsg struct {
-			Type    model.MessageType `json:"type"`
-			Content string            `json:"content"`
+			Type        model.MessageType `json:"type"`
+			Content     string            `json:"content"`
+			Status      *model.UserStatus `json:"status"`
+			TargetID    int64             `json:"target_id"`
+			Attachments []string          `json:"attachments"`
 		}
 
 		msg := &model.Message{
@@ -93,15 +130,87 @@ func (c *Client) readPump() {
 			Timestamp: time.Now(),
 		}
 
-		if err := json.Unmarshal(message, &partialMsg); err == nil && partialMsg.Type != "" {
+		isJSON := json.Unmarshal(message, &partialMsg) == nil && partialMsg.Type != ""
+
+		// Every frame acts on the user's behalf, so read-only API keys are
+		// turned away before anything is looked up or stored.
+		if !c.allows(auth.ScopeMessagesWrite) {
+			frameType := model.TypeMessage
+			if isJSON {
+				frameType = partialMsg.Type
+			}
+			log.Printf("Dropping message from %s: API key lacks %s for %s", c.ID, auth.ScopeMessagesWrite, c.ChannelID)
+			c.audit("ws.denied", string(frameType)+" to "+c.ChannelID)
+			continue
+		}
+
+		if isJSON {
 			msg.Type = partialMsg.Type
 			msg.Content = partialMsg.Content
+			msg.TargetID = partialMsg.TargetID
+
+			if !clientEvents[msg.Type] {
+				log.Printf("Dropping %q frame from %s: clients cannot send it", msg.Type, c.ID)
+				continue
+			}
+
+			// Attachments are uploaded through the API first and referenced by ID.
+			if len(partialMsg.Attachments) > 0 {
+				if msg.Type != model.TypeMessage {
+					continue
+				}
+				attachments, err := c.hub.resolveAttachments(c, partialMsg.Attachments)
+				if err != nil {
+					log.Printf("Dropping message from %s: %v", c.ID, err)
+					c.reply("attachments", "Could not send the message: "+err.Error())
+					continue
+				}
+				msg.Attachments = attachments
+			}
+
+			// Edits name the message they replace. They go to the messaging
+			// service only, which applies them for the author and announces
+			// them with a TypeEdited event.
+			if msg.Type == model.TypeEdit && msg.TargetID == 0 {
+				continue
+			}
+
+			// Status changes are user-level; the hub stores and fans them out.
+			if msg.Type == model.TypeStatus {
+				if partialMsg.Status == nil {
+					partialMsg.Status = &model.UserStatus{Status: model.Status(partialMsg.Content)}
+				}
+				if err := c.hub.setStatus(c, partialMsg.Status); err != nil {
+					log.Printf("Failed to set status for %s: %v", c.ID, err)
+				}
+				continue
+			}
+
+			// Typing indicators bypass Kafka entirely.
+			if msg.Type == model.TypeTyping {
+				c.handleTyping(msg.Content)
+				continue
+			}
 		} else {
 			msg.Type = model.TypeMessage
 			msg.Content = string(message)
 		}
 
-		c.hub.broadcast <- msg
+		// Sending a message ends the sender's typing indicator.
+		if msg.Type == model.TypeMessage {
+			c.hub.typing.stop(c.connID, c.ChannelID, c.ID)
+
+			// Slash commands are never broadcast; "//" escapes a leading slash.
+			if strings.HasPrefix(msg.Content, "//") {
+				msg.Content = msg.Content[1:]
+			} else if strings.HasPrefix(msg.Content, "/") && len(msg.Attachments) == 0 {
+				c.handleCommand(msg.Content)
+				continue
+			}
+		}
+
+		c.audit("ws.message", string(msg.Type)+" to "+c.ChannelID)
+		c.hub.Publish(msg)
 	}
 }
 
@@ -148,6 +257,13 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	// A draining gateway only sends clients away.
+	if hub.Draining() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Gateway is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Extract User ID from Auth Token
 	tokenString := r.Header.Get("Authorization")
 	if tokenString == "" {
@@ -166,7 +282,7 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		tokenString = tokenString[7:]
 	}
 
-	claims, err := auth.ValidateToken(tokenString)
+	claims, err := hub.authenticate(r.Context(), tokenString)
 	if err != nil {
 		log.Printf("Unauthorized: Invalid token: %v", err)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -195,14 +311,27 @@ func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// User channels carry server events and cannot be joined
+	if strings.HasPrefix(channelID, model.UserChannelPrefix) {
+		http.Error(w, "Cannot join a user channel", http.StatusForbidden)
+		return
+	}
+
+	// API keys must be allowed on the channel
+	if claims.APIKey != nil && !claims.Allows(auth.ScopeMessagesWrite, channelID) && !claims.Allows(auth.ScopeHistoryRead, channelID) {
+		http.Error(w, "API key is not allowed on this channel", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), ID: userID, ChannelID: channelID}
-	client.hub.register <- client
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), ID: userID, ChannelID: channelID, connID: hub.newConnID(), claims: claims}
+	client.hub.Register(client)
+	client.audit("ws.connect", channelID)
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -3,103 +3,224 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/mahaj/networking-minor/pkg/db"
 	"github.com/mahaj/networking-minor/pkg/model"
 	"github.com/segmentio/kafka-go"
 )
 
 type Consumer struct {
-	reader *kafka.Reader
-	db     *db.Session
+	reader     *kafka.Reader
+	db         *db.Session
+	policies   *policyCache
+	mentions   *Mentions
+	deadLetter *kafka.Writer
+
+	// Announces applied edits
+	events  *kafka.Writer
+	groupID string
+
+	// Only one DLQ replay may run at a time.
+	replaying sync.Mutex
 }
 
-func NewConsumer(brokers []string, topic string, groupID string, session *db.Session) *Consumer {
+func NewConsumer(brokers []string, topic string, groupID string, session *db.Session, policies *policyCache, mentions *Mentions) *Consumer {
 	r := kafka.NewReader(kafka.ReaderConfig{
 		Brokers:  brokers,
 		Topic:    topic,
 		GroupID:  groupID,
 		MinBytes: 10e3, // 10KB
 		MaxBytes: 10e6, // 10MB
+
+		// Fetch ahead so partition workers always have a full batch waiting
+		MaxWait:       100 * time.Millisecond,
+		QueueCapacity: persistBatchSize,
 	})
 
-	return &Consumer{reader: r, db: session}
+	return &Consumer{
+		reader:     r,
+		db:         session,
+		policies:   policies,
+		mentions:   mentions,
+		deadLetter: newDeadLetterWriter(brokers, topic+dlqSuffix),
+		events: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		},
+		groupID: groupID,
+	}
 }
 
+// Consume fetches records until ctx is done and hands them to a pipeline
+// that stores them in batches. Offsets are only committed once a record has
+// been stored or dead-lettered, so a crash replays it instead of losing it.
 func (c *Consumer) Consume(ctx context.Context) {
+	p := c.newPipeline(c.reader.CommitMessages)
+	defer p.close()
+
 	for {
-		m, err := c.reader.ReadMessage(ctx)
+		m, err := c.reader.FetchMessage(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Printf("Error reading message: %v. Retrying in 1s...", err)
 			time.Sleep(1 * time.Second)
 			continue
 		}
-		log.Printf("Received message from Kafka: %s", string(m.Value))
+		p.dispatch(ctx, m)
+	}
+}
 
-		// Parse JSON message
-		var msg model.Message
-		if err := json.Unmarshal(m.Value, &msg); err != nil {
-			log.Printf("Failed to unmarshal message: %v", err)
-			continue
-		}
+// handle processes a record, retrying failures and dead-lettering it when
+// the retries run out. It only returns false if ctx is done first.
+func (c *Consumer) handle(ctx context.Context, m kafka.Message) bool {
+	attempts, err := c.processWithRetry(ctx, m)
+	if err == nil {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	log.Printf("Dead-lettering offset %d of partition %d after %d attempts: %v", m.Offset, m.Partition, attempts, err)
 
-		// Only persist actual messages
-		if msg.Type != model.TypeMessage {
-			log.Printf("Skipping persistence for ephemeral message type: %s", msg.Type)
-			continue
+	// Keep trying: committing without a dead letter would lose the record.
+	backoff := retryBaseBackoff
+	for {
+		dlErr := c.writeDeadLetter(ctx, m, err, attempts)
+		if dlErr == nil {
+			return true
 		}
+		log.Printf("Failed to write dead letter: %v. Retrying in %s...", dlErr, backoff)
+		if !sleep(ctx, backoff) {
+			return false
+		}
+		backoff = min(backoff*2, retryMaxBackoff)
+	}
+}
 
-		// Persist to ScyllaDB
-		query := `INSERT INTO messages (channel_id, id, user_id, content, timestamp) VALUES (?, ?, ?, ?, ?)`
+// process stores one record. Errors wrapped with permanent are not retried.
+func (c *Consumer) process(m kafka.Message) error {
+	var msg model.Message
+	if err := json.Unmarshal(m.Value, &msg); err != nil {
+		return permanent(fmt.Errorf("unmarshal: %w", err))
+	}
 
-		if err := c.db.Query(query, msg.ChannelID, msg.ID, msg.UserID, msg.Content, msg.Timestamp).Exec(); err != nil {
-			log.Printf("Failed to save message to ScyllaDB: %v", err)
-		} else {
-			log.Printf("Message saved to ScyllaDB: %d", msg.ID)
-		}
+	if msg.Type == model.TypeEdit {
+		return c.applyEdit(&msg)
+	}
 
-		// DM Persistence: Update user_conversations table
-		if len(msg.ChannelID) > 3 && msg.ChannelID[:3] == "dm:" {
-			parts := strings.Split(msg.ChannelID, ":")
-			if len(parts) == 3 {
-				u1 := parts[1]
-				u2 := parts[2]
-
-				// Insert for u1 (u1 talks to u2)
-				q1 := `INSERT INTO user_conversations (user_id, other_user_id, last_updated) VALUES (?, ?, ?)`
-				if err := c.db.Query(q1, u1, u2, msg.Timestamp).Exec(); err != nil {
-					log.Printf("Failed to update conversation for %s: %v", u1, err)
-				}
-
-				// Insert for u2 (u2 talks to u1)
-				q2 := `INSERT INTO user_conversations (user_id, other_user_id, last_updated) VALUES (?, ?, ?)`
-				if err := c.db.Query(q2, u2, u1, msg.Timestamp).Exec(); err != nil {
-					log.Printf("Failed to update conversation for %s: %v", u2, err)
-				}
-
-				// Increment unread count for the recipient
-				// If u1 sent to u2, then u2 has an unread message from u1
-				// We need to know who sent it. msg.UserID is the sender.
-				sender := msg.UserID
-				var recipient string
-				if u1 == sender {
-					recipient = u2
-				} else {
-					recipient = u1
-				}
-
-				qCounter := `UPDATE conversation_counters SET unread_count = unread_count + 1 WHERE user_id = ? AND other_user_id = ?`
-				if err := c.db.Query(qCounter, recipient, sender).Exec(); err != nil {
-					log.Printf("Failed to increment unread count for %s: %v", recipient, err)
-				}
-			}
-		}
+	// Only persist actual messages
+	if msg.Type != model.TypeMessage {
+		log.Printf("Skipping persistence for ephemeral message type: %s", msg.Type)
+		return nil
+	}
+
+	if !c.policies.expire(&msg) {
+		log.Printf("Not storing message %d: it has already expired", msg.ID)
+		return nil
+	}
+	if err := c.mentions.resolve([]*model.Message{&msg}); err != nil {
+		return err
 	}
+	if err := c.scheduleExpiries([]*model.Message{&msg}); err != nil {
+		return err
+	}
+
+	// Attachments and mentions are stored as JSON alongside the message
+	attachments, err := attachmentsJSON(&msg)
+	if err != nil {
+		return err
+	}
+	mentions, err := mentionsJSON(&msg)
+	if err != nil {
+		return err
+	}
+
+	// Persist to ScyllaDB. Inserts are idempotent, so retrying is safe.
+	if err := c.db.Query(insertMessage, msg.ChannelID, msg.ID, msg.UserID, msg.Content, msg.Timestamp, msg.DisplayName, msg.Bot, attachments, mentions, ttlSeconds(&msg)).Exec(); err != nil {
+		return fmt.Errorf("save message %d: %w", msg.ID, err)
+	}
+	log.Printf("Message saved to ScyllaDB: %d", msg.ID)
+	if err := c.updateConversations([]*model.Message{&msg}); err != nil {
+		return err
+	}
+	return c.mentions.notify(context.Background(), []*model.Message{&msg})
+}
+
+// applyEdit replaces a message's content if the edit comes from its author.
+// Edits of messages that are not stored are dead-lettered straight away: the
+// original may itself be waiting in the dead-letter topic.
+func (c *Consumer) applyEdit(msg *model.Message) error {
+	stored := model.Message{ID: msg.TargetID, ChannelID: msg.ChannelID, Type: model.TypeMessage}
+	var ttl int
+	var mentions string
+	err := c.db.Query(`SELECT user_id, timestamp, display_name, mentions, TTL(content) FROM messages WHERE channel_id = ? AND id = ?`, msg.ChannelID, msg.TargetID).
+		Scan(&stored.UserID, &stored.Timestamp, &stored.DisplayName, &mentions, &ttl)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return permanent(fmt.Errorf("edit of unknown message %d", msg.TargetID))
+	}
+	if err != nil {
+		return fmt.Errorf("load message %d for edit: %w", msg.TargetID, err)
+	}
+	if stored.UserID != msg.UserID {
+		log.Printf("Ignoring edit of message %d by %s: not the author", msg.TargetID, msg.UserID)
+		return nil
+	}
+
+	stored.Content = msg.Content
+	if ttl > 0 {
+		expiresAt := time.Now().Add(time.Duration(ttl) * time.Second)
+		stored.ExpiresAt = &expiresAt
+	}
+	if err := c.mentions.resolve([]*model.Message{&stored}); err != nil {
+		return err
+	}
+	edited, err := mentionsJSON(&stored)
+	if err != nil {
+		return err
+	}
+
+	// The edit expires with the message; without the TTL the new cells
+	// would outlive the rest of the row.
+	query := `UPDATE messages USING TTL ? SET content = ?, mentions = ?, edited_at = ? WHERE channel_id = ? AND id = ?`
+	if err := c.db.Query(query, ttl, msg.Content, edited, msg.Timestamp, msg.ChannelID, msg.TargetID).Exec(); err != nil {
+		return fmt.Errorf("edit message %d: %w", msg.TargetID, err)
+	}
+
+	// Clients only learn about edits that were applied. Failing here retries
+	// the whole edit, which is idempotent.
+	announcement := model.Message{
+		ChannelID: msg.ChannelID,
+		UserID:    stored.UserID,
+		Type:      model.TypeEdited,
+		TargetID:  msg.TargetID,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+	}
+	payload, err := json.Marshal(&announcement)
+	if err != nil {
+		return permanent(err)
+	}
+	if err := c.events.WriteMessages(context.Background(), kafka.Message{Key: []byte(msg.ChannelID), Value: payload}); err != nil {
+		return fmt.Errorf("announce edit of %d: %w", msg.TargetID, err)
+	}
+
+	// Only users the edit mentions for the first time are notified
+	added := stored
+	added.Mentions = newMentions(storedMentions(mentions), stored.Mentions)
+	return c.mentions.notify(context.Background(), []*model.Message{&added})
 }
 
 func (c *Consumer) Close() error {
+	c.deadLetter.Close()
+	c.events.Close()
 	return c.reader.Close()
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Shape of the benchmark: channels, a share of them DMs, spread over
+	// Kafka partitions.
+	benchChannels   = 100
+	benchPartitions = 12
+	benchDMShare    = 0.1
+
+	// Scratch keyspace, dropped afterwards.
+	benchKeyspace = "chat_bench"
+)
+
+// BenchmarkPersist measures how fast messages are stored, one record at a
+// time as the consumer used to, and through the batching pipeline:
+//
+//	go test ./apps/messaging -run '^$' -bench Persist -benchtime 50000x
+//
+// It needs Scylla (SCYLLA_HOSTS, default localhost:9042) and is skipped
+// without it. Records are generated in memory, so only Scylla is measured.
+func BenchmarkPersist(b *testing.B) {
+	session := benchSession(b)
+
+	// Records that fail are dead-lettered to a topic of their own.
+	brokers := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
+	if brokers[0] == "" {
+		brokers = []string{"localhost:19092"}
+	}
+	c := &Consumer{db: session, policies: newPolicyCache(session), deadLetter: newDeadLetterWriter(brokers, "chat-messages-bench"+dlqSuffix), groupID: "messaging-bench"}
+	b.Cleanup(func() { c.deadLetter.Close() })
+	ctx := context.Background()
+
+	// Per-record logging would dominate both runs.
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	b.Run("sequential", func(b *testing.B) {
+		records := benchRecords(b.N, benchChannels, benchPartitions, benchDMShare)
+		b.ResetTimer()
+		for _, m := range records {
+			c.handle(ctx, m)
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+	})
+	b.Run("batched", func(b *testing.B) {
+		records := benchRecords(b.N, benchChannels, benchPartitions, benchDMShare)
+		b.ResetTimer()
+		p := c.newPipeline(func(context.Context, ...kafka.Message) error { return nil })
+		for _, m := range records {
+			p.dispatch(ctx, m)
+		}
+		p.close()
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+	})
+}
+
+// benchSession connects to a fresh scratch keyspace, or skips the test or
+// benchmark if Scylla is not reachable.
+func benchSession(b testing.TB) *db.Session {
+	hosts := os.Getenv("SCYLLA_HOSTS")
+	if hosts == "" {
+		hosts = "localhost:9042"
+	}
+	scyllaHosts := strings.Split(hosts, ",")
+
+	sysSession, err := db.NewSession(scyllaHosts, "system")
+	if err != nil {
+		b.Skipf("ScyllaDB is not available: %v", err)
+	}
+	b.Cleanup(sysSession.Close)
+	err = sysSession.Query(`CREATE KEYSPACE IF NOT EXISTS ` + benchKeyspace + ` WITH REPLICATION = { 'class' : 'SimpleStrategy', 'replication_factor' : 1 }`).Exec()
+	if err != nil {
+		b.Fatalf("Failed to create keyspace: %v", err)
+	}
+	b.Cleanup(func() { sysSession.Query(`DROP KEYSPACE IF EXISTS ` + benchKeyspace).Exec() })
+
+	session, err := db.NewSession(scyllaHosts, benchKeyspace)
+	if err != nil {
+		b.Fatalf("Failed to connect to ScyllaDB %s keyspace: %v", benchKeyspace, err)
+	}
+	b.Cleanup(session.Close)
+	if err := migrate(session, benchKeyspace); err != nil {
+		b.Fatalf("Failed to migrate schema: %v", err)
+	}
+	return session
+}
+
+// benchRecords generates n chat messages spread round-robin over channels,
+// each channel on one partition as Kafka's key hashing would place it.
+func benchRecords(n, channels, partitions int, dmShare float64) []kafka.Message {
+	dms := int(float64(channels) * dmShare)
+	channelIDs := make([]string, channels)
+	for i := range channelIDs {
+		if i < dms {
+			channelIDs[i] = fmt.Sprintf("dm:bench-%d:bench-%d", i, i+1)
+		} else {
+			channelIDs[i] = "bench-" + strconv.Itoa(i)
+		}
+	}
+
+	offsets := make([]int64, partitions)
+	base := time.Now().UnixNano()
+	records := make([]kafka.Message, n)
+	for i := range records {
+		channelID := channelIDs[i%channels]
+		h := fnv.New32a()
+		h.Write([]byte(channelID))
+		partition := int(h.Sum32() % uint32(partitions))
+
+		msg := model.Message{
+			ID:        base + int64(i),
+			ChannelID: channelID,
+			UserID:    "bench-" + strconv.Itoa(i%channels),
+			Type:      model.TypeMessage,
+			Content:   "benchmark message " + strconv.Itoa(i),
+			Timestamp: time.Now(),
+		}
+		value, _ := json.Marshal(msg)
+		records[i] = kafka.Message{
+			Topic:     "chat-messages",
+			Partition: partition,
+			Offset:    offsets[partition],
+			Key:       []byte(channelID),
+			Value:     value,
+		}
+		offsets[partition]++
+	}
+	return records
+}
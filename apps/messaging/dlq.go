@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Attempts to process a record before it is dead-lettered. Waits between
+	// attempts double from retryBaseBackoff up to retryMaxBackoff.
+	retryMaxAttempts = 5
+	retryBaseBackoff = 200 * time.Millisecond
+	retryMaxBackoff  = 5 * time.Second
+
+	// Records that cannot be processed go to the source topic plus this
+	// suffix, e.g. chat-messages-dlq.
+	dlqSuffix = "-dlq"
+
+	// Consumer group used to replay dead letters.
+	replayGroupID = "messaging-dlq-replay"
+
+	// A replay ends once no dead letter arrives for this long.
+	replayIdleTimeout = 10 * time.Second
+
+	// Header carrying DLQ_SECRET to the replay endpoint.
+	dlqSecretHeader = "X-DLQ-Secret"
+
+	// Development fallback, only used when DLQ_DEV_SECRET=true. It is
+	// public, so anyone reaching the internal port could replay with it.
+	dlqDevSecret = "dev-dlq-secret"
+)
+
+// Headers added to dead letters. The value and key are the original record's.
+const (
+	headerError     = "x-error"
+	headerAttempts  = "x-attempts"
+	headerTopic     = "x-original-topic"
+	headerPartition = "x-original-partition"
+	headerOffset    = "x-original-offset"
+	headerGroup     = "x-consumer-group"
+	headerFailedAt  = "x-failed-at"
+)
+
+// permanentError marks failures that retrying cannot fix, such as a record
+// that is not valid JSON.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// sleep waits for d, or returns false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// processWithRetry processes a record, retrying failures that are not
+// permanent with exponential backoff. It returns the number of attempts made.
+func (c *Consumer) processWithRetry(ctx context.Context, m kafka.Message) (int, error) {
+	backoff := retryBaseBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.process(m)
+		if err == nil {
+			return attempt, nil
+		}
+		if isPermanent(err) || attempt == retryMaxAttempts {
+			return attempt, err
+		}
+		log.Printf("Attempt %d for offset %d of partition %d failed: %v. Retrying in %s...", attempt, m.Offset, m.Partition, err, backoff)
+		if !sleep(ctx, backoff) {
+			return attempt, ctx.Err()
+		}
+		backoff = min(backoff*2, retryMaxBackoff)
+	}
+}
+
+func newDeadLetterWriter(brokers []string, topic string) *kafka.Writer {
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(brokers...),
+		Topic:                  topic,
+		Balancer:               &kafka.Hash{},
+		RequiredAcks:           kafka.RequireAll,
+		AllowAutoTopicCreation: true,
+	}
+}
+
+// writeDeadLetter copies a record to the dead-letter topic with the reason
+// it failed.
+func (c *Consumer) writeDeadLetter(ctx context.Context, m kafka.Message, cause error, attempts int) error {
+	return c.deadLetter.WriteMessages(ctx, kafka.Message{
+		Key:   m.Key,
+		Value: m.Value,
+		Headers: []kafka.Header{
+			{Key: headerError, Value: []byte(cause.Error())},
+			{Key: headerAttempts, Value: []byte(strconv.Itoa(attempts))},
+			{Key: headerTopic, Value: []byte(m.Topic)},
+			{Key: headerPartition, Value: []byte(strconv.Itoa(m.Partition))},
+			{Key: headerOffset, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+			{Key: headerGroup, Value: []byte(c.groupID)},
+			{Key: headerFailedAt, Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+		},
+	})
+}
+
+func header(m kafka.Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// ReplayResult summarizes a replay.
+type ReplayResult struct {
+	Replayed int    `json:"replayed"`
+	Dropped  int    `json:"dropped"`
+	Error    string `json:"error,omitempty"`
+}
+
+// replay reprocesses dead letters in order. Records that fail permanently
+// again are dropped; any other failure stops the replay at that record so a
+// later replay, once the cause is fixed, resumes there. Records dead-lettered
+// after the replay started are left for the next one, so a record that keeps
+// failing cannot loop.
+func (c *Consumer) replay(ctx context.Context, brokers []string, topic string) (ReplayResult, error) {
+	var res ReplayResult
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		Topic:       topic + dlqSuffix,
+		GroupID:     replayGroupID,
+		StartOffset: kafka.FirstOffset,
+		MinBytes:    1,
+		MaxBytes:    10e6,
+	})
+	defer r.Close()
+
+	started := time.Now()
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, replayIdleTimeout)
+		m, err := r.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return res, nil
+			}
+			return res, err
+		}
+
+		if failedAt, err := time.Parse(time.RFC3339Nano, header(m, headerFailedAt)); err == nil && failedAt.After(started) {
+			return res, nil
+		}
+
+		original := kafka.Message{Topic: header(m, headerTopic), Key: m.Key, Value: m.Value}
+		original.Partition, _ = strconv.Atoi(header(m, headerPartition))
+		original.Offset, _ = strconv.ParseInt(header(m, headerOffset), 10, 64)
+
+		_, err = c.processWithRetry(ctx, original)
+		switch {
+		case err == nil:
+			res.Replayed++
+		case isPermanent(err):
+			log.Printf("Dropping dead letter %d (originally offset %d of partition %d): %v", m.Offset, original.Offset, original.Partition, err)
+			res.Dropped++
+		default:
+			return res, fmt.Errorf("dead letter %d still fails: %w", m.Offset, err)
+		}
+
+		if err := r.CommitMessages(ctx, m); err != nil {
+			return res, err
+		}
+	}
+}
+
+// loadDLQSecret returns the secret that authorizes dead-letter replays, from
+// DLQ_SECRET. Without it, DLQ_DEV_SECRET=true falls back to the development
+// secret; otherwise it is an error. It is separate from SEARCH_SECRET, so
+// the API, which can search, cannot replay.
+func loadDLQSecret() (string, error) {
+	if secret := os.Getenv("DLQ_SECRET"); secret != "" {
+		return secret, nil
+	}
+	if os.Getenv("DLQ_DEV_SECRET") != "true" {
+		return "", errors.New("DLQ_SECRET is not set; set it, or set DLQ_DEV_SECRET=true for local development")
+	}
+	log.Println("WARNING: DLQ_SECRET is not set, using the insecure development secret")
+	return dlqDevSecret, nil
+}
+
+// ReplayHandler serves POST /internal/replay-dlq, which the replay-dlq
+// command calls. Replays run inside the service, next to the consumer whose
+// records they reprocess. Callers present DLQ_SECRET.
+func ReplayHandler(c *Consumer, brokers []string, topic, secret string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(dlqSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !c.replaying.TryLock() {
+			http.Error(w, "A replay is already running", http.StatusConflict)
+			return
+		}
+		defer c.replaying.Unlock()
+
+		log.Printf("Replaying dead letters from %s%s...", topic, dlqSuffix)
+		res, err := c.replay(r.Context(), brokers, topic)
+		status := http.StatusOK
+		if err != nil {
+			res.Error = err.Error()
+			status = http.StatusInternalServerError
+		}
+		log.Printf("Replay finished: %d replayed, %d dropped, error: %v", res.Replayed, res.Dropped, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// runReplayCommand asks the running service at addr to replay the
+// dead-letter topic and prints the outcome. It authenticates with the
+// service's own DLQ_SECRET.
+func runReplayCommand(addr string) {
+	secret, err := loadDLQSecret()
+	if err != nil {
+		log.Fatalf("Failed to load DLQ secret: %v", err)
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	req, err := http.NewRequest(http.MethodPost, addr+"/internal/replay-dlq", nil)
+	if err != nil {
+		log.Fatalf("Invalid messaging service address %s: %v", addr, err)
+	}
+	req.Header.Set(dlqSecretHeader, secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Failed to reach the messaging service at %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusConflict:
+		log.Fatal("A replay is already running")
+	case http.StatusForbidden:
+		log.Fatal("The messaging service rejected DLQ_SECRET")
+	}
+
+	var res ReplayResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		log.Fatalf("Unexpected response from the messaging service: %s", resp.Status)
+	}
+	fmt.Printf("Replayed %d dead letters, dropped %d that can never succeed\n", res.Replayed, res.Dropped)
+	if res.Error != "" {
+		fmt.Fprintf(os.Stderr, "Replay stopped: %s\n", res.Error)
+		os.Exit(1)
+	}
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 
+	"github.com/mahaj/networking-minor/pkg/blob"
 	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/prefs"
+	"github.com/mahaj/networking-minor/pkg/search"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -22,6 +28,37 @@ func main() {
 	}
 	scyllaHosts := strings.Split(scyllaHostsStr, ",")
 
+	// Presence, for @here
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	// Search index on local disk
+	indexPath := os.Getenv("SEARCH_INDEX")
+	if indexPath == "" {
+		indexPath = "messages.bleve"
+	}
+
+	// Every index needs a consumer group of its own, so replicas with
+	// separate indexes each set one.
+	indexGroupID := os.Getenv("SEARCH_GROUP_ID")
+	if indexGroupID == "" {
+		indexGroupID = "search-index-group"
+	}
+
+	// Internal endpoints: search for the API, DLQ replay for operators
+	internalAddr := os.Getenv("INTERNAL_ADDR")
+	if internalAddr == "" {
+		internalAddr = ":8082"
+	}
+
+	// Ask the running service to reprocess dead letters
+	if len(os.Args) > 1 && os.Args[1] == "replay-dlq" {
+		runReplayCommand(internalAddr)
+		return
+	}
+
 	topic := "chat-messages"
 	groupID := "messaging-service-group"
 	keyspace := "chat"
@@ -49,44 +86,108 @@ func main() {
 	}
 	defer session.Close()
 
-	// Create messages table
-	err = session.Query(`CREATE TABLE IF NOT EXISTS messages (
-		channel_id text,
-		id bigint,
-		user_id text,
-		content text,
-		timestamp timestamp,
-		PRIMARY KEY (channel_id, id)
-	) WITH CLUSTERING ORDER BY (id DESC)`).Exec()
+	if err := migrate(session, keyspace); err != nil {
+		log.Fatalf("Failed to migrate schema: %v", err)
+	}
+
+	// Rebuild the search index from Scylla. The service must be stopped
+	// while this runs, since both write the index.
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		if err := reindex(session, indexPath); err != nil {
+			log.Fatalf("Failed to reindex messages: %v", err)
+		}
+		return
+	}
+
+	index, err := search.Open(indexPath)
+	if err != nil {
+		log.Fatalf("Failed to open search index %s: %v", indexPath, err)
+	}
+	defer index.Close()
+
+	// Shared with the API, which sends searches on behalf of its users
+	searchSecret, err := search.LoadSecret()
 	if err != nil {
-		log.Fatalf("Failed to create messages table: %v", err)
+		log.Fatalf("Failed to load search secret: %v", err)
+	}
+	// Outgoing webhooks run on their own consumer group
+	webhooks := NewWebhookWorker(brokers, topic, session)
+	defer webhooks.Close()
+	go webhooks.Run(context.Background())
+
+	// Retention policies decide which new messages get a TTL
+	policies := newPolicyCache(session)
+	if err := policies.load(); err != nil {
+		log.Fatalf("Failed to load retention policies: %v", err)
 	}
+	go policies.Run(context.Background())
 
-	// Create user_conversations table
-	err = session.Query(`CREATE TABLE IF NOT EXISTS user_conversations (
-		user_id text,
-		other_user_id text,
-		last_updated timestamp,
-		PRIMARY KEY (user_id, other_user_id)
-	)`).Exec()
+	// Operators present this to replay dead letters
+	dlqSecret, err := loadDLQSecret()
 	if err != nil {
-		log.Fatalf("Failed to create user_conversations table: %v", err)
+		log.Fatalf("Failed to load DLQ secret: %v", err)
 	}
 
-	// Create conversation_counters table
-	err = session.Query(`CREATE TABLE IF NOT EXISTS conversation_counters (
-		user_id text,
-		other_user_id text,
-		unread_count counter,
-		PRIMARY KEY (user_id, other_user_id)
-	)`).Exec()
+	// The search index follows chat-messages on its own consumer group
+	indexer := NewIndexer(brokers, topic, indexGroupID, session, index, policies, searchSecret)
+	defer indexer.Close()
+	go indexer.Run(context.Background())
+
+	// Attachments of removed messages are deleted from the API's blob store
+	store, err := blob.FromEnv(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to create conversation_counters table: %v", err)
+		log.Fatalf("Failed to open blob store: %v", err)
 	}
 
-	consumer := NewConsumer(brokers, topic, groupID, session)
+	// Announces expired messages and purges ones older than their retention
+	expiries := NewExpiryWorker(brokers, topic, session, policies, indexer, store)
+	defer expiries.Close()
+	go expiries.Run(context.Background())
+
+	// Presence for @here, and snowflake node leases
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer rdb.Close()
+
+	// Notification preferences used to be kept in Redis alone
+	if n, err := prefs.Import(context.Background(), session, rdb); err != nil {
+		log.Fatalf("Failed to import notification preferences from Redis: %v", err)
+	} else if n > 0 {
+		log.Printf("Imported the notification preferences of %d users from Redis", n)
+	}
+
+	// Each replica leases a snowflake node of its own unless SNOWFLAKE_NODE
+	// sets one.
+	var ids *snowflake.Node
+	ids, err = snowflake.Load(context.Background(), rdb, snowflake.FirstMessagingNode, snowflake.LastMessagingNode, func(err error) {
+		log.Fatalf("Lost the lease of snowflake node %d: %v", ids.Number(), err)
+	})
+	if err != nil {
+		log.Fatalf("Failed to get a snowflake node: %v", err)
+	}
+	log.Printf("Generating IDs as snowflake node %d", ids.Number())
+
+	// Scheduled messages and reminders
+	scheduler := NewScheduler(brokers, topic, session, ids)
+	defer scheduler.Close()
+	go scheduler.Run(context.Background())
+
+	// Mention notifications go to the mentioned users' own channels
+	mentions := NewMentions(brokers, topic, session, rdb)
+	defer mentions.Close()
+
+	consumer := NewConsumer(brokers, topic, groupID, session, policies, mentions)
 	defer consumer.Close()
 
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/internal/search", indexer)
+		mux.Handle("/internal/replay-dlq", ReplayHandler(consumer, brokers, topic, dlqSecret))
+		log.Printf("Internal endpoints listening on %s", internalAddr)
+		if err := http.ListenAndServe(internalAddr, mux); err != nil {
+			log.Fatalf("Internal endpoints failed: %v", err)
+		}
+	}()
+
 	log.Println("Starting Kafka Consumer...")
 	consumer.Consume(context.Background())
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/mention"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+// A message notifies at most this many users, however many @channel reaches.
+const maxMentionRecipients = 1000
+
+// Mentions parses the mentions of stored messages and notifies the users
+// they reach: each gets a row in their mentions inbox and a mention event on
+// their own channel, which gateways deliver to all of their connections.
+type Mentions struct {
+	db       *db.Session
+	redis    *redis.Client
+	producer *kafka.Writer
+}
+
+func NewMentions(brokers []string, topic string, session *db.Session, rdb *redis.Client) *Mentions {
+	return &Mentions{
+		db:    session,
+		redis: rdb,
+		producer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		},
+	}
+}
+
+// resolve sets the mentions of messages from their content. Mentions of
+// users that do not exist are dropped. A nil Mentions leaves messages alone.
+func (m *Mentions) resolve(msgs []*model.Message) error {
+	if m == nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		msg.Mentions = mention.Parse(msg.Content)
+		names := mention.Users(msg.Mentions)
+		if len(names) == 0 {
+			continue
+		}
+
+		exists := make(map[string]bool)
+		var userID string
+		iter := m.db.Query(`SELECT user_id FROM users WHERE user_id IN ?`, names).Iter()
+		for iter.Scan(&userID) {
+			exists[userID] = true
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("look up mentioned users: %w", err)
+		}
+
+		kept := msg.Mentions[:0]
+		for _, mn := range msg.Mentions {
+			if mn.Type != model.MentionUser || exists[mn.UserID] {
+				kept = append(kept, mn)
+			}
+		}
+		msg.Mentions = kept
+		if len(msg.Mentions) == 0 {
+			msg.Mentions = nil
+		}
+	}
+	return nil
+}
+
+// mentionsJSON returns a message's mentions as they are stored.
+func mentionsJSON(msg *model.Message) (string, error) {
+	if len(msg.Mentions) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(msg.Mentions)
+	if err != nil {
+		return "", permanent(fmt.Errorf("marshal mentions: %w", err))
+	}
+	return string(data), nil
+}
+
+// notify records the authors of stored messages as channel members, then
+// adds each message to the inboxes of the users it mentions and tells them.
+// Inbox rows are added with a lightweight transaction, and only users whose
+// row is new are told, so a redelivered message notifies nobody twice. If
+// the events cannot be sent, the rows added are removed again and an error
+// is returned, so that retrying the messages notifies those users.
+func (m *Mentions) notify(ctx context.Context, msgs []*model.Message) error {
+	if m == nil {
+		return nil
+	}
+	type member struct{ channel, user string }
+	posted := make(map[member]time.Time)
+	for _, msg := range msgs {
+		if _, _, ok := dmParticipants(msg.ChannelID); ok {
+			continue
+		}
+		k := member{msg.ChannelID, msg.UserID}
+		if msg.Timestamp.After(posted[k]) {
+			posted[k] = msg.Timestamp
+		}
+	}
+	for k, ts := range posted {
+		q := `INSERT INTO channel_members (channel_id, user_id, last_posted_at) VALUES (?, ?, ?) USING TIMESTAMP ?`
+		if err := m.db.Query(q, k.channel, k.user, ts, ts.UnixMicro()).Exec(); err != nil {
+			return fmt.Errorf("record %s as a member of %s: %w", k.user, k.channel, err)
+		}
+	}
+
+	type inboxRow struct {
+		user    string
+		message int64
+	}
+	var added []inboxRow
+	var events []kafka.Message
+	fail := func(err error) error {
+		for _, row := range added {
+			if err := m.db.Query(`DELETE FROM mentions WHERE user_id = ? AND message_id = ?`, row.user, row.message).Exec(); err != nil {
+				log.Printf("Failed to remove message %d from the mentions of %s: %v", row.message, row.user, err)
+			}
+		}
+		return err
+	}
+	for _, msg := range msgs {
+		if len(msg.Mentions) == 0 {
+			continue
+		}
+		recipients, err := m.recipients(ctx, msg)
+		if err != nil {
+			return fail(fmt.Errorf("find users mentioned by message %d: %w", msg.ID, err))
+		}
+		for _, userID := range recipients {
+			q := `INSERT INTO mentions (user_id, message_id, channel_id, author_id) VALUES (?, ?, ?, ?) IF NOT EXISTS USING TTL ?`
+			applied, err := m.db.Query(q, userID, msg.ID, msg.ChannelID, msg.UserID, ttlSeconds(msg)).MapScanCAS(map[string]interface{}{})
+			if err != nil {
+				return fail(fmt.Errorf("add message %d to the mentions of %s: %w", msg.ID, userID, err))
+			}
+			if !applied {
+				// Notified when the message was delivered before
+				continue
+			}
+			added = append(added, inboxRow{userID, msg.ID})
+			events = append(events, mentionEvent(userID, msg))
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	if err := m.producer.WriteMessages(ctx, events...); err != nil {
+		return fail(fmt.Errorf("send %d mention notifications: %w", len(events), err))
+	}
+	return nil
+}
+
+// recipients returns the users a message's mentions reach, other than its
+// author. In a DM only its two participants can be reached.
+func (m *Mentions) recipients(ctx context.Context, msg *model.Message) ([]string, error) {
+	var users []string
+	seen := map[string]bool{msg.UserID: true}
+	add := func(ids ...string) {
+		for _, id := range ids {
+			if !seen[id] && len(users) < maxMentionRecipients {
+				seen[id] = true
+				users = append(users, id)
+			}
+		}
+	}
+
+	u1, u2, isDM := dmParticipants(msg.ChannelID)
+	for _, id := range mention.Users(msg.Mentions) {
+		if !isDM || id == u1 || id == u2 {
+			add(id)
+		}
+	}
+
+	if mention.Has(msg.Mentions, model.MentionChannel) {
+		if isDM {
+			add(u1, u2)
+		} else {
+			var userID string
+			iter := m.db.Query(`SELECT user_id FROM channel_members WHERE channel_id = ?`, msg.ChannelID).Iter()
+			for iter.Scan(&userID) {
+				add(userID)
+			}
+			if err := iter.Close(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Everyone currently in the channel, which @channel includes too
+	if mention.Has(msg.Mentions, model.MentionChannel) || mention.Has(msg.Mentions, model.MentionHere) {
+		present, err := m.redis.SMembers(ctx, "channel:"+msg.ChannelID+":users").Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range present {
+			if !isDM || id == u1 || id == u2 {
+				add(id)
+			}
+		}
+	}
+	return users, nil
+}
+
+func mentionEvent(userID string, msg *model.Message) kafka.Message {
+	channelID := model.UserChannel(userID)
+	payload, _ := json.Marshal(model.Message{
+		ChannelID:       channelID,
+		UserID:          msg.UserID,
+		Type:            model.TypeMention,
+		Content:         msg.Content,
+		TargetID:        msg.ID,
+		TargetChannelID: msg.ChannelID,
+		DisplayName:     msg.DisplayName,
+		Timestamp:       time.Now(),
+		Mentions:        msg.Mentions,
+	})
+	return kafka.Message{Key: []byte(channelID), Value: payload}
+}
+
+// newMentions returns the mentions of edited that were not already in
+// original: users it names for the first time, and @channel or @here if
+// original did not have them.
+func newMentions(original, edited []model.Mention) []model.Mention {
+	had := make(map[model.Mention]bool)
+	for _, mn := range original {
+		had[model.Mention{Type: mn.Type, UserID: mn.UserID}] = true
+	}
+	var added []model.Mention
+	for _, mn := range edited {
+		if !had[model.Mention{Type: mn.Type, UserID: mn.UserID}] {
+			added = append(added, mn)
+		}
+	}
+	return added
+}
+
+// storedMentions decodes the mentions column of a message.
+func storedMentions(data string) []model.Mention {
+	var mentions []model.Mention
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &mentions); err != nil {
+			log.Printf("Invalid stored mentions: %v", err)
+		}
+	}
+	return mentions
+}
+
+func (m *Mentions) Close() error {
+	return m.producer.Close()
+}
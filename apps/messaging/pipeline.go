@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// A partition's records are stored in batches of up to persistBatchSize,
+	// waiting at most persistLinger for a batch to fill.
+	persistBatchSize = 500
+	persistLinger    = 5 * time.Millisecond
+
+	// Channels in a batch are written by this many goroutines per partition.
+	persistWorkers = 8
+
+	// Limits of one unlogged batch. Every statement in it has the same
+	// partition key, so Scylla applies it as a single mutation.
+	maxBatchStatements = 50
+	maxBatchBytes      = 32 << 10
+)
+
+// committer commits the offset of a record and everything before it in the
+// same partition.
+type committer func(ctx context.Context, msgs ...kafka.Message) error
+
+// pipeline stores records concurrently while keeping each channel in order.
+// Records go to a worker per partition, which splits every batch by channel
+// and writes the channels in parallel. The batch's offsets are committed once
+// all of it is stored or dead-lettered; a crash replays the batch, which the
+// idempotent inserts absorb.
+type pipeline struct {
+	consumer   *Consumer
+	commit     committer
+	partitions map[int]chan kafka.Message
+	wg         sync.WaitGroup
+}
+
+func (c *Consumer) newPipeline(commit committer) *pipeline {
+	return &pipeline{consumer: c, commit: commit, partitions: make(map[int]chan kafka.Message)}
+}
+
+// dispatch hands a record to its partition's worker. It must only be called
+// from one goroutine.
+func (p *pipeline) dispatch(ctx context.Context, m kafka.Message) {
+	in, ok := p.partitions[m.Partition]
+	if !ok {
+		in = make(chan kafka.Message, persistBatchSize)
+		p.partitions[m.Partition] = in
+		p.wg.Add(1)
+		go p.runPartition(ctx, in)
+	}
+	select {
+	case in <- m:
+	case <-ctx.Done():
+	}
+}
+
+// close stores the records already dispatched and waits for the workers.
+func (p *pipeline) close() {
+	for _, in := range p.partitions {
+		close(in)
+	}
+	p.wg.Wait()
+}
+
+func (p *pipeline) runPartition(ctx context.Context, in <-chan kafka.Message) {
+	defer p.wg.Done()
+
+	batch := make([]kafka.Message, 0, persistBatchSize)
+	for {
+		m, ok := <-in
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], m)
+
+		timer := time.NewTimer(persistLinger)
+	fill:
+		for len(batch) < persistBatchSize {
+			select {
+			case m, ok = <-in:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, m)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+
+		if !p.consumer.persistBatch(ctx, batch) {
+			return
+		}
+		if err := p.commit(ctx, batch[len(batch)-1]); err != nil {
+			log.Printf("Failed to commit offset %d of partition %d: %v", batch[len(batch)-1].Offset, batch[len(batch)-1].Partition, err)
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// persistBatch stores a batch of records from one partition, writing
+// different channels concurrently. It only returns false if ctx is done
+// first.
+func (c *Consumer) persistBatch(ctx context.Context, batch []kafka.Message) bool {
+	// Records are keyed by channel, so grouping by key keeps each channel's
+	// records together and in order.
+	byChannel := make(map[string][]kafka.Message)
+	var order []string
+	for _, m := range batch {
+		key := string(m.Key)
+		if _, ok := byChannel[key]; !ok {
+			order = append(order, key)
+		}
+		byChannel[key] = append(byChannel[key], m)
+	}
+
+	slots := make([][]string, min(persistWorkers, len(order)))
+	for _, key := range order {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		i := int(h.Sum32() % uint32(len(slots)))
+		slots[i] = append(slots[i], key)
+	}
+
+	var wg sync.WaitGroup
+	for _, keys := range slots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, key := range keys {
+				if !c.persistChannel(ctx, byChannel[key]) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err() == nil
+}
+
+// persistChannel stores one channel's records in order. Runs of new
+// messages are written as unlogged batches; edits, and messages whose batch
+// fails, go through handle one at a time so they are retried and
+// dead-lettered like before.
+func (c *Consumer) persistChannel(ctx context.Context, records []kafka.Message) bool {
+	var run []kafka.Message
+	var msgs []*model.Message
+
+	flush := func() bool {
+		if len(run) == 0 {
+			return true
+		}
+		defer func() { run, msgs = run[:0], msgs[:0] }()
+
+		err := c.mentions.resolve(msgs)
+		if err == nil {
+			err = c.scheduleExpiries(msgs)
+		}
+		if err == nil {
+			err = c.insertMessages(msgs)
+		}
+		if err == nil {
+			err = c.updateConversations(msgs)
+		}
+		if err == nil {
+			err = c.mentions.notify(ctx, msgs)
+		}
+		if err != nil {
+			// Saving is idempotent, and users already notified are not
+			// notified again.
+			log.Printf("Failed to save a batch of %d messages for %s, saving them one by one: %v", len(msgs), msgs[0].ChannelID, err)
+			for _, m := range run {
+				if !c.handle(ctx, m) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	for _, m := range records {
+		msg := new(model.Message)
+		if err := json.Unmarshal(m.Value, msg); err == nil && msg.Type == model.TypeMessage {
+			if !c.policies.expire(msg) {
+				continue
+			}
+			run = append(run, m)
+			msgs = append(msgs, msg)
+			continue
+		}
+		if !flush() || !c.handle(ctx, m) {
+			return false
+		}
+	}
+	return flush()
+}
+
+// A TTL of 0 stores the message without one.
+const insertMessage = `INSERT INTO messages (channel_id, id, user_id, content, timestamp, display_name, bot, attachments, mentions) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`
+
+// insertMessages writes messages in unlogged batches, starting a new batch
+// whenever the channel changes or a batch reaches its limits.
+func (c *Consumer) insertMessages(msgs []*model.Message) error {
+	var b *gocql.Batch
+	var size int
+	exec := func() error {
+		if b == nil {
+			return nil
+		}
+		err := c.db.ExecuteBatch(b)
+		b = nil
+		return err
+	}
+
+	for i, msg := range msgs {
+		attachments, err := attachmentsJSON(msg)
+		if err != nil {
+			return err
+		}
+		mentions, err := mentionsJSON(msg)
+		if err != nil {
+			return err
+		}
+		n := len(msg.Content) + len(attachments) + len(mentions)
+		if b != nil && (b.Size() == maxBatchStatements || size+n > maxBatchBytes || msg.ChannelID != msgs[i-1].ChannelID) {
+			if err := exec(); err != nil {
+				return err
+			}
+		}
+		if b == nil {
+			b = c.db.NewBatch(gocql.UnloggedBatch)
+			size = 0
+		}
+		b.Query(insertMessage, msg.ChannelID, msg.ID, msg.UserID, msg.Content, msg.Timestamp, msg.DisplayName, msg.Bot, attachments, mentions, ttlSeconds(msg))
+		size += n
+	}
+	return exec()
+}
+
+// attachmentsJSON returns a message's attachments as they are stored.
+func attachmentsJSON(msg *model.Message) (string, error) {
+	if len(msg.Attachments) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(msg.Attachments)
+	if err != nil {
+		return "", permanent(fmt.Errorf("marshal attachments: %w", err))
+	}
+	return string(data), nil
+}
+
+// updateConversations records stored DMs in both users' conversation lists
+// and marks them unread for their recipients. Both writes are idempotent:
+// conversations are written USING TIMESTAMP the newest message's time, so a
+// redelivered older message cannot move them back, and unread rows are keyed
+// by message ID. That makes them safe to retry, so failures are returned and
+// the records are retried or dead-lettered like any other.
+func (c *Consumer) updateConversations(msgs []*model.Message) error {
+	type pair struct{ user, other string }
+	latest := make(map[pair]time.Time)
+	unread := make(map[pair][]*model.Message)
+
+	for _, msg := range msgs {
+		u1, u2, ok := dmParticipants(msg.ChannelID)
+		if !ok {
+			continue
+		}
+		for _, p := range []pair{{u1, u2}, {u2, u1}} {
+			if msg.Timestamp.After(latest[p]) {
+				latest[p] = msg.Timestamp
+			}
+		}
+
+		// msg.UserID is the sender; the other user has an unread message.
+		recipient := u1
+		if u1 == msg.UserID {
+			recipient = u2
+		}
+		p := pair{recipient, msg.UserID}
+		unread[p] = append(unread[p], msg)
+	}
+
+	for p, ts := range latest {
+		q := `INSERT INTO user_conversations (user_id, other_user_id, last_updated) VALUES (?, ?, ?) USING TIMESTAMP ?`
+		if err := c.db.Query(q, p.user, p.other, ts, ts.UnixMicro()).Exec(); err != nil {
+			return fmt.Errorf("update conversation for %s: %w", p.user, err)
+		}
+	}
+	for p, msgs := range unread {
+		// One partition per conversation, so each batch is a single mutation.
+		// Unread markers of disappearing messages expire with them.
+		b := c.db.NewBatch(gocql.UnloggedBatch)
+		for _, msg := range msgs {
+			b.Query(`INSERT INTO unread_messages (user_id, other_user_id, message_id) VALUES (?, ?, ?) USING TTL ?`, p.user, p.other, msg.ID, ttlSeconds(msg))
+		}
+		if err := c.db.ExecuteBatch(b); err != nil {
+			return fmt.Errorf("mark %d messages unread for %s: %w", len(msgs), p.user, err)
+		}
+	}
+	return nil
+}
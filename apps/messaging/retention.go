@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/blob"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/pins"
+	"github.com/mahaj/networking-minor/pkg/retention"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Policies edited through the API apply to new messages within this long.
+	policyRefreshInterval = 30 * time.Second
+
+	// How often expired messages are announced, and how often messages older
+	// than their channel's retention are purged.
+	expiryInterval = 30 * time.Second
+	purgeInterval  = time.Hour
+
+	// Expiries are looked for this far back when the service starts, so
+	// ones that came due while it was down are still announced.
+	expiryLookback = 7 * 24 * time.Hour
+
+	// Message IDs removed from the search index per call while purging.
+	purgeChunkSize = 1000
+)
+
+// policyCache holds the retention policies, reloaded periodically so the
+// consumer does not read them for every message.
+type policyCache struct {
+	db       *db.Session
+	mu       sync.RWMutex
+	policies retention.Policies
+}
+
+func newPolicyCache(session *db.Session) *policyCache {
+	return &policyCache{db: session}
+}
+
+func (pc *policyCache) load() error {
+	policies, err := retention.LoadAll(pc.db)
+	if err != nil {
+		return err
+	}
+	pc.mu.Lock()
+	pc.policies = policies
+	pc.mu.Unlock()
+	return nil
+}
+
+// Run reloads the policies until ctx is done.
+func (pc *policyCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(policyRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pc.load(); err != nil {
+				log.Printf("Failed to reload retention policies: %v", err)
+			}
+		}
+	}
+}
+
+func (pc *policyCache) For(channelID string) retention.Policy {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	return pc.policies.For(channelID)
+}
+
+// expire sets when a new message expires under its channel's policy. The
+// time counts from when the message was sent, so a redelivered message
+// expires at the same time. It returns false for a message that has already
+// expired and must not be stored.
+func (pc *policyCache) expire(msg *model.Message) bool {
+	ttl := pc.For(msg.ChannelID).TTL()
+	if ttl == 0 {
+		return true
+	}
+	expiresAt := msg.Timestamp.Add(ttl)
+	msg.ExpiresAt = &expiresAt
+	return ttlSeconds(msg) > 0
+}
+
+// ttlSeconds is the TTL to store a message's rows with; 0 means none.
+func ttlSeconds(msg *model.Message) int {
+	if msg.ExpiresAt == nil {
+		return 0
+	}
+	return max(0, int(math.Ceil(time.Until(*msg.ExpiresAt).Seconds())))
+}
+
+func expiryHour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+// scheduleExpiries records when messages expire so the expiry worker can
+// announce it. It runs before the messages are stored: a schedule without
+// its message is harmless, a message without its schedule would never be
+// removed from the search index.
+func (c *Consumer) scheduleExpiries(msgs []*model.Message) error {
+	batches := make(map[time.Time]*gocql.Batch)
+	for _, msg := range msgs {
+		if msg.ExpiresAt == nil {
+			continue
+		}
+		hour := expiryHour(*msg.ExpiresAt)
+		b, ok := batches[hour]
+		if !ok {
+			b = c.db.NewBatch(gocql.UnloggedBatch)
+			batches[hour] = b
+		}
+		// The message is gone by the time it expires, so its attachments
+		// are recorded here to be deleted with it.
+		var attachmentIDs []string
+		for _, a := range msg.Attachments {
+			if a.ID != "" {
+				attachmentIDs = append(attachmentIDs, a.ID)
+			}
+		}
+		b.Query(`INSERT INTO message_expiries (hour, expires_at, channel_id, message_id, attachment_ids) VALUES (?, ?, ?, ?, ?)`, hour, *msg.ExpiresAt, msg.ChannelID, msg.ID, attachmentIDs)
+	}
+	for _, b := range batches {
+		if err := c.db.ExecuteBatch(b); err != nil {
+			return fmt.Errorf("schedule expiry: %w", err)
+		}
+	}
+	return nil
+}
+
+// ExpiryWorker tells clients about messages removed by retention policies,
+// removes them from the search index and deletes their attachments.
+// Messages stored since a policy was set expire through their TTL; older
+// ones are purged by retention.
+type ExpiryWorker struct {
+	db       *db.Session
+	policies *policyCache
+	indexer  *Indexer
+	store    blob.Store
+	producer *kafka.Writer
+
+	// Oldest hour that may still hold scheduled expiries.
+	oldest time.Time
+}
+
+func NewExpiryWorker(brokers []string, topic string, session *db.Session, policies *policyCache, indexer *Indexer, store blob.Store) *ExpiryWorker {
+	return &ExpiryWorker{
+		db:       session,
+		policies: policies,
+		indexer:  indexer,
+		store:    store,
+		producer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		},
+		oldest: expiryHour(time.Now().Add(-expiryLookback)),
+	}
+}
+
+// Run announces expiries and purges old messages until ctx is done.
+func (w *ExpiryWorker) Run(ctx context.Context) {
+	expiries := time.NewTicker(expiryInterval)
+	defer expiries.Stop()
+	purges := time.NewTicker(purgeInterval)
+	defer purges.Stop()
+
+	w.purge(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-expiries.C:
+			w.expireDue(ctx)
+		case <-purges.C:
+			w.purge(ctx)
+		}
+	}
+}
+
+type expiry struct {
+	expiresAt     time.Time
+	channelID     string
+	messageID     int64
+	attachmentIDs []string
+}
+
+// expireDue handles every scheduled expiry that has come due.
+func (w *ExpiryWorker) expireDue(ctx context.Context) {
+	now := time.Now()
+	for hour := w.oldest; !hour.After(now); hour = hour.Add(time.Hour) {
+		var due []expiry
+		var e expiry
+		iter := w.db.Query(`SELECT expires_at, channel_id, message_id, attachment_ids FROM message_expiries WHERE hour = ? AND expires_at <= ?`, hour, now).Iter()
+		for iter.Scan(&e.expiresAt, &e.channelID, &e.messageID, &e.attachmentIDs) {
+			due = append(due, e)
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("Failed to load expiries for %s: %v", hour.Format(time.RFC3339), err)
+			return
+		}
+		if len(due) > 0 {
+			if err := w.expire(ctx, hour, due); err != nil {
+				log.Printf("Failed to expire %d messages: %v", len(due), err)
+				return
+			}
+		}
+		// Hours that are over hold nothing else.
+		if hour.Add(time.Hour).Before(now) {
+			w.oldest = hour.Add(time.Hour)
+		}
+	}
+}
+
+// expire announces expired messages, unindexes them, deletes their
+// attachments, unpins them and clears their unread markers, then deletes
+// their schedule.
+// The messages themselves are already gone through their TTL.
+func (w *ExpiryWorker) expire(ctx context.Context, hour time.Time, due []expiry) error {
+	events := make([]kafka.Message, len(due))
+	ids := make([]int64, len(due))
+	var attachmentIDs []string
+	for i, e := range due {
+		events[i] = expireEvent(e.channelID, e.messageID, "")
+		ids[i] = e.messageID
+		attachmentIDs = append(attachmentIDs, e.attachmentIDs...)
+	}
+	if err := w.producer.WriteMessages(ctx, events...); err != nil {
+		return fmt.Errorf("publish expiry events: %w", err)
+	}
+	w.indexer.Remove(ids...)
+	if err := w.deleteAttachments(ctx, attachmentIDs); err != nil {
+		return err
+	}
+
+	expired := make(map[string]map[int64]bool)
+	for _, e := range due {
+		if expired[e.channelID] == nil {
+			expired[e.channelID] = make(map[int64]bool)
+		}
+		expired[e.channelID][e.messageID] = true
+	}
+	for channelID, ids := range expired {
+		w.unpin(channelID, func(id int64) bool { return ids[id] })
+	}
+
+	b := w.db.NewBatch(gocql.UnloggedBatch)
+	for _, e := range due {
+		if u1, u2, ok := dmParticipants(e.channelID); ok {
+			for _, p := range [][2]string{{u1, u2}, {u2, u1}} {
+				if err := w.db.Query(`DELETE FROM unread_messages WHERE user_id = ? AND other_user_id = ? AND message_id = ?`, p[0], p[1], e.messageID).Exec(); err != nil {
+					log.Printf("Failed to clear unread message %d: %v", e.messageID, err)
+				}
+			}
+		}
+		b.Query(`DELETE FROM message_expiries WHERE hour = ? AND expires_at = ? AND channel_id = ? AND message_id = ?`, hour, e.expiresAt, e.channelID, e.messageID)
+	}
+	if err := w.db.ExecuteBatch(b); err != nil {
+		return fmt.Errorf("delete expiry schedule: %w", err)
+	}
+	log.Printf("Expired %d messages", len(due))
+	return nil
+}
+
+// purge deletes messages older than their channel's retention. These are
+// messages stored before the policy was set or shortened; newer ones carry
+// a TTL.
+func (w *ExpiryWorker) purge(ctx context.Context) {
+	if err := w.policies.load(); err != nil {
+		log.Printf("Failed to load retention policies: %v", err)
+		return
+	}
+
+	iter := w.db.Query(`SELECT DISTINCT channel_id FROM messages`).Iter()
+	var channelID string
+	for iter.Scan(&channelID) {
+		if ctx.Err() != nil {
+			break
+		}
+		keep := w.policies.For(channelID).Retention()
+		if keep == 0 {
+			continue
+		}
+		if err := w.purgeChannel(ctx, channelID, snowflake.MinID(time.Now().Add(-keep))); err != nil {
+			log.Printf("Failed to purge %s: %v", channelID, err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list channels to purge: %v", err)
+	}
+}
+
+// purgeChannel deletes a channel's messages with IDs below cutoff, their
+// attachments and their pins.
+func (w *ExpiryWorker) purgeChannel(ctx context.Context, channelID string, cutoff int64) error {
+	var ids []int64
+	var attachmentIDs []string
+	var newest, id int64
+	var attachments string
+	iter := w.db.Query(`SELECT id, attachments FROM messages WHERE channel_id = ? AND id < ?`, channelID, cutoff).Iter()
+	for iter.Scan(&id, &attachments) {
+		newest = max(newest, id)
+		ids = append(ids, id)
+		if len(ids) == purgeChunkSize {
+			w.indexer.Remove(ids...)
+			ids = ids[:0]
+		}
+		if attachments == "" {
+			continue
+		}
+		var list []model.Attachment
+		if err := json.Unmarshal([]byte(attachments), &list); err != nil {
+			log.Printf("Invalid attachments on message %d: %v", id, err)
+			continue
+		}
+		for _, a := range list {
+			if a.ID != "" {
+				attachmentIDs = append(attachmentIDs, a.ID)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if newest == 0 {
+		return nil
+	}
+	w.indexer.Remove(ids...)
+	// Before the messages, so a failure leaves them to find next time
+	if err := w.deleteAttachments(ctx, attachmentIDs); err != nil {
+		return err
+	}
+
+	if err := w.db.Query(`DELETE FROM messages WHERE channel_id = ? AND id < ?`, channelID, cutoff).Exec(); err != nil {
+		return err
+	}
+	w.unpin(channelID, func(id int64) bool { return id < cutoff })
+	if u1, u2, ok := dmParticipants(channelID); ok {
+		for _, p := range [][2]string{{u1, u2}, {u2, u1}} {
+			if err := w.db.Query(`DELETE FROM unread_messages WHERE user_id = ? AND other_user_id = ? AND message_id < ?`, p[0], p[1], cutoff).Exec(); err != nil {
+				log.Printf("Failed to clear unread messages of %s: %v", channelID, err)
+			}
+		}
+	}
+
+	if err := w.producer.WriteMessages(ctx, expireEvent(channelID, newest, model.ExpireBefore)); err != nil {
+		log.Printf("Failed to announce purge of %s: %v", channelID, err)
+	}
+	log.Printf("Purged messages of %s up to %d", channelID, newest)
+	return nil
+}
+
+// unpin unpins the channel's removed messages, so they stop taking up its
+// pins. The API unpins any it finds first when listing pins.
+func (w *ExpiryWorker) unpin(channelID string, removed func(id int64) bool) {
+	var ids []int64
+	var id int64
+	iter := w.db.Query(`SELECT message_id FROM channel_pins WHERE channel_id = ?`, channelID).Iter()
+	for iter.Scan(&id) {
+		if removed(id) {
+			ids = append(ids, id)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to load pins of %s: %v", channelID, err)
+		return
+	}
+	for _, id := range ids {
+		if _, err := pins.Remove(w.db, channelID, id); err != nil {
+			log.Printf("Failed to unpin removed message %d: %v", id, err)
+		}
+	}
+}
+
+// deleteAttachments deletes the files and rows of attachments of removed
+// messages. Cards have no ID and nothing to delete.
+func (w *ExpiryWorker) deleteAttachments(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		for _, key := range []string{blob.OriginalKey(id), blob.ThumbnailKey(id)} {
+			if err := w.store.Delete(ctx, key); err != nil {
+				return fmt.Errorf("delete attachment %s: %w", id, err)
+			}
+		}
+		if err := w.db.Query(`DELETE FROM attachments WHERE attachment_id = ?`, id).Exec(); err != nil {
+			return fmt.Errorf("delete attachment %s: %w", id, err)
+		}
+	}
+	if len(ids) > 0 {
+		log.Printf("Deleted %d attachments of removed messages", len(ids))
+	}
+	return nil
+}
+
+func (w *ExpiryWorker) Close() error {
+	return w.producer.Close()
+}
+
+func expireEvent(channelID string, messageID int64, content string) kafka.Message {
+	payload, _ := json.Marshal(model.Message{
+		ChannelID: channelID,
+		Type:      model.TypeExpire,
+		TargetID:  messageID,
+		Content:   content,
+		Timestamp: time.Now(),
+	})
+	return kafka.Message{Key: []byte(channelID), Value: payload}
+}
+
+func dmParticipants(channelID string) (u1, u2 string, ok bool) {
+	parts := strings.Split(channelID, ":")
+	if len(parts) != 3 || parts[0] != "dm" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
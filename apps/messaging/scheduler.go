@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/schedule"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// How often the queue is checked for due schedules.
+	schedulerInterval = 5 * time.Second
+
+	// A schedule claimed this long ago without being sent is claimed again;
+	// the replica sending it has probably stopped.
+	claimTimeout = 2 * time.Minute
+
+	// The scheduler resumes from its watermark. Without one it looks back
+	// this far for due schedules.
+	schedulerLookback  = 24 * time.Hour
+	schedulerWatermark = "schedule_queue"
+
+	// A schedule that fails to send is queued again after as long as it is
+	// already late, between these bounds, so it cannot hold the scan back.
+	minSendRetry = time.Minute
+	maxSendRetry = time.Hour
+)
+
+// Scheduler sends scheduled messages and reminders when they come due, by
+// publishing them to chat-messages like any other message. Every replica of
+// the service runs one; a lightweight transaction decides which replica
+// sends each schedule.
+type Scheduler struct {
+	db       *db.Session
+	producer *kafka.Writer
+	ids      *snowflake.Node
+
+	// Oldest minute that may still hold due schedules.
+	oldest time.Time
+}
+
+// NewScheduler resumes from the minute the scheduler last got to, so
+// schedules that came due while the service was down are sent late rather
+// than never.
+func NewScheduler(brokers []string, topic string, session *db.Session, ids *snowflake.Node) *Scheduler {
+	oldest := loadWatermark(session, schedulerWatermark, schedule.Minute(time.Now().Add(-schedulerLookback)))
+	return &Scheduler{
+		db: session,
+		producer: &kafka.Writer{
+			Addr:     kafka.TCP(brokers...),
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		},
+		ids:    ids,
+		oldest: oldest,
+	}
+}
+
+// Run sends due schedules until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sendDue(ctx)
+		}
+	}
+}
+
+type queued struct {
+	sendAt     time.Time
+	userID     string
+	scheduleID string
+}
+
+// sendDue sends every queued schedule whose time has come. A minute is only
+// left behind once nothing in it is waiting any more; schedules that fail are
+// moved to a later minute.
+func (s *Scheduler) sendDue(ctx context.Context) {
+	now := time.Now()
+	defer func(start time.Time) {
+		if s.oldest.After(start) {
+			saveWatermark(s.db, schedulerWatermark, s.oldest)
+		}
+	}(s.oldest)
+	for minute := s.oldest; !minute.After(now); minute = minute.Add(time.Minute) {
+		var due []queued
+		var q queued
+		iter := s.db.Query(`SELECT send_at, user_id, schedule_id FROM schedule_queue WHERE minute = ? AND send_at <= ?`, minute, now).Iter()
+		for iter.Scan(&q.sendAt, &q.userID, &q.scheduleID) {
+			due = append(due, q)
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("Failed to load schedules due at %s: %v", minute.Format(time.RFC3339), err)
+			return
+		}
+
+		done := true
+		for _, q := range due {
+			ok, err := s.send(ctx, minute, q)
+			if err != nil {
+				log.Printf("Failed to send schedule %s of %s: %v", q.scheduleID, q.userID, err)
+				ok = s.postpone(minute, q, now) == nil
+			}
+			done = done && ok
+		}
+		if done && minute.Add(time.Minute).Before(now) && minute.Equal(s.oldest) {
+			s.oldest = minute.Add(time.Minute)
+		}
+	}
+}
+
+// send sends one queued schedule if it is still due and this replica wins
+// the claim. It returns true once the queue entry is gone.
+func (s *Scheduler) send(ctx context.Context, minute time.Time, q queued) (bool, error) {
+	sc, err := schedule.Get(s.db, q.userID, q.scheduleID)
+	if errors.Is(err, schedule.ErrNotFound) {
+		return true, s.dequeue(minute, q)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Sent, cancelled, or moved to another time since this entry was queued.
+	stale := sc.Status == schedule.StatusSent || sc.Status == schedule.StatusCancelled || !sc.SendAt.Equal(q.sendAt)
+	if stale {
+		return true, s.dequeue(minute, q)
+	}
+	// Another replica is sending it.
+	if sc.Status == schedule.StatusSending && sc.ClaimedAt != nil && time.Since(*sc.ClaimedAt) < claimTimeout {
+		return false, nil
+	}
+
+	now := time.Now()
+	claimed, err := schedule.Claim(s.db, sc, s.ids.Generate(), now)
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	msg := &model.Message{
+		ID:        sc.MessageID,
+		ChannelID: sc.ChannelID,
+		UserID:    sc.UserID,
+		Type:      model.TypeMessage,
+		Content:   sc.Content,
+		Timestamp: now,
+	}
+	if sc.Kind == schedule.KindReminder {
+		msg.ChannelID = model.UserChannel(sc.UserID)
+		msg.Type = model.TypeReminder
+		msg.TargetID = sc.TargetID
+		msg.TargetChannelID = sc.ChannelID
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	if err := s.producer.WriteMessages(ctx, kafka.Message{Key: []byte(msg.ChannelID), Value: payload}); err != nil {
+		return false, fmt.Errorf("publish: %w", err)
+	}
+
+	log.Printf("Sent %s %s of %s as message %d", sc.Kind, sc.ID, sc.UserID, sc.MessageID)
+	if err := schedule.MarkSent(s.db, sc, now); err != nil {
+		return false, fmt.Errorf("mark sent: %w", err)
+	}
+	return true, s.dequeue(minute, q)
+}
+
+// postpone moves a queue entry that failed to send to a later minute. The
+// entry keeps its send time, so it still matches the schedule.
+func (s *Scheduler) postpone(minute time.Time, q queued, now time.Time) error {
+	retry := min(max(now.Sub(q.sendAt), minSendRetry), maxSendRetry)
+	later := schedule.Minute(now.Add(retry))
+	err := s.db.Query(`INSERT INTO schedule_queue (minute, send_at, user_id, schedule_id) VALUES (?, ?, ?, ?)`,
+		later, q.sendAt, q.userID, q.scheduleID).Exec()
+	if err != nil {
+		log.Printf("Failed to postpone schedule %s of %s: %v", q.scheduleID, q.userID, err)
+		return err
+	}
+	return s.dequeue(minute, q)
+}
+
+func (s *Scheduler) dequeue(minute time.Time, q queued) error {
+	return s.db.Query(`DELETE FROM schedule_queue WHERE minute = ? AND send_at = ? AND user_id = ? AND schedule_id = ?`,
+		minute, q.sendAt, q.userID, q.scheduleID).Exec()
+}
+
+func (s *Scheduler) Close() error {
+	return s.producer.Close()
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// schema lists the tables the chat keyspace needs, in creation order.
+// Note: In production, schema creation should be handled by migration tools
+var schema = []struct {
+	name string
+	cql  string
+}{
+	{"messages", `CREATE TABLE IF NOT EXISTS messages (
+		channel_id text,
+		id bigint,
+		user_id text,
+		content text,
+		timestamp timestamp,
+		PRIMARY KEY (channel_id, id)
+	) WITH CLUSTERING ORDER BY (id DESC)`},
+
+	{"user_conversations", `CREATE TABLE IF NOT EXISTS user_conversations (
+		user_id text,
+		other_user_id text,
+		last_updated timestamp,
+		PRIMARY KEY (user_id, other_user_id)
+	)`},
+
+	// One row per DM its recipient has not read. Rows are keyed by message
+	// ID, so storing a redelivered message again changes nothing.
+	{"unread_messages", `CREATE TABLE IF NOT EXISTS unread_messages (
+		user_id text,
+		other_user_id text,
+		message_id bigint,
+		PRIMARY KEY ((user_id, other_user_id), message_id)
+	) WITH CLUSTERING ORDER BY (message_id DESC)`},
+
+	// The last message a user has read in each DM. Only messages after it
+	// count as unread. Cursors are written USING TIMESTAMP the message ID, so
+	// they only move forward.
+	{"conversation_reads", `CREATE TABLE IF NOT EXISTS conversation_reads (
+		user_id text,
+		other_user_id text,
+		last_read_id bigint,
+		PRIMARY KEY (user_id, other_user_id)
+	)`},
+
+	// Retention policies by channel; "*" holds the workspace default.
+	{"retention_policies", `CREATE TABLE IF NOT EXISTS retention_policies (
+		channel_id text PRIMARY KEY,
+		retention_days int,
+		disappear_seconds int,
+		updated_by text,
+		updated_at timestamp
+	)`},
+
+	// Messages stored with a TTL, by the hour they expire in. The expiry
+	// worker announces and unindexes them, then deletes the rows.
+	{"message_expiries", `CREATE TABLE IF NOT EXISTS message_expiries (
+		hour timestamp,
+		expires_at timestamp,
+		channel_id text,
+		message_id bigint,
+		PRIMARY KEY (hour, expires_at, channel_id, message_id)
+	)`},
+
+	// Messages to send later and reminders, by owner. See pkg/schedule.
+	{"scheduled_messages", `CREATE TABLE IF NOT EXISTS scheduled_messages (
+		user_id text,
+		schedule_id text,
+		kind text,
+		channel_id text,
+		content text,
+		target_id bigint,
+		send_at timestamp,
+		status text,
+		created_at timestamp,
+		message_id bigint,
+		claimed_at timestamp,
+		sent_at timestamp,
+		PRIMARY KEY (user_id, schedule_id)
+	)`},
+
+	// Schedules by the minute they are due.
+	{"schedule_queue", `CREATE TABLE IF NOT EXISTS schedule_queue (
+		minute timestamp,
+		send_at timestamp,
+		user_id text,
+		schedule_id text,
+		PRIMARY KEY (minute, send_at, user_id, schedule_id)
+	)`},
+
+	// Pinned messages of each channel.
+	{"channel_pins", `CREATE TABLE IF NOT EXISTS channel_pins (
+		channel_id text,
+		message_id bigint,
+		pinned_by text,
+		pinned_at timestamp,
+		PRIMARY KEY (channel_id, message_id)
+	) WITH CLUSTERING ORDER BY (message_id DESC)`},
+
+	// Number of pinned messages of each channel, changed with lightweight
+	// transactions so concurrent pins cannot exceed the cap.
+	{"channel_pin_counts", `CREATE TABLE IF NOT EXISTS channel_pin_counts (
+		channel_id text PRIMARY KEY,
+		pins int
+	)`},
+
+	// Messages users saved for later, across channels.
+	{"saved_messages", `CREATE TABLE IF NOT EXISTS saved_messages (
+		user_id text,
+		channel_id text,
+		message_id bigint,
+		saved_at timestamp,
+		PRIMARY KEY (user_id, channel_id, message_id)
+	)`},
+
+	// Messages that mention each user, newest first. Rows expire with
+	// their message.
+	{"mentions", `CREATE TABLE IF NOT EXISTS mentions (
+		user_id text,
+		message_id bigint,
+		channel_id text,
+		author_id text,
+		PRIMARY KEY (user_id, message_id)
+	) WITH CLUSTERING ORDER BY (message_id DESC)`},
+
+	// Users who have posted in each channel; @channel notifies them.
+	{"channel_members", `CREATE TABLE IF NOT EXISTS channel_members (
+		channel_id text,
+		user_id text,
+		last_posted_at timestamp,
+		PRIMARY KEY (channel_id, user_id)
+	)`},
+
+	// Devices that receive push notifications, registered through the API.
+	{"devices", `CREATE TABLE IF NOT EXISTS devices (
+		user_id text,
+		device_id text,
+		provider text,
+		token text,
+		created_at timestamp,
+		PRIMARY KEY (user_id, device_id)
+	)`},
+
+	// E-mail digest settings of users who asked for digests.
+	{"email_digests", `CREATE TABLE IF NOT EXISTS email_digests (
+		user_id text,
+		email text,
+		frequency text,
+		last_sent_at timestamp,
+		PRIMARY KEY (user_id)
+	)`},
+
+	// Notification preferences: a row per channel a user changed from the
+	// defaults, and their do-not-disturb schedule as JSON.
+	{"notification_prefs", `CREATE TABLE IF NOT EXISTS notification_prefs (
+		user_id text,
+		channel_id text,
+		level text,
+		muted boolean,
+		muted_until timestamp,
+		dnd text static,
+		PRIMARY KEY (user_id, channel_id)
+	)`},
+
+	// Users whose notification level for a channel is all.
+	{"channel_notify_all", `CREATE TABLE IF NOT EXISTS channel_notify_all (
+		channel_id text,
+		user_id text,
+		PRIMARY KEY (channel_id, user_id)
+	)`},
+
+	// Accounts. Usernames double as user IDs, so the primary key is what
+	// makes them unique.
+	{"users", `CREATE TABLE IF NOT EXISTS users (
+		user_id text,
+		password_hash text,
+		created_at timestamp,
+		password_changed_at timestamp,
+		failed_attempts int,
+		locked_until timestamp,
+		PRIMARY KEY (user_id)
+	)`},
+
+	// Links external OpenID Connect subjects to chat users.
+	{"oidc_identities", `CREATE TABLE IF NOT EXISTS oidc_identities (
+		issuer text,
+		subject text,
+		user_id text,
+		email text,
+		created_at timestamp,
+		PRIMARY KEY ((issuer, subject))
+	)`},
+
+	// Rows expire with the token (USING TTL on insert).
+	{"password_resets", `CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash text,
+		user_id text,
+		PRIMARY KEY (token_hash)
+	)`},
+
+	// API keys of bot accounts. Only the hash of the secret is stored; Redis
+	// holds a copy of live keys for the gateway.
+	{"api_keys", `CREATE TABLE IF NOT EXISTS api_keys (
+		key_id text,
+		bot_id text,
+		owner_id text,
+		name text,
+		secret_hash text,
+		scopes set<text>,
+		channels set<text>,
+		created_at timestamp,
+		revoked_at timestamp,
+		PRIMARY KEY (key_id)
+	)`},
+
+	{"api_keys_by_owner", `CREATE TABLE IF NOT EXISTS api_keys_by_owner (
+		owner_id text,
+		key_id text,
+		PRIMARY KEY (owner_id, key_id)
+	)`},
+
+	// Incoming webhooks. The token is part of the webhook URL; only its hash
+	// is stored.
+	{"incoming_webhooks", `CREATE TABLE IF NOT EXISTS incoming_webhooks (
+		webhook_id text,
+		channel_id text,
+		token_hash text,
+		name text,
+		created_by text,
+		created_at timestamp,
+		PRIMARY KEY (webhook_id)
+	)`},
+
+	{"incoming_webhooks_by_channel", `CREATE TABLE IF NOT EXISTS incoming_webhooks_by_channel (
+		channel_id text,
+		webhook_id text,
+		PRIMARY KEY (channel_id, webhook_id)
+	)`},
+
+	// Outgoing webhooks. The secret signs deliveries, so it is stored as is.
+	{"channel_webhooks", `CREATE TABLE IF NOT EXISTS channel_webhooks (
+		channel_id text,
+		webhook_id text,
+		url text,
+		secret text,
+		events set<text>,
+		created_by text,
+		created_at timestamp,
+		PRIMARY KEY (channel_id, webhook_id)
+	)`},
+
+	// One row per delivery attempt, kept for a week.
+	{"webhook_deliveries", `CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		webhook_id text,
+		attempt_id timeuuid,
+		delivery_id text,
+		event text,
+		attempt int,
+		status_code int,
+		error text,
+		duration_ms int,
+		PRIMARY KEY (webhook_id, attempt_id)
+	) WITH CLUSTERING ORDER BY (attempt_id DESC) AND default_time_to_live = 604800`},
+
+	// Deliveries that failed every attempt.
+	{"webhook_dead_letters", `CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		webhook_id text,
+		failed_id timeuuid,
+		delivery_id text,
+		event text,
+		payload text,
+		attempts int,
+		last_error text,
+		PRIMARY KEY (webhook_id, failed_id)
+	) WITH CLUSTERING ORDER BY (failed_id DESC)`},
+
+	// Failed deliveries waiting for another attempt, by the minute they are
+	// due.
+	{"webhook_retries", `CREATE TABLE IF NOT EXISTS webhook_retries (
+		minute timestamp,
+		due_at timestamp,
+		delivery_id text,
+		webhook_id text,
+		channel_id text,
+		event text,
+		payload text,
+		attempt int,
+		PRIMARY KEY (minute, due_at, delivery_id)
+	)`},
+
+	// Retries used to expire after a day, which lost them in longer outages
+	// instead of dead-lettering them.
+	{"webhook_retries", `ALTER TABLE webhook_retries WITH default_time_to_live = 0`},
+
+	// How far a queue partitioned by minute has been worked through:
+	// everything before at is done.
+	{"watermarks", `CREATE TABLE IF NOT EXISTS watermarks (
+		name text PRIMARY KEY,
+		at timestamp
+	)`},
+
+	// Uploaded files; the data itself is in the blob store.
+	{"attachments", `CREATE TABLE IF NOT EXISTS attachments (
+		attachment_id text PRIMARY KEY,
+		channel_id text,
+		uploader_id text,
+		name text,
+		content_type text,
+		size bigint,
+		width int,
+		height int,
+		thumbnail boolean,
+		created_at timestamp
+	)`},
+}
+
+// columns lists columns added to tables after they were first released.
+// CREATE TABLE IF NOT EXISTS leaves existing tables alone, so they are added
+// separately.
+var columns = []struct {
+	table   string
+	name    string
+	cqlType string
+}{
+	{"users", "is_bot", "boolean"},
+	{"users", "owner_id", "text"},
+	{"messages", "edited_at", "timestamp"},
+	{"messages", "display_name", "text"},
+	// JSON list of model.Attachment
+	{"messages", "attachments", "text"},
+	// JSON list of model.Mention
+	{"messages", "mentions", "text"},
+	{"messages", "bot", "boolean"},
+	{"message_expiries", "attachment_ids", "list<text>"},
+	{"email_digests", "confirmed_email", "text"},
+	{"email_digests", "confirmation_sent_at", "timestamp"},
+}
+
+// migrate creates every table in schema and adds every column in columns
+// that does not exist yet.
+func migrate(session *db.Session, keyspace string) error {
+	for _, t := range schema {
+		if err := session.Query(t.cql).Exec(); err != nil {
+			return fmt.Errorf("failed to create %s table: %w", t.name, err)
+		}
+	}
+
+	for _, c := range columns {
+		var name string
+		err := session.Query(`SELECT column_name FROM system_schema.columns WHERE keyspace_name = ? AND table_name = ? AND column_name = ?`,
+			keyspace, c.table, c.name).Scan(&name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, gocql.ErrNotFound) {
+			return fmt.Errorf("failed to inspect %s table: %w", c.table, err)
+		}
+		if err := session.Query(fmt.Sprintf("ALTER TABLE %s ADD %s %s", c.table, c.name, c.cqlType)).Exec(); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", c.table, c.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/search"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Messages are indexed in batches of up to indexBatchSize, at least
+	// every indexFlushInterval.
+	indexBatchSize     = 500
+	indexFlushInterval = time.Second
+
+	// Rows written per batch when rebuilding the index.
+	reindexBatchSize = 1000
+)
+
+// Indexer adds messages to the search index and answers searches for the
+// API. It reads chat-messages on a consumer group of its own, so indexing
+// never slows down persistence, and commits offsets only once a batch is in
+// the index, so a crash replays it instead of losing it.
+//
+// New messages are indexed from the topic and edits from the TypeEdited
+// events the consumer announces once it has applied them.
+type Indexer struct {
+	index    *search.Index
+	reader   *kafka.Reader
+	db       *db.Session
+	policies *policyCache
+	secret   []byte
+}
+
+func NewIndexer(brokers []string, topic, groupID string, session *db.Session, index *search.Index, policies *policyCache, secret string) *Indexer {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  brokers,
+		Topic:    topic,
+		GroupID:  groupID,
+		MinBytes: 10e3,
+		MaxBytes: 10e6,
+	})
+	return &Indexer{index: index, reader: r, db: session, policies: policies, secret: []byte(secret)}
+}
+
+// Remove deletes messages from the index, e.g. once they expire. A nil
+// Indexer, as used by benchmarks, does nothing.
+func (x *Indexer) Remove(ids ...int64) {
+	if x == nil || len(ids) == 0 {
+		return
+	}
+	if err := x.index.Delete(ids...); err != nil {
+		log.Printf("Failed to remove %d messages from the index: %v", len(ids), err)
+	}
+}
+
+// Run indexes records in batches until ctx is done. A batch that fails is
+// retried until it succeeds.
+func (x *Indexer) Run(ctx context.Context) {
+	var batch []kafka.Message
+	for ctx.Err() == nil {
+		batch = x.fetch(ctx, batch[:0])
+		if len(batch) == 0 {
+			continue
+		}
+
+		backoff := retryBaseBackoff
+		for {
+			err := x.add(batch)
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to index %d records: %v. Retrying in %s...", len(batch), err, backoff)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, retryMaxBackoff)
+		}
+		if err := x.reader.CommitMessages(ctx, batch...); err != nil && ctx.Err() == nil {
+			log.Printf("Indexer failed to commit %d records: %v", len(batch), err)
+		}
+	}
+}
+
+// fetch collects up to indexBatchSize records, waiting at most
+// indexFlushInterval once the first has arrived.
+func (x *Indexer) fetch(ctx context.Context, batch []kafka.Message) []kafka.Message {
+	m, err := x.reader.FetchMessage(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Indexer error reading message: %v. Retrying in 1s...", err)
+			sleep(ctx, time.Second)
+		}
+		return batch
+	}
+	batch = append(batch, m)
+
+	linger, cancel := context.WithTimeout(ctx, indexFlushInterval)
+	defer cancel()
+	for len(batch) < indexBatchSize {
+		m, err := x.reader.FetchMessage(linger)
+		if err != nil {
+			break
+		}
+		batch = append(batch, m)
+	}
+	return batch
+}
+
+// add indexes the messages and applied edits among records. Messages that
+// have expired, or that retention has purged, are left out: the expiry
+// worker may already have removed them.
+func (x *Indexer) add(records []kafka.Message) error {
+	var msgs []*model.Message
+	for _, m := range records {
+		msg := new(model.Message)
+		if err := json.Unmarshal(m.Value, msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case model.TypeMessage:
+		case model.TypeEdited:
+			stored, err := x.stored(msg.ChannelID, msg.TargetID)
+			if err != nil {
+				return err
+			}
+			if stored == nil {
+				continue
+			}
+			msg = stored
+		default:
+			continue
+		}
+		if keep := x.policies.For(msg.ChannelID).Retention(); keep > 0 && time.Since(msg.Timestamp) > keep {
+			continue
+		}
+		if !x.policies.expire(msg) {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return x.index.Add(msgs...)
+}
+
+// stored loads the current version of a message, nil if it is gone.
+func (x *Indexer) stored(channelID string, id int64) (*model.Message, error) {
+	msg := &model.Message{ID: id, ChannelID: channelID, Type: model.TypeMessage}
+	err := x.db.Query(`SELECT user_id, content, timestamp, display_name FROM messages WHERE channel_id = ? AND id = ?`, channelID, id).
+		Scan(&msg.UserID, &msg.Content, &msg.Timestamp, &msg.DisplayName)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (x *Indexer) Close() error {
+	return x.reader.Close()
+}
+
+// ServeHTTP answers POST /internal/search with a search.Query body. The
+// reader in the query is trusted, so callers must present the shared
+// secret, which only the API has.
+func (x *Indexer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(search.SecretHeader)), x.secret) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	var q search.Query
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	res, err := x.index.Search(r.Context(), &q)
+	if errors.Is(err, search.ErrEmptyQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Search failed: %v", err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// reindex rebuilds the index at path from every message in Scylla.
+func reindex(session *db.Session, path string) error {
+	index, err := search.Create(path)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	iter := session.Query(`SELECT channel_id, id, user_id, content, timestamp, display_name FROM messages`).
+		PageSize(reindexBatchSize).Iter()
+
+	var batch []*model.Message
+	var total int
+	for {
+		msg := &model.Message{Type: model.TypeMessage}
+		if !iter.Scan(&msg.ChannelID, &msg.ID, &msg.UserID, &msg.Content, &msg.Timestamp, &msg.DisplayName) {
+			break
+		}
+		batch = append(batch, msg)
+		if len(batch) == reindexBatchSize {
+			if err := index.Add(batch...); err != nil {
+				iter.Close()
+				return err
+			}
+			total += len(batch)
+			batch = batch[:0]
+			log.Printf("Indexed %d messages...", total)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	if err := index.Add(batch...); err != nil {
+		return err
+	}
+	total += len(batch)
+	log.Printf("Reindexed %d messages into %s", total, path)
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/mahaj/networking-minor/pkg/unread"
+	"github.com/segmentio/kafka-go"
+)
+
+// TestUnreadReplay checks that redelivered DMs, as after a consumer restart
+// or rebalance, do not change unread counts, before or after the recipient
+// reads them. Counts and reads go through pkg/unread, as the API does. It needs Scylla (SCYLLA_HOSTS, default localhost:9042) and is
+// skipped without it.
+func TestUnreadReplay(t *testing.T) {
+	session := benchSession(t)
+	c := &Consumer{db: session, policies: newPolicyCache(session), groupID: "messaging-test"}
+	ctx := context.Background()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	// A node the services never lease, so IDs cannot collide with real ones.
+	ids, err := snowflake.NewNode(1023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sender, recipient = "unread-a", "unread-b"
+	channelID := "dm:" + sender + ":" + recipient
+	var offset int64
+	send := func() kafka.Message {
+		payload, _ := json.Marshal(model.Message{
+			ID:        ids.Generate(),
+			ChannelID: channelID,
+			UserID:    sender,
+			Type:      model.TypeMessage,
+			Content:   "unread replay check",
+			Timestamp: time.Now(),
+		})
+		offset++
+		return kafka.Message{Topic: "chat-messages", Offset: offset, Key: []byte(channelID), Value: payload}
+	}
+	store := func(records []kafka.Message) {
+		p := c.newPipeline(func(context.Context, ...kafka.Message) error { return nil })
+		for _, m := range records {
+			p.dispatch(ctx, m)
+		}
+		p.close()
+	}
+	expect := func(want int64) {
+		t.Helper()
+		got, err := unread.Count(session, recipient, sender)
+		if err != nil {
+			t.Fatalf("Failed to count unread messages: %v", err)
+		}
+		if got != want {
+			t.Fatalf("%d unread messages, want %d", got, want)
+		}
+	}
+
+	const n = 20
+	var records []kafka.Message
+	for i := 0; i < n; i++ {
+		records = append(records, send())
+	}
+	store(records)
+	expect(n)
+
+	// Redeliver everything, along with one new message.
+	records = append(records, send())
+	store(records)
+	expect(n + 1)
+
+	// Reading resets the count; redelivering messages already read must not
+	// bring them back.
+	if err := unread.Read(session, recipient, sender, 0); err != nil {
+		t.Fatalf("Failed to read the conversation: %v", err)
+	}
+	expect(0)
+	store(append(records, send()))
+	expect(1)
+}
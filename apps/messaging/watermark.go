@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// loadWatermark returns how far a time-partitioned queue has been worked
+// through, or fallback if it never was.
+func loadWatermark(session *db.Session, name string, fallback time.Time) time.Time {
+	var at time.Time
+	err := session.Query(`SELECT at FROM watermarks WHERE name = ?`, name).Scan(&at)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return fallback
+	}
+	if err != nil {
+		log.Printf("Failed to load the %s watermark, starting from %s: %v", name, fallback.Format(time.RFC3339), err)
+		return fallback
+	}
+	return at
+}
+
+// saveWatermark records that everything before at is done. It is written
+// USING TIMESTAMP at, so a replica that is further behind cannot move it
+// back.
+func saveWatermark(session *db.Session, name string, at time.Time) {
+	err := session.Query(`INSERT INTO watermarks (name, at) VALUES (?, ?) USING TIMESTAMP ?`, name, at, at.UnixMicro()).Exec()
+	if err != nil {
+		log.Printf("Failed to save the %s watermark: %v", name, err)
+	}
+}
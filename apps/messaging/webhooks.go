@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/netguard"
+	"github.com/mahaj/networking-minor/pkg/webhook"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Consumer group of the webhook worker. It is separate from persistence
+	// so a slow endpoint never holds up storing messages.
+	webhookGroupID = "webhook-delivery-group"
+
+	webhookWorkers   = 8
+	webhookQueueSize = 1024
+	webhookTimeout   = 10 * time.Second
+
+	// Attempts before a delivery is dead-lettered. Waits between attempts
+	// double from webhookBaseBackoff: 1s, 2s, 4s, 8s, 16s.
+	webhookMaxAttempts = 6
+	webhookBaseBackoff = time.Second
+
+	// How long a channel's webhook list is cached. New or deleted webhooks
+	// take effect within this time.
+	webhookCacheTTL = 30 * time.Second
+
+	// How often webhook_retries is checked for retries nobody picked up,
+	// because the replica that scheduled them stopped. A retry is left to
+	// its own replica's timer until it is webhookRetryGrace overdue.
+	webhookRetryInterval = 15 * time.Second
+	webhookRetryGrace    = 10 * time.Second
+
+	// Recovery resumes from its watermark. Without one it looks back this
+	// far, as long as retries used to be kept.
+	webhookRetryLookback  = 24 * time.Hour
+	webhookRetryWatermark = "webhook_retries"
+)
+
+type webhookTarget struct {
+	id     string
+	url    string
+	secret string
+	events map[string]bool
+}
+
+type cachedWebhooks struct {
+	targets   []*webhookTarget
+	fetchedAt time.Time
+}
+
+// webhookDelivery is one event on its way to one webhook.
+type webhookDelivery struct {
+	target    *webhookTarget
+	channelID string
+	id        string
+	event     string
+	body      []byte
+	attempt   int
+}
+
+// WebhookWorker delivers channel events from chat-messages to the channel's
+// webhooks. Failed deliveries are retried with exponential backoff, every
+// attempt is logged, and deliveries that never succeed are dead-lettered.
+// Every pending attempt, the first included, is stored in webhook_retries
+// before the record's offset is committed, so it survives a restart; a
+// lightweight transaction decides which replica makes each one.
+//
+// Webhook URLs are user-supplied, so deliveries only ever connect to public
+// addresses.
+type WebhookWorker struct {
+	reader *kafka.Reader
+	db     *db.Session
+	client *http.Client
+	queue  chan *webhookDelivery
+
+	mu    sync.Mutex
+	cache map[string]cachedWebhooks // channel_id -> webhooks
+
+	// Oldest minute that may still hold overdue retries. Only the recovery
+	// loop uses it.
+	oldest time.Time
+}
+
+func NewWebhookWorker(brokers []string, topic string, session *db.Session) *WebhookWorker {
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  brokers,
+		Topic:    topic,
+		GroupID:  webhookGroupID,
+		MinBytes: 10e3,
+		MaxBytes: 10e6,
+	})
+
+	return &WebhookWorker{
+		reader: r,
+		db:     session,
+		client: netguard.Client(webhookTimeout),
+		queue:  make(chan *webhookDelivery, webhookQueueSize),
+		cache:  make(map[string]cachedWebhooks),
+		oldest: loadWatermark(session, webhookRetryWatermark, time.Now().Add(-webhookRetryLookback).Truncate(time.Minute)),
+	}
+}
+
+// Run starts the delivery workers and consumes chat-messages until ctx is
+// done.
+func (w *WebhookWorker) Run(ctx context.Context) {
+	for i := 0; i < webhookWorkers; i++ {
+		go w.work(ctx)
+	}
+	go w.recoverRetries(ctx)
+
+	for {
+		m, err := w.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Webhook worker error reading message: %v. Retrying in 1s...", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		// Committing before the deliveries are stored would lose them.
+		backoff := retryBaseBackoff
+		for {
+			err := w.handle(ctx, m)
+			if err == nil {
+				break
+			}
+			log.Printf("Webhook worker failed to handle offset %d: %v. Retrying in %s...", m.Offset, err, backoff)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = min(backoff*2, retryMaxBackoff)
+		}
+		if err := w.reader.CommitMessages(ctx, m); err != nil && ctx.Err() == nil {
+			log.Printf("Webhook worker failed to commit offset %d: %v", m.Offset, err)
+		}
+	}
+}
+
+func (w *WebhookWorker) Close() error {
+	return w.reader.Close()
+}
+
+// handle stores a delivery for every webhook of the channel that subscribed
+// to the record's event. A record replayed after a crash may deliver its
+// event twice, under a new delivery ID. It fails only if the channel's
+// webhooks cannot be loaded.
+func (w *WebhookWorker) handle(ctx context.Context, m kafka.Message) error {
+	var msg model.Message
+	if err := json.Unmarshal(m.Value, &msg); err != nil {
+		return nil
+	}
+	event := webhook.EventFor(&msg)
+	if event == "" {
+		return nil
+	}
+
+	targets, err := w.webhooksFor(msg.ChannelID)
+	if err != nil {
+		return fmt.Errorf("load webhooks for %s: %w", msg.ChannelID, err)
+	}
+	var subscribed []*webhookTarget
+	for _, t := range targets {
+		if t.events[event] {
+			subscribed = append(subscribed, t)
+		}
+	}
+	if len(subscribed) == 0 {
+		return nil
+	}
+
+	for _, t := range subscribed {
+		id := gocql.TimeUUID().String()
+		body, err := json.Marshal(webhook.Payload{
+			DeliveryID: id,
+			Event:      event,
+			ChannelID:  msg.ChannelID,
+			Timestamp:  msg.Timestamp,
+			Message:    &msg,
+		})
+		if err != nil {
+			log.Printf("Failed to marshal webhook payload for %s: %v", t.id, err)
+			continue
+		}
+		w.scheduleAttempt(ctx, &webhookDelivery{target: t, channelID: msg.ChannelID, id: id, event: event, body: body, attempt: 1}, time.Now())
+	}
+	return nil
+}
+
+// webhooksFor returns a channel's webhooks, cached for webhookCacheTTL.
+func (w *WebhookWorker) webhooksFor(channelID string) ([]*webhookTarget, error) {
+	w.mu.Lock()
+	cached, ok := w.cache[channelID]
+	w.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < webhookCacheTTL {
+		return cached.targets, nil
+	}
+
+	iter := w.db.Query(`SELECT webhook_id, url, secret, events FROM channel_webhooks WHERE channel_id = ?`, channelID).Iter()
+	var targets []*webhookTarget
+	var id, url, secret string
+	var events []string
+	for iter.Scan(&id, &url, &secret, &events) {
+		t := &webhookTarget{id: id, url: url, secret: secret, events: make(map[string]bool)}
+		for _, e := range events {
+			t.events[e] = true
+		}
+		targets = append(targets, t)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	w.cache[channelID] = cachedWebhooks{targets: targets, fetchedAt: time.Now()}
+	w.mu.Unlock()
+	return targets, nil
+}
+
+func (w *WebhookWorker) enqueue(ctx context.Context, d *webhookDelivery) {
+	select {
+	case w.queue <- d:
+	case <-ctx.Done():
+	}
+}
+
+func (w *WebhookWorker) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-w.queue:
+			w.attempt(ctx, d)
+		}
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry or dead-letters
+// the delivery if it fails.
+func (w *WebhookWorker) attempt(ctx context.Context, d *webhookDelivery) {
+	start := time.Now()
+	status, err := w.post(ctx, d)
+	w.logAttempt(d, status, err, time.Since(start))
+	if err == nil {
+		return
+	}
+
+	// Other client errors mean the receiver rejected the payload; sending it
+	// again will not help.
+	permanent := status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+	if permanent || d.attempt >= webhookMaxAttempts {
+		w.deadLetter(d, err)
+		return
+	}
+
+	backoff := webhookBaseBackoff << (d.attempt - 1)
+	backoff += time.Duration(rand.Int63n(int64(backoff / 2)))
+	d.attempt++
+	w.scheduleAttempt(ctx, d, time.Now().Add(backoff))
+}
+
+// scheduleAttempt stores a delivery for an attempt at dueAt and sets a timer
+// for it. If the row cannot be stored the attempt is kept in memory only.
+func (w *WebhookWorker) scheduleAttempt(ctx context.Context, d *webhookDelivery, dueAt time.Time) {
+	// Timestamps are stored in milliseconds; the claim has to match exactly.
+	dueAt = dueAt.Truncate(time.Millisecond)
+	minute := dueAt.Truncate(time.Minute)
+	query := `INSERT INTO webhook_retries (minute, due_at, delivery_id, webhook_id, channel_id, event, payload, attempt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if err := w.db.Query(query, minute, dueAt, d.id, d.target.id, d.channelID, d.event, string(d.body), d.attempt).Exec(); err != nil {
+		log.Printf("Failed to store attempt %d of webhook delivery %s, keeping it in memory: %v", d.attempt, d.id, err)
+		time.AfterFunc(time.Until(dueAt), func() { w.enqueue(ctx, d) })
+		return
+	}
+	time.AfterFunc(time.Until(dueAt), func() {
+		if w.claimRetry(minute, dueAt, d.id) {
+			w.enqueue(ctx, d)
+		}
+	})
+}
+
+// claimRetry removes a stored retry and reports whether this call removed
+// it. Whoever removes it makes the attempt.
+func (w *WebhookWorker) claimRetry(minute, dueAt time.Time, deliveryID string) bool {
+	applied, err := w.db.Query(`DELETE FROM webhook_retries WHERE minute = ? AND due_at = ? AND delivery_id = ? IF EXISTS`,
+		minute, dueAt, deliveryID).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		log.Printf("Failed to claim retry of webhook delivery %s: %v", deliveryID, err)
+		return false
+	}
+	return applied
+}
+
+// recoverRetries makes the stored retries whose timers were lost, until ctx
+// is done.
+func (w *WebhookWorker) recoverRetries(ctx context.Context) {
+	ticker := time.NewTicker(webhookRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.recoverOverdue(ctx)
+		}
+	}
+}
+
+type storedRetry struct {
+	dueAt      time.Time
+	deliveryID string
+	webhookID  string
+	channelID  string
+	event      string
+	payload    string
+	attempt    int
+}
+
+// recoverOverdue queues every retry more than webhookRetryGrace overdue. A
+// minute is only left behind once nothing in it is waiting any more.
+func (w *WebhookWorker) recoverOverdue(ctx context.Context) {
+	cutoff := time.Now().Add(-webhookRetryGrace)
+	defer func(start time.Time) {
+		if w.oldest.After(start) {
+			saveWatermark(w.db, webhookRetryWatermark, w.oldest)
+		}
+	}(w.oldest)
+	for minute := w.oldest; !minute.After(cutoff); minute = minute.Add(time.Minute) {
+		var overdue []storedRetry
+		var r storedRetry
+		iter := w.db.Query(`SELECT due_at, delivery_id, webhook_id, channel_id, event, payload, attempt FROM webhook_retries WHERE minute = ? AND due_at <= ?`, minute, cutoff).Iter()
+		for iter.Scan(&r.dueAt, &r.deliveryID, &r.webhookID, &r.channelID, &r.event, &r.payload, &r.attempt) {
+			overdue = append(overdue, r)
+		}
+		if err := iter.Close(); err != nil {
+			log.Printf("Failed to load webhook retries due at %s: %v", minute.Format(time.RFC3339), err)
+			return
+		}
+
+		done := true
+		for _, r := range overdue {
+			target, err := w.webhook(r.channelID, r.webhookID)
+			if err != nil {
+				log.Printf("Failed to load webhook %s: %v", r.webhookID, err)
+				done = false
+				continue
+			}
+			if !w.claimRetry(minute, r.dueAt, r.deliveryID) || target == nil {
+				// Someone else has it, or the webhook was deleted
+				continue
+			}
+			w.enqueue(ctx, &webhookDelivery{
+				target:    target,
+				channelID: r.channelID,
+				id:        r.deliveryID,
+				event:     r.event,
+				body:      []byte(r.payload),
+				attempt:   r.attempt,
+			})
+		}
+		if done && minute.Add(time.Minute).Before(cutoff) && minute.Equal(w.oldest) {
+			w.oldest = minute.Add(time.Minute)
+		}
+	}
+}
+
+// webhook returns one of a channel's webhooks, nil if it no longer exists.
+func (w *WebhookWorker) webhook(channelID, webhookID string) (*webhookTarget, error) {
+	targets, err := w.webhooksFor(channelID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if t.id == webhookID {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+func (w *WebhookWorker) post(ctx context.Context, d *webhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.target.url, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-webhooks/1")
+	req.Header.Set(webhook.HeaderEvent, d.event)
+	req.Header.Set(webhook.HeaderDelivery, d.id)
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(d.target.secret, time.Now(), d.body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (w *WebhookWorker) logAttempt(d *webhookDelivery, status int, err error, took time.Duration) {
+	var errText string
+	if err != nil {
+		errText = err.Error()
+	}
+	query := `INSERT INTO webhook_deliveries (webhook_id, attempt_id, delivery_id, event, attempt, status_code, error, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	if err := w.db.Query(query, d.target.id, gocql.TimeUUID(), d.id, d.event, d.attempt, status, errText, int(took.Milliseconds())).Exec(); err != nil {
+		log.Printf("Failed to log webhook delivery %s: %v", d.id, err)
+	}
+}
+
+func (w *WebhookWorker) deadLetter(d *webhookDelivery, lastErr error) {
+	log.Printf("Webhook %s gave up on delivery %s after %d attempts: %v", d.target.id, d.id, d.attempt, lastErr)
+	query := `INSERT INTO webhook_dead_letters (webhook_id, failed_id, delivery_id, event, payload, attempts, last_error) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	if err := w.db.Query(query, d.target.id, gocql.TimeUUID(), d.id, d.event, string(d.body), d.attempt, lastErr.Error()).Exec(); err != nil {
+		log.Printf("Failed to dead-letter webhook delivery %s: %v", d.id, err)
+	}
+}
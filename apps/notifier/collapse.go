@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/push"
+)
+
+type burstKey struct {
+	userID    string
+	channelID string
+}
+
+// burst counts the notifications held back during a window.
+type burst struct {
+	count  int
+	latest *push.Notification
+}
+
+// collapser limits each user to one notification per channel per window.
+// The first notification goes out at once; whatever arrives during the
+// window is sent as one summary when it ends, which starts another window.
+//
+// Bursts are kept in memory. chat-messages is keyed by channel and mention
+// and reminder events by user, so one notifier replica sees every record
+// that can collapse together.
+type collapser struct {
+	window time.Duration
+	send   func(userID string, n *push.Notification)
+
+	mu     sync.Mutex
+	bursts map[burstKey]*burst
+}
+
+func newCollapser(window time.Duration, send func(string, *push.Notification)) *collapser {
+	return &collapser{window: window, send: send, bursts: make(map[burstKey]*burst)}
+}
+
+func (c *collapser) add(userID, channelID string, n *push.Notification) {
+	k := burstKey{userID, channelID}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b, ok := c.bursts[k]; ok {
+		b.count++
+		b.latest = n
+		return
+	}
+	c.bursts[k] = &burst{}
+	time.AfterFunc(c.window, func() { c.flush(k) })
+	c.send(userID, n)
+}
+
+// flush ends a window, sending a summary if anything was held back.
+func (c *collapser) flush(k burstKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b := c.bursts[k]
+	if b.count == 0 {
+		delete(c.bursts, k)
+		return
+	}
+
+	summary := *b.latest
+	if b.count > 1 {
+		summary.Body = fmt.Sprintf("%d new messages. Latest: %s", b.count, b.latest.Body)
+	}
+	b.count, b.latest = 0, nil
+	time.AfterFunc(c.window, func() { c.flush(k) })
+	c.send(k.userID, &summary)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/digest"
+	"github.com/mahaj/networking-minor/pkg/prefs"
+	"github.com/mahaj/networking-minor/pkg/snowflake"
+	"github.com/mahaj/networking-minor/pkg/status"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// How often users are checked for a digest that is due.
+	digestInterval = 5 * time.Minute
+
+	// Mentions listed in one digest; the rest are only counted.
+	maxDigestMentions = 20
+)
+
+type digestConversation struct {
+	With   string
+	Unread int64
+	Latest string
+}
+
+type digestMention struct {
+	Author    string
+	ChannelID string
+	Content   string
+}
+
+// digestContent is what a digest tells a user about.
+type digestContent struct {
+	UserID         string
+	Conversations  []digestConversation
+	Unread         int64
+	Mentions       []digestMention
+	MoreMentions   int
+	AppURL         string
+	UnsubscribeURL string
+}
+
+func (c *digestContent) empty() bool {
+	return len(c.Conversations) == 0 && len(c.Mentions) == 0
+}
+
+// DigestWorker e-mails users who asked for digests about the DMs they have
+// not read and the mentions they got while they were away. A user only gets
+// one once they have been offline for minOffline, and at most once per
+// period of their chosen frequency.
+type DigestWorker struct {
+	db         *db.Session
+	redis      *redis.Client
+	mailer     *digest.Mailer
+	secret     []byte
+	apiURL     string
+	appURL     string
+	minOffline time.Duration
+}
+
+func NewDigestWorker(session *db.Session, rdb *redis.Client, mailer *digest.Mailer, secret []byte, apiURL, appURL string, minOffline time.Duration) *DigestWorker {
+	return &DigestWorker{db: session, redis: rdb, mailer: mailer, secret: secret, apiURL: apiURL, appURL: appURL, minOffline: minOffline}
+}
+
+// Run sends digests as they come due until ctx is done.
+func (w *DigestWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(digestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.sendDue(ctx)
+		}
+	}
+}
+
+func (w *DigestWorker) sendDue(ctx context.Context) {
+	all, err := digest.List(w.db)
+	if err != nil {
+		log.Printf("Failed to load digest settings: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, s := range all {
+		if now.Sub(s.LastSentAt) < digest.Period(s.Frequency) {
+			continue
+		}
+		away, err := w.offlineFor(ctx, s.UserID, now)
+		if err != nil {
+			log.Printf("Failed to check presence of %s: %v", s.UserID, err)
+			continue
+		}
+		if away < w.minOffline {
+			continue
+		}
+		p, err := prefs.Get(ctx, w.db, w.redis, s.UserID)
+		if err != nil {
+			log.Printf("Failed to load preferences of %s: %v", s.UserID, err)
+			continue
+		}
+		// Held until do not disturb ends
+		if p.InDND(now) {
+			continue
+		}
+		if err := w.send(s, p, now); err != nil {
+			log.Printf("Failed to send digest to %s: %v", s.UserID, err)
+		}
+	}
+}
+
+// offlineFor returns how long a user has been offline, or 0 if they are
+// connected.
+func (w *DigestWorker) offlineFor(ctx context.Context, userID string, now time.Time) (time.Duration, error) {
+	vals, err := w.redis.HMGet(ctx, status.Key(userID), "online", "last_seen").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	if len(vals) > 0 && vals[0] != nil {
+		return 0, nil
+	}
+	if len(vals) > 1 {
+		if s, ok := vals[1].(string); ok {
+			if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return now.Sub(time.UnixMilli(ms)), nil
+			}
+		}
+	}
+	// Never seen, or seen before presence was recorded
+	return now.Sub(time.Time{}), nil
+}
+
+// send claims a user's digest so no other replica sends it, then collects
+// what happened since the last one and mails it if there is anything.
+func (w *DigestWorker) send(s *digest.Settings, p *prefs.Prefs, now time.Time) error {
+	claimed, err := digest.Claim(w.db, s, now)
+	if err != nil || !claimed {
+		return err
+	}
+
+	content, err := w.collect(s.UserID, p, s.LastSentAt, now)
+	if err == nil && !content.empty() {
+		var msg []byte
+		msg, err = w.render(s, content)
+		if err == nil {
+			err = w.mailer.Send(s.Email, msg)
+		}
+	}
+	if err != nil {
+		if rerr := digest.Release(w.db, s, now); rerr != nil {
+			log.Printf("Failed to release digest of %s: %v", s.UserID, rerr)
+		}
+		return err
+	}
+	if !content.empty() {
+		log.Printf("Sent %s digest to %s: %d unread messages, %d mentions", s.Frequency, s.UserID, content.Unread, len(content.Mentions)+content.MoreMentions)
+	}
+	return nil
+}
+
+// collect gathers the unread DMs and the mentions a user got since a time,
+// leaving out channels their preferences keep quiet at now.
+func (w *DigestWorker) collect(userID string, p *prefs.Prefs, since, now time.Time) (*digestContent, error) {
+	content := &digestContent{UserID: userID, AppURL: w.appURL, UnsubscribeURL: digest.UnsubscribeURL(w.apiURL, w.secret, userID)}
+	sinceID := snowflake.MinID(since)
+
+	var other string
+	var lastUpdated time.Time
+	iter := w.db.Query(`SELECT other_user_id, last_updated FROM user_conversations WHERE user_id = ?`, userID).Iter()
+	for iter.Scan(&other, &lastUpdated) {
+		if lastUpdated.Before(since) || !p.Allows(dmChannel(userID, other), false, now) {
+			continue
+		}
+		c, err := w.unreadSince(userID, other, sinceID)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if c.Unread > 0 {
+			content.Conversations = append(content.Conversations, c)
+			content.Unread += c.Unread
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	var messageID int64
+	var channelID, author string
+	iter = w.db.Query(`SELECT message_id, channel_id, author_id FROM mentions WHERE user_id = ? AND message_id > ?`, userID, sinceID).Iter()
+	for iter.Scan(&messageID, &channelID, &author) {
+		if !p.Allows(channelID, true, now) {
+			continue
+		}
+		if len(content.Mentions) == maxDigestMentions {
+			content.MoreMentions++
+			continue
+		}
+		var text string
+		err := w.db.Query(`SELECT content FROM messages WHERE channel_id = ? AND id = ?`, channelID, messageID).Scan(&text)
+		if errors.Is(err, gocql.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		content.Mentions = append(content.Mentions, digestMention{Author: author, ChannelID: channelID, Content: text})
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// unreadSince counts the DMs from other that userID has not read and that
+// arrived after sinceID. As in the API, the read cursor decides what is
+// unread.
+func (w *DigestWorker) unreadSince(userID, other string, sinceID int64) (digestConversation, error) {
+	c := digestConversation{With: other}
+	var lastRead int64
+	err := w.db.Query(`SELECT last_read_id FROM conversation_reads WHERE user_id = ? AND other_user_id = ?`, userID, other).Scan(&lastRead)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		return c, err
+	}
+	from := max(lastRead, sinceID)
+
+	if err := w.db.Query(`SELECT COUNT(*) FROM unread_messages WHERE user_id = ? AND other_user_id = ? AND message_id > ?`, userID, other, from).Scan(&c.Unread); err != nil {
+		return c, err
+	}
+	if c.Unread == 0 {
+		return c, nil
+	}
+
+	// Rows are newest first
+	var latest int64
+	if err := w.db.Query(`SELECT message_id FROM unread_messages WHERE user_id = ? AND other_user_id = ? AND message_id > ? LIMIT 1`, userID, other, from).Scan(&latest); err != nil {
+		return c, err
+	}
+	err = w.db.Query(`SELECT content FROM messages WHERE channel_id = ? AND id = ?`, dmChannel(userID, other), latest).Scan(&c.Latest)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		return c, err
+	}
+	return c, nil
+}
+
+var digestText = template.Must(template.New("text").Parse(`Hi {{.UserID}},
+
+Here is what you missed.
+{{if .Conversations}}
+Unread direct messages:
+{{range .Conversations}}
+  {{.With}}: {{.Unread}} unread{{if .Latest}}, latest: "{{.Latest}}"{{end}}
+{{- end}}
+{{end}}{{if .Mentions}}
+Mentions:
+{{range .Mentions}}
+  {{.Author}} in {{.ChannelID}}: "{{.Content}}"
+{{- end}}{{if .MoreMentions}}
+  ...and {{.MoreMentions}} more
+{{- end}}
+{{end}}
+Open the chat: {{.AppURL}}
+
+Unsubscribe from these e-mails: {{.UnsubscribeURL}}
+`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #222;">
+<p>Hi {{.UserID}},</p>
+<p>Here is what you missed.</p>
+{{if .Conversations}}
+<h3>Unread direct messages</h3>
+<ul>
+{{range .Conversations}}<li><strong>{{.With}}</strong>: {{.Unread}} unread{{if .Latest}}, latest: &ldquo;{{.Latest}}&rdquo;{{end}}</li>
+{{end}}</ul>
+{{end}}{{if .Mentions}}
+<h3>Mentions</h3>
+<ul>
+{{range .Mentions}}<li><strong>{{.Author}}</strong> in {{.ChannelID}}: &ldquo;{{.Content}}&rdquo;</li>
+{{end}}{{if .MoreMentions}}<li>&hellip;and {{.MoreMentions}} more</li>{{end}}
+</ul>
+{{end}}
+<p><a href="{{.AppURL}}">Open the chat</a></p>
+<p style="font-size: small; color: #888;"><a href="{{.UnsubscribeURL}}">Unsubscribe</a> from these e-mails.</p>
+</body>
+</html>
+`))
+
+// render builds a multipart/alternative message with a plain-text and an
+// HTML version of the digest.
+func (w *DigestWorker) render(s *digest.Settings, content *digestContent) ([]byte, error) {
+	var text, html bytes.Buffer
+	if err := digestText.Execute(&text, content); err != nil {
+		return nil, err
+	}
+	if err := digestHTML.Execute(&html, content); err != nil {
+		return nil, err
+	}
+
+	subject := "You were mentioned while you were away"
+	if content.Unread > 0 {
+		subject = fmt.Sprintf("You have %d unread messages", content.Unread)
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", w.mailer.From())
+	fmt.Fprintf(&msg, "To: %s\r\n", s.Email)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s.digest@chat>\r\n", hex.EncodeToString(id))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	// One-click unsubscribe (RFC 8058): mail clients POST to the link
+	fmt.Fprintf(&msg, "List-Unsubscribe: <%s>\r\n", content.UnsubscribeURL)
+	fmt.Fprintf(&msg, "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		data        []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write(part.data); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+func dmChannel(u1, u2 string) string {
+	if u1 > u2 {
+		u1, u2 = u2, u1
+	}
+	return "dm:" + u1 + ":" + u2
+}
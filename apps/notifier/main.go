@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/digest"
+	"github.com/mahaj/networking-minor/pkg/push"
+	"github.com/redis/go-redis/v9"
+)
+
+func main() {
+	kafkaBrokersStr := os.Getenv("KAFKA_BROKERS")
+	if kafkaBrokersStr == "" {
+		kafkaBrokersStr = "localhost:19092"
+	}
+
+	scyllaHostsStr := os.Getenv("SCYLLA_HOSTS")
+	if scyllaHostsStr == "" {
+		scyllaHostsStr = "localhost:9042"
+	}
+
+	redisAddr := os.Getenv("REDIS_ADDR")
+	if redisAddr == "" {
+		redisAddr = "localhost:6379"
+	}
+
+	// Each user gets at most one notification per channel in this window
+	window := 30 * time.Second
+	if v := os.Getenv("NOTIFY_COLLAPSE_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid NOTIFY_COLLAPSE_WINDOW %q", v)
+		}
+		window = d
+	}
+
+	// Digests go through SMTP; Docker Compose runs Mailpit to catch them
+	smtpAddr := os.Getenv("SMTP_ADDR")
+	if smtpAddr == "" {
+		smtpAddr = "localhost:1025"
+	}
+	smtpFrom := os.Getenv("SMTP_FROM")
+	if smtpFrom == "" {
+		smtpFrom = "chat@localhost"
+	}
+
+	// Signs unsubscribe links; the API must use the same secret
+	digestSecret, err := digest.LoadSecret()
+	if err != nil {
+		log.Fatalf("Failed to load digest secret: %v", err)
+	}
+
+	// Unsubscribe links point at the API; "open the chat" at the web app
+	apiURL := os.Getenv("API_PUBLIC_URL")
+	if apiURL == "" {
+		apiURL = "http://localhost:8081"
+	}
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:3000"
+	}
+
+	// Users get digests once they have been offline this long
+	minOffline := 2 * time.Hour
+	if v := os.Getenv("DIGEST_MIN_OFFLINE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid DIGEST_MIN_OFFLINE %q", v)
+		}
+		minOffline = d
+	}
+
+	providers, err := loadProviders()
+	if err != nil {
+		log.Fatalf("Failed to set up push providers: %v", err)
+	}
+	if len(providers) == 0 {
+		log.Printf("No push providers configured; notifications will not be sent")
+	}
+
+	// The messaging service creates the schema
+	session, err := db.NewSession(strings.Split(scyllaHostsStr, ","), "chat")
+	if err != nil {
+		log.Fatalf("Failed to connect to ScyllaDB: %v", err)
+	}
+	defer session.Close()
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer rdb.Close()
+
+	mailer := digest.NewMailer(smtpAddr, smtpFrom, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	digests := NewDigestWorker(session, rdb, mailer, digestSecret, apiURL, appURL, minOffline)
+	go digests.Run(context.Background())
+
+	notifier := NewNotifier(strings.Split(kafkaBrokersStr, ","), "chat-messages", session, rdb, providers, window)
+	defer notifier.Close()
+
+	log.Println("Starting notifier...")
+	notifier.Run(context.Background())
+}
+
+// loadProviders sets up every provider that is configured. Devices of
+// other providers are skipped.
+func loadProviders() (map[string]push.Provider, error) {
+	providers := make(map[string]push.Provider)
+
+	// Service account key from the Firebase console
+	if path := os.Getenv("FCM_CREDENTIALS"); path != "" {
+		p, err := push.NewFCM(path)
+		if err != nil {
+			return nil, err
+		}
+		providers[push.ProviderFCM] = p
+	}
+
+	// Token signing key (.p8) from the Apple developer account
+	if path := os.Getenv("APNS_KEY_FILE"); path != "" {
+		p, err := push.NewAPNs(path, os.Getenv("APNS_KEY_ID"), os.Getenv("APNS_TEAM_ID"), os.Getenv("APNS_TOPIC"), os.Getenv("APNS_SANDBOX") == "true")
+		if err != nil {
+			return nil, err
+		}
+		providers[push.ProviderAPNs] = p
+	}
+
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		p, err := push.NewWebPush(key, os.Getenv("VAPID_SUBJECT"))
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Web push enabled; browsers subscribe with applicationServerKey %s", p.PublicKey())
+		providers[push.ProviderWebPush] = p
+	}
+
+	// Stand-ins for testing
+	if path := os.Getenv("PUSH_FILE"); path != "" {
+		providers[push.ProviderFile] = push.NewFile(path)
+	}
+	if url := os.Getenv("PUSH_HTTP_URL"); url != "" {
+		providers[push.ProviderHTTP] = push.NewHTTP(url)
+	}
+
+	for name := range providers {
+		log.Printf("Push provider %s enabled", name)
+	}
+	return providers, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/mahaj/networking-minor/pkg/mention"
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/mahaj/networking-minor/pkg/prefs"
+	"github.com/mahaj/networking-minor/pkg/push"
+	"github.com/mahaj/networking-minor/pkg/status"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	// Consumer group of the notifier, separate from persistence and webhooks.
+	notifierGroupID = "notifier-group"
+
+	sendWorkers   = 8
+	sendQueueSize = 1024
+
+	// Longest notification body; longer messages are cut.
+	maxBodyLength = 200
+)
+
+// pushJob is one notification on its way to all of a user's devices.
+type pushJob struct {
+	userID       string
+	notification *push.Notification
+}
+
+// Notifier sends push notifications for chat-messages to users who are not
+// connected: DMs to their recipient, channel messages to users who follow
+// every message there, and mentions and reminders to their user. Users'
+// notification preferences and do not disturb are honoured, and bursts from
+// one channel are collapsed.
+type Notifier struct {
+	reader    *kafka.Reader
+	db        *db.Session
+	redis     *redis.Client
+	providers map[string]push.Provider
+	collapser *collapser
+	queue     chan pushJob
+}
+
+func NewNotifier(brokers []string, topic string, session *db.Session, rdb *redis.Client, providers map[string]push.Provider, window time.Duration) *Notifier {
+	n := &Notifier{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  brokers,
+			Topic:    topic,
+			GroupID:  notifierGroupID,
+			MinBytes: 10e3,
+			MaxBytes: 10e6,
+		}),
+		db:        session,
+		redis:     rdb,
+		providers: providers,
+		queue:     make(chan pushJob, sendQueueSize),
+	}
+	n.collapser = newCollapser(window, n.enqueue)
+	return n
+}
+
+// Run starts the send workers and consumes chat-messages until ctx is done.
+func (n *Notifier) Run(ctx context.Context) {
+	for i := 0; i < sendWorkers; i++ {
+		go n.work(ctx)
+	}
+
+	for {
+		m, err := n.reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Notifier error reading message: %v. Retrying in 1s...", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		n.handle(ctx, m)
+	}
+}
+
+func (n *Notifier) Close() error {
+	return n.reader.Close()
+}
+
+// handle works out who a record should notify and hands the notifications
+// to the collapser.
+func (n *Notifier) handle(ctx context.Context, m kafka.Message) {
+	var msg model.Message
+	if err := json.Unmarshal(m.Value, &msg); err != nil {
+		return
+	}
+
+	switch msg.Type {
+	case model.TypeMessage:
+		// The messaging service resolves mentions after this record was
+		// written, so they are parsed again here
+		mentioned := mention.Users(mention.Parse(msg.Content))
+		if u1, u2, ok := dmParticipants(msg.ChannelID); ok {
+			recipient := u1
+			if recipient == msg.UserID {
+				recipient = u2
+			}
+			n.notify(ctx, recipient, msg.ChannelID, &msg, sender(&msg), slices.Contains(mentioned, recipient))
+			return
+		}
+
+		// Other channels notify users who asked for every message. Mentioned
+		// users hear about it through their mention event instead.
+		users, err := prefs.NotifyAll(n.db, msg.ChannelID)
+		if err != nil {
+			log.Printf("Failed to load who follows %s: %v", msg.ChannelID, err)
+			return
+		}
+		for _, u := range users {
+			if u != msg.UserID && !slices.Contains(mentioned, u) {
+				n.notify(ctx, u, msg.ChannelID, &msg, sender(&msg)+" in "+msg.ChannelID, false)
+			}
+		}
+	case model.TypeMention:
+		// The DM itself already notifies
+		if _, _, ok := dmParticipants(msg.TargetChannelID); ok {
+			return
+		}
+		recipient := strings.TrimPrefix(msg.ChannelID, model.UserChannelPrefix)
+		n.notify(ctx, recipient, msg.TargetChannelID, &msg, sender(&msg)+" in "+msg.TargetChannelID, true)
+	case model.TypeReminder:
+		recipient := strings.TrimPrefix(msg.ChannelID, model.UserChannelPrefix)
+		n.notify(ctx, recipient, msg.TargetChannelID, &msg, "Reminder", false)
+	}
+}
+
+// notify hands a notification about msg in channelID to the collapser if
+// the recipient wants it.
+func (n *Notifier) notify(ctx context.Context, recipient, channelID string, msg *model.Message, title string, mentioned bool) {
+	ok, err := n.wants(ctx, recipient, channelID, msg.Type, mentioned)
+	if err != nil {
+		log.Printf("Failed to check whether %s wants notifications: %v", recipient, err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	notification := &push.Notification{Title: title, Body: preview(msg)}
+	if msg.Type == model.TypeReminder && notification.Body == "" {
+		notification.Body = "About a message in " + channelID
+	}
+	messageID := msg.ID
+	if msg.TargetID != 0 {
+		messageID = msg.TargetID
+	}
+	notification.CollapseKey = channelID
+	notification.Data = map[string]string{
+		"type":       string(msg.Type),
+		"channel_id": channelID,
+		"message_id": strconv.FormatInt(messageID, 10),
+	}
+	n.collapser.add(recipient, channelID, notification)
+}
+
+// wants reports whether a user should get a push notification: only when
+// they have no connection open, their status is not do not disturb, their
+// do-not-disturb schedule is off, and their preferences for the channel
+// allow it. Reminders were asked for, so they skip the channel preferences.
+func (n *Notifier) wants(ctx context.Context, userID, channelID string, t model.MessageType, mentioned bool) (bool, error) {
+	vals, err := n.redis.HMGet(ctx, status.Key(userID), "online", "status").Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+	online := len(vals) > 0 && vals[0] != nil
+	dnd := len(vals) > 1 && vals[1] == string(model.StatusDND)
+	if online || dnd {
+		return false, nil
+	}
+
+	p, err := prefs.Get(ctx, n.db, n.redis, userID)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if p.InDND(now) {
+		return false, nil
+	}
+	return t == model.TypeReminder || p.Allows(channelID, mentioned, now), nil
+}
+
+func (n *Notifier) enqueue(userID string, notification *push.Notification) {
+	select {
+	case n.queue <- pushJob{userID: userID, notification: notification}:
+	default:
+		log.Printf("Dropping notification for %s: send queue is full", userID)
+	}
+}
+
+func (n *Notifier) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-n.queue:
+			n.send(ctx, job)
+		}
+	}
+}
+
+// send delivers a notification to every device of the user, forgetting
+// devices their push service no longer knows.
+func (n *Notifier) send(ctx context.Context, job pushJob) {
+	devices, err := push.List(n.db, job.userID)
+	if err != nil {
+		log.Printf("Failed to load devices of %s: %v", job.userID, err)
+		return
+	}
+	for _, d := range devices {
+		provider, ok := n.providers[d.Provider]
+		if !ok {
+			continue
+		}
+		err := provider.Send(ctx, d.Token, job.notification)
+		if errors.Is(err, push.ErrInvalidToken) {
+			log.Printf("Forgetting %s device %s of %s: token is no longer valid", d.Provider, d.ID, job.userID)
+			if err := push.Delete(n.db, job.userID, d.ID); err != nil {
+				log.Printf("Failed to delete device %s: %v", d.ID, err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to send notification to %s device %s of %s: %v", d.Provider, d.ID, job.userID, err)
+			continue
+		}
+		log.Printf("Sent notification to %s device %s of %s", d.Provider, d.ID, job.userID)
+	}
+}
+
+func dmParticipants(channelID string) (u1, u2 string, ok bool) {
+	parts := strings.Split(channelID, ":")
+	if len(parts) != 3 || parts[0] != "dm" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func sender(msg *model.Message) string {
+	if msg.DisplayName != "" {
+		return msg.DisplayName
+	}
+	return msg.UserID
+}
+
+// preview is the start of a message's content, for a notification body.
+func preview(msg *model.Message) string {
+	body := msg.Content
+	if body == "" && len(msg.Attachments) > 0 {
+		return "Sent an attachment"
+	}
+	if utf8.RuneCountInString(body) > maxBodyLength {
+		body = string([]rune(body)[:maxBodyLength-1]) + "…"
+	}
+	return body
+}
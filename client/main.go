@@ -12,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,17 +23,24 @@ type LoginResponse struct {
 	Token string `json:"token"`
 }
 
-func login(apiAddr, userID string) (string, error) {
-	reqBody, _ := json.Marshal(map[string]string{"user_id": userID})
-	resp, err := http.Post(apiAddr+"/login", "application/json", bytes.NewBuffer(reqBody))
+// login authenticates against /login, or creates the account first via
+// /register when register is set.
+func login(apiAddr, userID, password string, register bool) (string, error) {
+	path := "/login"
+	if register {
+		path = "/register"
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"username": userID, "password": password})
+	resp, err := http.Post(apiAddr+path, "application/json", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
 		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("login failed: %s", string(body))
+		return "", fmt.Errorf("%s failed: %s", path, string(body))
 	}
 
 	var loginResp LoginResponse
@@ -47,6 +55,8 @@ func main() {
 	serverAddr := flag.String("addr", "localhost:8080", "gateway service address")
 	apiAddr := flag.String("api", "http://localhost:8081", "api service address")
 	userID := flag.String("user", "user1", "user id")
+	password := flag.String("password", "", "password")
+	register := flag.Bool("register", false, "create the account before connecting")
 	channelID := flag.String("channel", "general", "channel id")
 	dmUser := flag.String("dm", "", "user id to dm (overrides -channel)")
 	flag.Parse()
@@ -64,7 +74,7 @@ func main() {
 
 	// 1. Login to get token
 	log.Printf("Logging in as %s...", *userID)
-	token, err := login(*apiAddr, *userID)
+	token, err := login(*apiAddr, *userID, *password, *register)
 	if err != nil {
 		log.Fatal("Login failed:", err)
 	}
@@ -95,6 +105,14 @@ func main() {
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+					log.Println("Gateway is restarting, reconnect to continue")
+					return
+				}
+				if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+					log.Println("Session was revoked, log in again")
+					return
+				}
 				log.Println("read:", err)
 				return
 			}
@@ -107,10 +125,50 @@ func main() {
 			}
 
 			if msg.Type == model.TypeTyping {
-				fmt.Printf("\rUser %s is typing...      \n> ", msg.UserID)
+				if msg.Content != model.TypingStop {
+					fmt.Printf("\rUser %s is typing...      \n> ", msg.UserID)
+				}
+			} else if msg.Type == model.TypeStatus && msg.Status != nil {
+				fmt.Printf("\rUser %s is now %s %s\n> ", msg.UserID, msg.Status.Status, msg.Status.Text)
+			} else if msg.Type == model.TypeEphemeral {
+				fmt.Printf("\r(only you) %s\n> ", msg.Content)
+			} else if msg.Type == model.TypeTopic {
+				fmt.Printf("\r%s set the topic: %s\n> ", msg.UserID, msg.Content)
+			} else if msg.Type == model.TypeInvite {
+				// The inviter gets a copy too; their confirmation is the command reply.
+				if msg.UserID == *userID {
+					continue
+				}
+				fmt.Printf("\r%s invited you to %s (-channel %s)\n> ", msg.UserID, msg.Content, msg.Content)
+			} else if msg.Type == model.TypeExpire {
+				if msg.Content == model.ExpireBefore {
+					fmt.Printf("\r(messages up to %d expired)\n> ", msg.TargetID)
+				} else {
+					fmt.Printf("\r(message %d expired)\n> ", msg.TargetID)
+				}
+			} else if msg.Type == model.TypeReminder {
+				fmt.Printf("\rReminder: message %d in %s %s\n> ", msg.TargetID, msg.TargetChannelID, msg.Content)
+			} else if msg.Type == model.TypePin {
+				fmt.Printf("\r%s pinned message %d\n> ", msg.UserID, msg.TargetID)
+			} else if msg.Type == model.TypeUnpin {
+				fmt.Printf("\r%s unpinned message %d\n> ", msg.UserID, msg.TargetID)
+			} else if msg.Type == model.TypeEdited {
+				fmt.Printf("\r%s edited message %d: %s\n> ", msg.UserID, msg.TargetID, msg.Content)
+			} else if msg.Type == model.TypeMention {
+				fmt.Printf("\r%s mentioned you in %s: %s\n> ", msg.UserID, msg.TargetChannelID, msg.Content)
+			} else if msg.Bot {
+				fmt.Printf("\r%s [bot %s]: %s\n> ", msg.DisplayName, msg.UserID, msg.Content)
+				for _, a := range msg.Attachments {
+					fmt.Printf("\r  %s %s %s\n> ", a.Title, a.TitleLink, a.Text)
+				}
+			} else if msg.DisplayName != "" {
+				fmt.Printf("\r%s (%s): %s\n> ", msg.DisplayName, msg.UserID, msg.Content)
 			} else {
 				fmt.Printf("\r%s: %s\n> ", msg.UserID, msg.Content)
 			}
+			for _, a := range msg.Attachments {
+				fmt.Printf("\r  [%s, %s, %d bytes] %s/attachments/%s\n> ", a.Name, a.ContentType, a.Size, *apiAddr, a.ID)
+			}
 		}
 	}()
 
@@ -148,6 +206,22 @@ func main() {
 				continue
 			}
 
+			if strings.HasPrefix(text, "/status ") {
+				// Send status change: /status away|dnd|online [text]
+				fields := strings.SplitN(strings.TrimPrefix(text, "/status "), " ", 2)
+				st := model.UserStatus{Status: model.Status(fields[0])}
+				if len(fields) == 2 {
+					st.Text = fields[1]
+				}
+				jsonMsg, _ := json.Marshal(map[string]interface{}{"type": model.TypeStatus, "status": st})
+				if err := c.WriteMessage(websocket.TextMessage, jsonMsg); err != nil {
+					log.Println("write:", err)
+					break
+				}
+				fmt.Print("> ")
+				continue
+			}
+
 			// Send normal message
 			// Client sends raw text, Gateway wraps it.
 			err := c.WriteMessage(websocket.TextMessage, []byte(text))
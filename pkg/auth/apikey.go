@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Scopes an API key can be granted.
+const (
+	ScopeHistoryRead   = "history:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+var Scopes = []string{ScopeHistoryRead, ScopeMessagesWrite}
+
+const (
+	// API keys look like "ck_<id>_<secret>", so they can be told apart from
+	// JWTs and the ID can be looked up without scanning.
+	apiKeyPrefix = "ck_"
+
+	// Number of audit entries kept per key.
+	apiKeyAuditLength = 1000
+)
+
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// APIKey is a long-lived credential of a bot account. It is limited to its
+// scopes and, if Channels is set, to those channels.
+type APIKey struct {
+	ID         string     `json:"id"`
+	BotID      string     `json:"bot_id"`
+	OwnerID    string     `json:"owner_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Channels   []string   `json:"channels,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	SecretHash string     `json:"secret_hash,omitempty"`
+}
+
+// AuditEntry records one use of an API key.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Detail     string    `json:"detail"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+// IsAPIKey reports whether a bearer credential is an API key rather than a
+// JWT.
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// NewAPIKey creates a key for a bot and returns it with the full credential,
+// which is shown to the owner once and never stored.
+func NewAPIKey(botID, ownerID, name string, scopes, channels []string) (*APIKey, string, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, "", errors.New("at least one scope is required")
+	}
+
+	// Hex keeps the ID free of the "_" separator.
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, "", err
+	}
+	id := hex.EncodeToString(buf)
+	secret, err := randomToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	k := &APIKey{
+		ID:         id,
+		BotID:      botID,
+		OwnerID:    ownerID,
+		Name:       name,
+		Scopes:     scopes,
+		Channels:   channels,
+		CreatedAt:  time.Now(),
+		SecretHash: hashToken(secret),
+	}
+	return k, apiKeyPrefix + id + "_" + secret, nil
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAPIKey splits a credential into key ID and secret.
+func ParseAPIKey(credential string) (id, secret string, err error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(credential, apiKeyPrefix), "_")
+	if !IsAPIKey(credential) || !ok || id == "" || secret == "" {
+		return "", "", ErrInvalidAPIKey
+	}
+	return id, secret, nil
+}
+
+// Matches reports whether secret belongs to this key.
+func (k *APIKey) Matches(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(k.SecretHash), []byte(hashToken(secret))) == 1
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsChannel reports whether the key may act on a channel. Keys without a
+// channel list may act on any channel their bot can.
+func (k *APIKey) AllowsChannel(channelID string) bool {
+	if len(k.Channels) == 0 {
+		return true
+	}
+	for _, c := range k.Channels {
+		if c == channelID {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenID identifies connections opened with this key in revocations.
+func (k *APIKey) TokenID() string {
+	return "apikey:" + k.ID
+}
+
+// Claims returns the identity requests made with this key act as. The token
+// ID matches revocations of the key.
+func (k *APIKey) Claims() *Claims {
+	c := &Claims{UserID: k.BotID, APIKey: k}
+	c.ID = k.TokenID()
+	return c
+}
+
+// APIKeyStore keeps live API keys in Redis so every service, including the
+// gateway, can verify them. The API's database is the source of truth; the
+// store only holds copies of keys that are not revoked.
+type APIKeyStore struct {
+	redis *redis.Client
+}
+
+func NewAPIKeyStore(rdb *redis.Client) *APIKeyStore {
+	return &APIKeyStore{redis: rdb}
+}
+
+func apiKeyKey(id string) string {
+	return "apikey:" + id
+}
+
+func apiKeyAuditKey(id string) string {
+	return "apikey:" + id + ":audit"
+}
+
+func (s *APIKeyStore) Put(ctx context.Context, k *APIKey) error {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	return s.redis.Set(ctx, apiKeyKey(k.ID), data, 0).Err()
+}
+
+// Get returns a live key, or nil if the store does not know it.
+func (s *APIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	data, err := s.redis.Get(ctx, apiKeyKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var k APIKey
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Verify looks up a credential and checks its secret.
+func (s *APIKeyStore) Verify(ctx context.Context, credential string) (*APIKey, error) {
+	id, secret, err := ParseAPIKey(credential)
+	if err != nil {
+		return nil, err
+	}
+	k, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || !k.Matches(secret) {
+		return nil, ErrInvalidAPIKey
+	}
+	return k, nil
+}
+
+// Revoke removes a key and disconnects gateway sessions opened with it.
+func (s *APIKeyStore) Revoke(ctx context.Context, k *APIKey) error {
+	if err := s.redis.Del(ctx, apiKeyKey(k.ID)).Err(); err != nil {
+		return err
+	}
+	publishRevocation(ctx, s.redis, Revocation{UserID: k.BotID, TokenID: k.TokenID()})
+	return nil
+}
+
+// Audit records a use of a key. The log is capped at the most recent
+// apiKeyAuditLength entries.
+func (s *APIKeyStore) Audit(ctx context.Context, keyID string, e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return s.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: apiKeyAuditKey(keyID),
+		MaxLen: apiKeyAuditLength,
+		Approx: true,
+		Values: map[string]interface{}{
+			"time":   e.Time.UnixMilli(),
+			"action": e.Action,
+			"detail": e.Detail,
+			"remote": e.RemoteAddr,
+		},
+	}).Err()
+}
+
+// AuditLog returns up to count of a key's most recent audit entries, newest
+// first.
+func (s *APIKeyStore) AuditLog(ctx context.Context, keyID string, count int64) ([]AuditEntry, error) {
+	msgs, err := s.redis.XRevRangeN(ctx, apiKeyAuditKey(keyID), "+", "-", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, 0, len(msgs))
+	for _, m := range msgs {
+		e := AuditEntry{}
+		if v, ok := m.Values["time"].(string); ok {
+			ms, _ := strconv.ParseInt(v, 10, 64)
+			e.Time = time.UnixMilli(ms)
+		}
+		e.Action, _ = m.Values["action"].(string)
+		e.Detail, _ = m.Values["detail"].(string)
+		e.RemoteAddr, _ = m.Values["remote"].(string)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
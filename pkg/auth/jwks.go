@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// Minimum time between two remote JWKS fetches triggered by unknown kids.
+const jwksRefetchInterval = 30 * time.Second
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every local asymmetric key in the set.
+// HMAC secrets are never published.
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range ks.verify {
+		if jwk, ok := toJWK(k); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+func toJWK(k *Key) (JWK, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA", Kid: k.ID, Alg: k.Method.Alg(), Use: "sig",
+			N: b64(pub.N.Bytes()),
+			E: b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case *ecdsa.PublicKey:
+		// Coordinates are fixed-width (32 bytes for P-256).
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		return JWK{
+			Kty: "EC", Kid: k.ID, Alg: k.Method.Alg(), Use: "sig",
+			Crv: "P-256", X: b64(x), Y: b64(y),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// Key converts a JWK back into a verification key.
+func (j JWK) Key() (*Key, error) {
+	dec := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch j.Kty {
+	case "RSA":
+		n, err := dec(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(j.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())})
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := dec(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(j.Kid, &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+// FetchJWKS downloads a JWKS and returns its signing keys.
+func FetchJWKS(url string) ([]*Key, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+	for _, j := range set.Keys {
+		if j.Kid == "" {
+			continue
+		}
+		k, err := j.Key()
+		if err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// NewRemoteKeySet returns a verify-only key set backed by a JWKS URL, e.g.
+// an OpenID provider's. Keys are fetched now and again whenever a token names
+// an unknown kid.
+func NewRemoteKeySet(jwksURL string) (*KeySet, error) {
+	ks := NewKeySet()
+	ks.jwksURL = jwksURL
+	if err := ks.FetchJWKS(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// FetchJWKS refreshes the key set from its configured JWKS URL.
+func (ks *KeySet) FetchJWKS() error {
+	if ks.jwksURL == "" {
+		return errors.New("no JWKS URL configured")
+	}
+
+	ks.mu.Lock()
+	ks.lastFetch = time.Now()
+	ks.mu.Unlock()
+
+	keys, err := FetchJWKS(ks.jwksURL)
+	if err != nil {
+		return err
+	}
+
+	remote := make(map[string]*Key, len(keys))
+	for _, k := range keys {
+		remote[k.ID] = k
+	}
+	ks.mu.Lock()
+	ks.remote = remote
+	ks.mu.Unlock()
+	return nil
+}
+
+// WatchJWKS refreshes the remote JWKS every interval until done is closed.
+func (ks *KeySet) WatchJWKS(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := ks.FetchJWKS(); err != nil {
+				log.Printf("Failed to refresh JWKS from %s: %v", ks.jwksURL, err)
+			}
+		}
+	}
+}
+
+// refreshRemote fetches the remote JWKS when a token names a key we do not
+// know yet, e.g. right after the issuer rotated. It is rate limited so
+// garbage kids cannot turn into a request flood.
+func (ks *KeySet) refreshRemote() bool {
+	ks.mu.RLock()
+	due := ks.jwksURL != "" && time.Since(ks.lastFetch) > jwksRefetchInterval
+	ks.mu.RUnlock()
+	if !due {
+		return false
+	}
+	return ks.FetchJWKS() == nil
+}
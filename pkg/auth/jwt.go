@@ -2,44 +2,88 @@ package auth
 
 import (
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtKey = []byte("my_secret_key") // TODO: Move to env var
+// Nothing is signed or trusted until SetKeys is called.
+var (
+	keysMu sync.RWMutex
+	keys   = NewKeySet()
+)
+
+// SetKeys replaces the key set used by GenerateToken and ValidateToken.
+func SetKeys(ks *KeySet) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	keys = ks
+}
+
+// Keys returns the key set used by GenerateToken and ValidateToken.
+func Keys() *KeySet {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return keys
+}
+
+// Token times keep microseconds, so a token issued just after RevokeUser,
+// e.g. by a password change, is told apart from the ones it revoked.
+func init() {
+	jwt.TimePrecision = time.Microsecond
+}
 
 type Claims struct {
 	UserID string `json:"user_id"`
 	jwt.RegisteredClaims
+
+	// Set when the caller authenticated with an API key instead of a token.
+	APIKey *APIKey `json:"-"`
+}
+
+// Allows reports whether the caller may use scope, on channelID if it is
+// not empty. Users may do anything their account can; API keys only what
+// they were granted.
+func (c *Claims) Allows(scope, channelID string) bool {
+	if c.APIKey == nil {
+		return true
+	}
+	if !c.APIKey.HasScope(scope) {
+		return false
+	}
+	return channelID == "" || c.APIKey.AllowsChannel(channelID)
 }
 
 type contextKey string
 
 const UserKey contextKey = "user"
 
-// GenerateToken creates a new JWT token for a given user ID
+// GenerateToken creates a short-lived access token for a given user ID. The
+// token ID lets it be revoked individually.
 func GenerateToken(userID string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := &Claims{
 		UserID: userID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return Keys().Sign(claims)
 }
 
 // ValidateToken parses and validates a JWT token
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-
+	token, err := Keys().Parse(tokenString, claims)
 	if err != nil {
 		return nil, err
 	}
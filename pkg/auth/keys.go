@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Development fallback, only used when JWT_DEV_SECRET=true. It is public,
+// so anyone could mint tokens with it.
+const devSecret = "my_secret_key"
+
+// Key is a signing or verification key. Asymmetric keys used only for
+// verification have no private half.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{} // []byte for HMAC, *rsa.PrivateKey or *ecdsa.PrivateKey
+	Public  interface{} // []byte for HMAC, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// KeySet holds the key tokens are signed with and every key tokens may be
+// verified with. Keeping the previous key in the verification set while a
+// new one signs allows rotation without invalidating live tokens.
+type KeySet struct {
+	mu      sync.RWMutex
+	signing *Key
+	verify  map[string]*Key
+
+	// Keys from a remote JWKS, e.g. the API's keys on the gateway. The map is
+	// replaced on every fetch so keys retired by the issuer stop working.
+	remote    map[string]*Key
+	jwksURL   string
+	lastFetch time.Time
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{verify: make(map[string]*Key), remote: make(map[string]*Key)}
+}
+
+// SetSigningKey makes k the key new tokens are signed with. It is also
+// trusted for verification.
+func (ks *KeySet) SetSigningKey(k *Key) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.signing = k
+	ks.verify[k.ID] = k
+}
+
+// AddVerificationKey trusts k for verification only.
+func (ks *KeySet) AddVerificationKey(k *Key) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.verify[k.ID] = k
+}
+
+// Sign signs claims with the current signing key and sets the kid header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	k := ks.signing
+	ks.mu.RUnlock()
+	if k == nil || k.Private == nil {
+		return "", errors.New("no signing key configured")
+	}
+
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.Private)
+}
+
+// Parse verifies a token against the key named by its kid header. Tokens
+// without a kid, issued before key IDs were introduced, are checked against
+// the signing key. Extra options add claim checks such as the issuer.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	opts = append([]jwt.ParserOption{jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"})}, opts...)
+	return jwt.ParseWithClaims(tokenString, claims, ks.keyFunc, opts...)
+}
+
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	k := ks.lookup(kid)
+	if k == nil && kid != "" && ks.refreshRemote() {
+		k = ks.lookup(kid)
+	}
+	if k == nil {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	// The key decides the algorithm, never the token.
+	if token.Method.Alg() != k.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+	}
+	return k.Public, nil
+}
+
+func (ks *KeySet) lookup(kid string) *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if kid == "" {
+		return ks.signing
+	}
+	if k, ok := ks.verify[kid]; ok {
+		return k
+	}
+	return ks.remote[kid]
+}
+
+// Load builds a key set from the environment:
+//
+//	JWT_ALG               HS256 (default), RS256 or ES256
+//	JWT_SECRET            HMAC secret for HS256
+//	JWT_DEV_SECRET        "true" to fall back to a public secret for local development
+//	JWT_PRIVATE_KEY_FILE  PEM private key for RS256/ES256; omit on verify-only services
+//	JWT_KEY_ID            kid of the signing key (default: derived from the public key)
+//	JWT_VERIFY_KEYS       extra trusted keys as kid=path.pem, comma-separated
+//	JWT_JWKS_URL          remote JWKS to fetch trusted keys from
+func Load() (*KeySet, error) {
+	ks := NewKeySet()
+
+	alg := os.Getenv("JWT_ALG")
+	if alg == "" {
+		alg = "HS256"
+	}
+
+	switch alg {
+	case "HS256":
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			// Verify-only services trust the configured keys and nothing else
+			if os.Getenv("JWT_VERIFY_KEYS") != "" || os.Getenv("JWT_JWKS_URL") != "" {
+				break
+			}
+			if os.Getenv("JWT_DEV_SECRET") != "true" {
+				return nil, errors.New("JWT_SECRET is not set; set it, use JWT_ALG with a key file, or set JWT_DEV_SECRET=true for local development")
+			}
+			log.Println("WARNING: JWT_SECRET is not set, using the insecure development secret")
+			secret = devSecret
+		}
+		ks.SetSigningKey(&Key{
+			ID:      os.Getenv("JWT_KEY_ID"),
+			Method:  jwt.SigningMethodHS256,
+			Private: []byte(secret),
+			Public:  []byte(secret),
+		})
+
+	case "RS256", "ES256":
+		if path := os.Getenv("JWT_PRIVATE_KEY_FILE"); path != "" {
+			k, err := LoadKeyFile(path, os.Getenv("JWT_KEY_ID"))
+			if err != nil {
+				return nil, err
+			}
+			if k.Private == nil {
+				return nil, fmt.Errorf("%s does not contain a private key", path)
+			}
+			if k.Method.Alg() != alg {
+				return nil, fmt.Errorf("%s is a %s key, but JWT_ALG is %s", path, k.Method.Alg(), alg)
+			}
+			ks.SetSigningKey(k)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALG %q", alg)
+	}
+
+	if v := os.Getenv("JWT_VERIFY_KEYS"); v != "" {
+		for _, entry := range strings.Split(v, ",") {
+			kid, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				kid, path = "", kid
+			}
+			k, err := LoadKeyFile(path, kid)
+			if err != nil {
+				return nil, err
+			}
+			ks.AddVerificationKey(k)
+		}
+	}
+
+	if url := os.Getenv("JWT_JWKS_URL"); url != "" {
+		ks.jwksURL = url
+		if err := ks.FetchJWKS(); err != nil {
+			// The issuer may simply not be up yet; unknown kids trigger a retry.
+			log.Printf("Failed to fetch JWKS from %s: %v", url, err)
+		}
+	}
+
+	return ks, nil
+}
+
+// LoadKeyFile reads an RSA or P-256 key from a PEM file. Private keys yield
+// a signing key, public keys a verification-only key. An empty kid is
+// replaced by one derived from the public key.
+func LoadKeyFile(path, kid string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	k, err := newKey(kid, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// newKey wraps a parsed RSA or ECDSA key, private or public.
+func newKey(kid string, parsed interface{}) (*Key, error) {
+	k := &Key{ID: kid}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		k.Private = parsed
+		parsed = signer.Public()
+	}
+
+	switch pub := parsed.(type) {
+	case *rsa.PublicKey:
+		k.Method = jwt.SigningMethodRS256
+		k.Public = pub
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		k.Method = jwt.SigningMethodES256
+		k.Public = pub
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if k.ID == "" {
+		der, err := x509.MarshalPKIXPublicKey(k.Public)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(der)
+		k.ID = hex.EncodeToString(sum[:8])
+	}
+	return k, nil
+}
@@ -0,0 +1,309 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Lifetime of access tokens. Kept short because they are only checked
+	// against the revocation list, not looked up.
+	AccessTokenTTL = 15 * time.Minute
+
+	// Lifetime of refresh tokens. Each use rotates the token.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+
+	// Longest lifetime any access token can have, including the 24h tokens
+	// issued before refresh tokens existed. Revocations are kept this long.
+	maxAccessTokenTTL = 24 * time.Hour
+
+	// Redis pub/sub channel announcing revocations to live gateways.
+	RevocationChannel = "auth:revocations"
+)
+
+var ErrRevoked = errors.New("token has been revoked")
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// Redis layout:
+//
+//	revoked:jti:{jti}          access token revoked until it would have expired
+//	revoked:user:{uid}         unix time in seconds, with microseconds; access tokens issued earlier are revoked
+//	refresh_epoch:{uid}        unix ms; refresh families created earlier are revoked
+//	refresh:{hash}             hash {user_id, family, created} of a live refresh token
+//	refresh_used:{hash}        family of an already rotated refresh token
+//	refresh_family:{family}    set of live token hashes in a rotation family
+//	refresh_families:{uid}     set of a user's families
+//
+// Refresh tokens are stored hashed. A rotated token that shows up again means
+// it was stolen, so the whole family is revoked.
+
+// TokenPair is what clients receive on login and refresh. The access token
+// keeps the "token" field name older clients already read.
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	UserID       string `json:"user_id"`
+}
+
+// Revocation is published when tokens are revoked so gateways can drop the
+// affected sockets. An empty TokenID means every session of the user.
+type Revocation struct {
+	UserID  string `json:"user_id"`
+	TokenID string `json:"token_id,omitempty"`
+}
+
+// Sessions issues token pairs and tracks revocations in Redis.
+type Sessions struct {
+	redis *redis.Client
+}
+
+func NewSessions(rdb *redis.Client) *Sessions {
+	return &Sessions{redis: rdb}
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue starts a new session: an access token and a refresh token in a new
+// rotation family.
+func (s *Sessions) Issue(ctx context.Context, userID string) (*TokenPair, error) {
+	family, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	created := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return s.issue(ctx, userID, family, created)
+}
+
+// issue mints a pair in the given family. The family is re-added to the
+// user's set on every rotation so RevokeUser still finds families that are
+// kept alive only by refreshes.
+func (s *Sessions) issue(ctx context.Context, userID, family, created string) (*TokenPair, error) {
+	access, err := GenerateToken(userID)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashToken(refresh)
+	pipe := s.redis.TxPipeline()
+	pipe.HSet(ctx, "refresh:"+hash, "user_id", userID, "family", family, "created", created)
+	pipe.Expire(ctx, "refresh:"+hash, RefreshTokenTTL)
+	pipe.SAdd(ctx, "refresh_family:"+family, hash)
+	pipe.Expire(ctx, "refresh_family:"+family, RefreshTokenTTL)
+	pipe.SAdd(ctx, "refresh_families:"+userID, family)
+	pipe.Expire(ctx, "refresh_families:"+userID, RefreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(AccessTokenTTL.Seconds()),
+		UserID:       userID,
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new pair. The presented token is
+// consumed; presenting it again revokes the whole family.
+func (s *Sessions) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	hash := hashToken(refreshToken)
+
+	vals, err := s.redis.HGetAll(ctx, "refresh:"+hash).Result()
+	if err != nil {
+		return nil, err
+	}
+	userID, family, created := vals["user_id"], vals["family"], vals["created"]
+	if userID == "" {
+		if family, err := s.redis.Get(ctx, "refresh_used:"+hash).Result(); err == nil {
+			log.Printf("Refresh token reuse detected, revoking family %s", family)
+			s.revokeFamily(ctx, family)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Only one of two concurrent refreshes with the same token wins the
+	// delete; the other is treated as reuse.
+	deleted, err := s.redis.Del(ctx, "refresh:"+hash).Result()
+	if err != nil {
+		return nil, err
+	}
+	if deleted == 0 {
+		s.revokeFamily(ctx, family)
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Backstop for families RevokeUser could not reach. Families without a
+	// creation time predate the epoch and are revoked too.
+	epoch, err := s.redis.Get(ctx, "refresh_epoch:"+userID).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if err == nil {
+		if since, perr := strconv.ParseInt(created, 10, 64); perr != nil || since < epoch {
+			s.revokeFamily(ctx, family)
+			return nil, ErrInvalidRefreshToken
+		}
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, "refresh_used:"+hash, family, RefreshTokenTTL)
+	pipe.SRem(ctx, "refresh_family:"+family, hash)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return s.issue(ctx, userID, family, created)
+}
+
+// revokeFamily deletes every live refresh token of a rotation family.
+func (s *Sessions) revokeFamily(ctx context.Context, family string) {
+	hashes, err := s.redis.SMembers(ctx, "refresh_family:"+family).Result()
+	if err != nil {
+		log.Printf("Failed to load refresh family %s: %v", family, err)
+		return
+	}
+	keys := []string{"refresh_family:" + family}
+	for _, h := range hashes {
+		keys = append(keys, "refresh:"+h)
+	}
+	if err := s.redis.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Failed to revoke refresh family %s: %v", family, err)
+	}
+}
+
+// Logout revokes one session: its access token and, if given, the refresh
+// token family it belongs to.
+func (s *Sessions) Logout(ctx context.Context, claims *Claims, refreshToken string) error {
+	if refreshToken != "" {
+		hash := hashToken(refreshToken)
+		vals, err := s.redis.HGetAll(ctx, "refresh:"+hash).Result()
+		if err != nil {
+			return err
+		}
+		// Users can only end their own sessions.
+		if vals["user_id"] == claims.UserID {
+			s.revokeFamily(ctx, vals["family"])
+		}
+	}
+
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		if ttl := time.Until(claims.ExpiresAt.Time); ttl > 0 {
+			if err := s.redis.Set(ctx, "revoked:jti:"+claims.ID, 1, ttl).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.publish(ctx, Revocation{UserID: claims.UserID, TokenID: claims.ID})
+	return nil
+}
+
+// RevokeUser ends every session of a user, e.g. after a password change.
+// Tokens issued afterwards are unaffected.
+func (s *Sessions) RevokeUser(ctx context.Context, userID string) error {
+	now := time.Now()
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, "revoked:user:"+userID, unixSeconds(now), maxAccessTokenTTL)
+	pipe.Set(ctx, "refresh_epoch:"+userID, now.UnixMilli(), RefreshTokenTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	families, err := s.redis.SMembers(ctx, "refresh_families:"+userID).Result()
+	if err != nil {
+		return err
+	}
+	for _, family := range families {
+		s.revokeFamily(ctx, family)
+	}
+	s.redis.Del(ctx, "refresh_families:"+userID)
+
+	s.publish(ctx, Revocation{UserID: userID})
+	return nil
+}
+
+// IsRevoked reports whether a validated token has been revoked.
+func (s *Sessions) IsRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	pipe := s.redis.Pipeline()
+	var jti *redis.IntCmd
+	if claims.ID != "" {
+		jti = pipe.Exists(ctx, "revoked:jti:"+claims.ID)
+	}
+	user := pipe.Get(ctx, "revoked:user:"+claims.UserID)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return false, err
+	}
+
+	if jti != nil && jti.Val() > 0 {
+		return true, nil
+	}
+	if since, err := user.Float64(); err == nil {
+		// Tokens without iat predate refresh tokens and are revoked too.
+		// Tokens from before iat had microseconds are cut to the second, so
+		// those issued in the second of a revocation are revoked with it.
+		if claims.IssuedAt == nil || unixSeconds(claims.IssuedAt.Time) < since {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Validate checks a token's signature and expiry, then the revocation list.
+// Redis errors fail closed.
+func (s *Sessions) Validate(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := s.IsRevoked(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrRevoked
+	}
+	return claims, nil
+}
+
+func (s *Sessions) publish(ctx context.Context, rev Revocation) {
+	publishRevocation(ctx, s.redis, rev)
+}
+
+func publishRevocation(ctx context.Context, rdb *redis.Client, rev Revocation) {
+	payload, _ := json.Marshal(rev)
+	if err := rdb.Publish(ctx, RevocationChannel, payload).Err(); err != nil {
+		log.Printf("Failed to publish revocation for %s: %v", rev.UserID, err)
+	}
+}
+
+// unixSeconds returns t as fractional unix seconds, to the microsecond.
+// Revocations stored as whole seconds before it existed read the same way.
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixMicro()) / 1e6
+}
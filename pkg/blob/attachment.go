@@ -0,0 +1,38 @@
+package blob
+
+import (
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+// Attachments are stored as
+//
+//	attachments/{id}/original
+//	attachments/{id}/thumbnail   images only
+//
+// The API also records each upload in Redis, under UploadKey, so that the
+// gateway, which has no database, can check that the attachments of a
+// message were uploaded to its channel by its sender.
+
+// UploadTTL is how long an upload can be referenced by new messages.
+const UploadTTL = 24 * time.Hour
+
+// Upload is the Redis record of an uploaded attachment.
+type Upload struct {
+	model.Attachment
+	ChannelID  string `json:"channel_id"`
+	UploaderID string `json:"uploader_id"`
+}
+
+func UploadKey(id string) string {
+	return "attachment:" + id
+}
+
+func OriginalKey(id string) string {
+	return "attachments/" + id + "/original"
+}
+
+func ThumbnailKey(id string) string {
+	return "attachments/" + id + "/thumbnail"
+}
@@ -0,0 +1,72 @@
+// Package blob stores uploaded files. Attachments are written through a
+// Store, which is either a local directory or an S3-compatible bucket
+// (AWS S3, MinIO).
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Info describes a stored blob.
+type Info struct {
+	Size        int64
+	ContentType string
+}
+
+// Store is a flat key/value store for blobs. Keys are slash-separated paths
+// such as "attachments/{id}/original".
+type Store interface {
+	// Put stores size bytes from r under key, replacing any existing blob.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get opens a blob. The caller must close it. Missing blobs return
+	// ErrNotFound.
+	Get(ctx context.Context, key string) (io.ReadCloser, *Info, error)
+
+	Delete(ctx context.Context, key string) error
+}
+
+// validKey rejects keys that could escape the store's root.
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("blob: invalid key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("blob: invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+// FromEnv opens the store configured by BLOB_STORE: "local" (the default),
+// using the directory BLOB_DIR, or "s3", configured by S3_ENDPOINT,
+// S3_BUCKET, S3_REGION, S3_ACCESS_KEY, S3_SECRET_KEY and S3_INSECURE.
+func FromEnv(ctx context.Context) (Store, error) {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		return NewLocal(dir)
+	case "s3":
+		return NewS3(ctx, S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Insecure:  os.Getenv("S3_INSECURE") == "true",
+		})
+	default:
+		return nil, fmt.Errorf("blob: unknown BLOB_STORE %q, expected local or s3", kind)
+	}
+}
@@ -0,0 +1,196 @@
+// Package bot is a small SDK for bots. A bot connects to the gateway with an
+// API key, reads the channel's messages and posts its own; bots that serve
+// slash commands answer the gateway's signed HTTP requests with
+// CommandHandler.
+//
+//	err := bot.Run(ctx, "ws://localhost:8080/ws", apiKey, "general", func(c *bot.Conn, msg *model.Message) {
+//		if msg.Type == model.TypeMessage && msg.Content == "ping" {
+//			c.Send("pong")
+//		}
+//	})
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+const (
+	writeWait = 10 * time.Second
+
+	// Reconnect backoff bounds used by Run.
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// ErrUnauthorized means the gateway rejected the credential or revoked it.
+// Reconnecting will not help.
+var ErrUnauthorized = errors.New("bot: credential rejected by the gateway")
+
+// Conn is a connection to one channel.
+type Conn struct {
+	ws      *websocket.Conn
+	channel string
+
+	// Serializes writes; gorilla allows one concurrent writer.
+	mu sync.Mutex
+
+	// Messages decoded from the last frame but not yet returned by Read.
+	pending []*model.Message
+}
+
+// Dial connects to the gateway at gatewayURL (e.g. "ws://localhost:8080/ws")
+// with an API key or access token.
+func Dial(ctx context.Context, gatewayURL, credential, channel string) (*Conn, error) {
+	u, err := url.Parse(gatewayURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("channel", channel)
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+credential)
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, ErrUnauthorized
+		}
+		return nil, err
+	}
+	return &Conn{ws: ws, channel: channel}, nil
+}
+
+// Channel returns the channel the connection is in.
+func (c *Conn) Channel() string {
+	return c.channel
+}
+
+// Send posts a message to the channel. Text starting with "/" runs a slash
+// command; start it with "//" to post a literal "/".
+func (c *Conn) Send(text string) error {
+	return c.write(map[string]string{"type": string(model.TypeMessage), "content": text})
+}
+
+// Edit replaces the content of one of the bot's earlier messages.
+func (c *Conn) Edit(messageID int64, text string) error {
+	return c.write(map[string]any{"type": string(model.TypeEdit), "content": text, "target_id": messageID})
+}
+
+// Typing shows or clears the bot's typing indicator.
+func (c *Conn) Typing(typing bool) error {
+	state := model.TypingStop
+	if typing {
+		state = model.TypingStart
+	}
+	return c.write(map[string]string{"type": string(model.TypeTyping), "content": state})
+}
+
+func (c *Conn) write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Read returns the next event from the channel: messages, presence, typing,
+// edits and the ephemeral replies to the bot's own commands.
+func (c *Conn) Read() (*model.Message, error) {
+	for len(c.pending) == 0 {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				return nil, ErrUnauthorized
+			}
+			return nil, err
+		}
+
+		// The gateway may pack several queued messages into one frame.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var msg model.Message
+			if err := dec.Decode(&msg); err != nil {
+				if !errors.Is(err, io.EOF) {
+					return nil, fmt.Errorf("bot: decoding message: %w", err)
+				}
+				break
+			}
+			c.pending = append(c.pending, &msg)
+		}
+	}
+	msg := c.pending[0]
+	c.pending = c.pending[1:]
+	return msg, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+	c.mu.Unlock()
+	return c.ws.Close()
+}
+
+// Handler is called for every event Run reads. Events from the bot itself
+// are included.
+type Handler func(c *Conn, msg *model.Message)
+
+// Run keeps a connection to channel open and calls handle for each event
+// until ctx is done or the credential is rejected. Dropped connections,
+// including gateways restarting, are retried with backoff.
+func Run(ctx context.Context, gatewayURL, credential, channel string, handle Handler) error {
+	backoff := minBackoff
+	for {
+		conn, err := Dial(ctx, gatewayURL, credential, channel)
+		if err == nil {
+			backoff = minBackoff
+			err = serve(ctx, conn, handle)
+		}
+		if errors.Is(err, ErrUnauthorized) || ctx.Err() != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func serve(ctx context.Context, conn *Conn, handle Handler) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.ws.Close()
+
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return err
+		}
+		handle(conn, msg)
+	}
+}
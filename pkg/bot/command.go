@@ -0,0 +1,93 @@
+package bot
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/webhook"
+)
+
+// How a command response is shown.
+const (
+	// Only the user who ran the command sees the response. This is the
+	// default.
+	ResponseEphemeral = "ephemeral"
+
+	// The response is posted to the channel for everyone.
+	ResponseInChannel = "in_channel"
+)
+
+// Maximum size of a command invocation or response body.
+const maxCommandBody = 64 << 10
+
+// CommandRequest is what the gateway POSTs to a command's URL when a user
+// runs it. The body is signed like outgoing webhooks, with the secret
+// returned when the command was registered.
+type CommandRequest struct {
+	Command   string    `json:"command"`
+	Text      string    `json:"text"`
+	UserID    string    `json:"user_id"`
+	ChannelID string    `json:"channel_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// CommandResponse is what a command's URL replies with. An empty Text sends
+// nothing back.
+type CommandResponse struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type,omitempty"`
+}
+
+// CommandFunc handles one invocation.
+type CommandFunc func(req *CommandRequest) *CommandResponse
+
+// Ephemeral is a response only the caller sees.
+func Ephemeral(text string) *CommandResponse {
+	return &CommandResponse{Text: text, ResponseType: ResponseEphemeral}
+}
+
+// InChannel is a response posted to the channel.
+func InChannel(text string) *CommandResponse {
+	return &CommandResponse{Text: text, ResponseType: ResponseInChannel}
+}
+
+// CommandHandler serves a registered command. Requests without a valid
+// signature are rejected. The gateway waits a few seconds for the response,
+// so slow work should be started in the background and its result posted
+// with a Conn or an incoming webhook.
+func CommandHandler(secret string, fn CommandFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCommandBody))
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := webhook.Verify(secret, r.Header.Get(webhook.HeaderSignature), body, webhook.DefaultTolerance); err != nil {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		var req CommandRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		resp := fn(&req)
+		if resp == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			log.Printf("Failed to write response to /%s: %v", req.Command, err)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+// Package commands stores the slash commands served by external bots. The
+// API registers them and the gateway looks them up when a message starting
+// with "/" names a command it does not implement itself.
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis layout:
+//
+//	command:{name}  JSON Registration
+//	commands        set of registered names
+
+const indexKey = "commands"
+
+// Builtins are implemented by the gateway and cannot be registered. The
+// gateway lists them with these usage lines and refuses to start if it does
+// not implement exactly these.
+var Builtins = map[string]string{
+	"help":   "/help - list commands",
+	"me":     "/me <action> - post an action, e.g. /me waves",
+	"topic":  "/topic [text] - show or set the channel topic",
+	"invite": "/invite <user> - invite a user to this channel",
+	"mute":   "/mute [duration] - mute this channel, e.g. /mute 2h",
+	"unmute": "/unmute - unmute this channel",
+	"notify": "/notify [all|mentions|none] - show or set what in this channel notifies you",
+}
+
+var (
+	ErrNotFound    = errors.New("command not found")
+	ErrTaken       = errors.New("command name is already taken")
+	ErrInvalidName = errors.New("command names are 1-32 lowercase letters, digits, '-' or '_'")
+)
+
+var namePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// Registration is an external command. The gateway POSTs invocations to URL
+// signed with Secret.
+type Registration struct {
+	Name        string    `json:"name"`
+	URL         string    `json:"url"`
+	Description string    `json:"description"`
+	OwnerID     string    `json:"owner_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	// Only returned when the command is registered.
+	Secret string `json:"secret,omitempty"`
+}
+
+func Key(name string) string {
+	return "command:" + name
+}
+
+// ValidName reports whether name can be registered.
+func ValidName(name string) error {
+	if !namePattern.MatchString(name) {
+		return ErrInvalidName
+	}
+	if _, ok := Builtins[name]; ok {
+		return ErrTaken
+	}
+	return nil
+}
+
+// Save registers a command. Names are first come, first served.
+func Save(ctx context.Context, rdb *redis.Client, r *Registration) error {
+	if err := ValidName(r.Name); err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ok, err := rdb.SetNX(ctx, Key(r.Name), data, 0).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTaken
+	}
+	return rdb.SAdd(ctx, indexKey, r.Name).Err()
+}
+
+// Get returns a registered command, or ErrNotFound.
+func Get(ctx context.Context, rdb *redis.Client, name string) (*Registration, error) {
+	data, err := rdb.Get(ctx, Key(name)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r Registration
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// List returns every registered command without secrets.
+func List(ctx context.Context, rdb *redis.Client) ([]Registration, error) {
+	names, err := rdb.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := []Registration{}
+	for _, name := range names {
+		r, err := Get(ctx, rdb, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Secret = ""
+		list = append(list, *r)
+	}
+	return list, nil
+}
+
+// Delete removes a command.
+func Delete(ctx context.Context, rdb *redis.Client, name string) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, Key(name))
+		pipe.SRem(ctx, indexKey, name)
+		return nil
+	})
+	return err
+}
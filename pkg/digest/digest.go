@@ -0,0 +1,215 @@
+// Package digest stores users' e-mail digest settings. The API edits them;
+// the notifier sends digests of unread DMs and mentions to users who have
+// been offline for a while.
+//
+// Every digest carries an unsubscribe link signed with a secret shared by
+// the notifier and the API, so it works without logging in. Digests are
+// only sent to addresses confirmed through a link the API mails, signed
+// with the same secret.
+package digest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// How often a user gets a digest.
+const (
+	FrequencyOff    = "off"
+	FrequencyHourly = "hourly"
+	FrequencyDaily  = "daily"
+	FrequencyWeekly = "weekly"
+)
+
+var periods = map[string]time.Duration{
+	FrequencyHourly: time.Hour,
+	FrequencyDaily:  24 * time.Hour,
+	FrequencyWeekly: 7 * 24 * time.Hour,
+}
+
+// Period returns the time between digests of a frequency, or 0 for
+// FrequencyOff and unknown frequencies.
+func Period(frequency string) time.Duration {
+	return periods[frequency]
+}
+
+// ValidFrequency reports whether frequency is one of the Frequency constants.
+func ValidFrequency(frequency string) bool {
+	return frequency == FrequencyOff || periods[frequency] > 0
+}
+
+var ErrNotFound = errors.New("digest settings not found")
+
+type Settings struct {
+	UserID    string `json:"-"`
+	Email     string `json:"email"`
+	Frequency string `json:"frequency"`
+
+	// A digest covers what happened since the previous one, or since the
+	// settings were saved.
+	LastSentAt time.Time `json:"last_sent_at"`
+
+	// Whether the user confirmed Email through the link mailed to it.
+	// Digests are only sent to confirmed addresses.
+	Confirmed bool `json:"confirmed"`
+
+	// When the last confirmation mail was sent, to Email.
+	ConfirmationSentAt time.Time `json:"-"`
+}
+
+const columns = `user_id, email, frequency, last_sent_at, confirmed_email, confirmation_sent_at`
+
+// dest returns where a row of columns is scanned into.
+func (s *Settings) dest(confirmedEmail *string) []interface{} {
+	return []interface{}{&s.UserID, &s.Email, &s.Frequency, &s.LastSentAt, confirmedEmail, &s.ConfirmationSentAt}
+}
+
+// Get returns a user's settings.
+func Get(session *db.Session, userID string) (*Settings, error) {
+	s := new(Settings)
+	var confirmedEmail string
+	err := session.Query(`SELECT `+columns+` FROM email_digests WHERE user_id = ?`, userID).Scan(s.dest(&confirmedEmail)...)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Confirmed = s.Email != "" && confirmedEmail == s.Email
+	return s, nil
+}
+
+// List returns the settings of every user who gets digests: their
+// frequency is not off and they confirmed their address.
+func List(session *db.Session) ([]*Settings, error) {
+	var all []*Settings
+	iter := session.Query(`SELECT ` + columns + ` FROM email_digests`).Iter()
+	for {
+		s := new(Settings)
+		var confirmedEmail string
+		if !iter.Scan(s.dest(&confirmedEmail)...) {
+			break
+		}
+		s.Confirmed = s.Email != "" && confirmedEmail == s.Email
+		if s.Frequency != FrequencyOff && s.Confirmed {
+			all = append(all, s)
+		}
+	}
+	return all, iter.Close()
+}
+
+// Save stores a user's settings. The confirmed address is kept, so going
+// back to it does not need another confirmation.
+func Save(session *db.Session, s *Settings) error {
+	return session.Query(`INSERT INTO email_digests (user_id, email, frequency, last_sent_at) VALUES (?, ?, ?, ?)`,
+		s.UserID, s.Email, s.Frequency, s.LastSentAt).Exec()
+}
+
+// ConfirmedAddress returns the last address the user confirmed, or "" if
+// they never confirmed one. It is the only address known to be theirs.
+func ConfirmedAddress(session *db.Session, userID string) (string, error) {
+	var email string
+	err := session.Query(`SELECT confirmed_email FROM email_digests WHERE user_id = ?`, userID).Scan(&email)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return "", nil
+	}
+	return email, err
+}
+
+// ConfirmationSent records when a confirmation mail was last sent.
+func ConfirmationSent(session *db.Session, userID string, sentAt time.Time) error {
+	return session.Query(`UPDATE email_digests SET confirmation_sent_at = ? WHERE user_id = ?`, sentAt, userID).Exec()
+}
+
+// Confirm marks email as the user's confirmed address, reporting false if
+// their settings no longer use it.
+func Confirm(session *db.Session, userID, email string) (bool, error) {
+	return session.Query(`UPDATE email_digests SET confirmed_email = ? WHERE user_id = ? IF email = ?`,
+		email, userID, email).MapScanCAS(map[string]interface{}{})
+}
+
+// Unsubscribe turns a user's digests off.
+func Unsubscribe(session *db.Session, userID string) error {
+	return session.Query(`UPDATE email_digests SET frequency = ? WHERE user_id = ? IF EXISTS`, FrequencyOff, userID).Exec()
+}
+
+// Claim moves a user's last digest to now, reporting false if another
+// notifier replica already did. s.LastSentAt must be what was read.
+func Claim(session *db.Session, s *Settings, now time.Time) (bool, error) {
+	return session.Query(`UPDATE email_digests SET last_sent_at = ? WHERE user_id = ? IF last_sent_at = ?`,
+		now, s.UserID, s.LastSentAt).MapScanCAS(map[string]interface{}{})
+}
+
+// Release undoes a Claim made at claimedAt, so a digest that could not be
+// sent is tried again.
+func Release(session *db.Session, s *Settings, claimedAt time.Time) error {
+	_, err := session.Query(`UPDATE email_digests SET last_sent_at = ? WHERE user_id = ? IF last_sent_at = ?`,
+		s.LastSentAt, s.UserID, claimedAt).MapScanCAS(map[string]interface{}{})
+	return err
+}
+
+// Development fallback, only used when DIGEST_DEV_SECRET=true. It is
+// public, so anyone could unsubscribe users or confirm addresses with it.
+const devSecret = "dev-digest-secret"
+
+// LoadSecret returns the secret that signs unsubscribe and confirmation
+// links, from DIGEST_SECRET. Without it, DIGEST_DEV_SECRET=true falls back
+// to the development secret; otherwise it is an error.
+func LoadSecret() ([]byte, error) {
+	if secret := os.Getenv("DIGEST_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	if os.Getenv("DIGEST_DEV_SECRET") != "true" {
+		return nil, errors.New("DIGEST_SECRET is not set; set it, or set DIGEST_DEV_SECRET=true for local development")
+	}
+	log.Println("WARNING: DIGEST_SECRET is not set, using the insecure development secret")
+	return []byte(devSecret), nil
+}
+
+// UnsubscribeToken signs a user ID for unsubscribe links.
+func UnsubscribeToken(secret []byte, userID string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("unsubscribe\x00" + userID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyUnsubscribe checks a token made by UnsubscribeToken.
+func VerifyUnsubscribe(secret []byte, userID, token string) bool {
+	return hmac.Equal([]byte(token), []byte(UnsubscribeToken(secret, userID)))
+}
+
+// UnsubscribeURL is the link in a user's digests, served by the API at
+// baseURL.
+func UnsubscribeURL(baseURL string, secret []byte, userID string) string {
+	q := url.Values{"user": {userID}, "token": {UnsubscribeToken(secret, userID)}}
+	return baseURL + "/digest/unsubscribe?" + q.Encode()
+}
+
+// ConfirmToken signs a user ID and the address they want digests at for
+// confirmation links.
+func ConfirmToken(secret []byte, userID, email string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("confirm\x00" + userID + "\x00" + email))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyConfirm checks a token made by ConfirmToken.
+func VerifyConfirm(secret []byte, userID, email, token string) bool {
+	return hmac.Equal([]byte(token), []byte(ConfirmToken(secret, userID, email)))
+}
+
+// ConfirmURL is the link in a confirmation mail, served by the API at
+// baseURL.
+func ConfirmURL(baseURL string, secret []byte, userID, email string) string {
+	q := url.Values{"user": {userID}, "email": {email}, "token": {ConfirmToken(secret, userID, email)}}
+	return baseURL + "/digest/confirm?" + q.Encode()
+}
@@ -0,0 +1,56 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// Mailer sends e-mail through an SMTP server. The notifier sends digests
+// with it, and the API confirmation and password reset mails.
+type Mailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewMailer logs in with username and password if username is set.
+func NewMailer(addr, from, username, password string) *Mailer {
+	m := &Mailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// From is the address mail is sent from.
+func (m *Mailer) From() string {
+	return m.from
+}
+
+func (m *Mailer) Send(to string, msg []byte) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, msg)
+}
+
+// SendText sends a plain-text mail.
+func (m *Mailer) SendText(to, subject, body string) error {
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@chat>\r\n", hex.EncodeToString(id))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+	return m.Send(to, msg.Bytes())
+}
@@ -0,0 +1,86 @@
+// Package mention finds @mentions in message content. The messaging service
+// parses every message it stores, keeps the mentions on the message, and
+// notifies the users they reach.
+package mention
+
+import (
+	"strings"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+// Names that mention more than one user. Nobody can be mentioned by these.
+const (
+	Channel = "channel"
+	Here    = "here"
+)
+
+// Usernames are 3-32 characters; see the API's registration.
+const (
+	minName = 3
+	maxName = 32
+)
+
+func nameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-'
+}
+
+// Parse returns the mentions in content, in order. A mention is an @ that
+// starts the content or follows a character that cannot be in a name, so
+// e-mail addresses are not mentions. Names are matched case-insensitively,
+// and a trailing '.' or '-' ends the sentence rather than the name.
+// Whether a mentioned user exists is up to the caller.
+func Parse(content string) []model.Mention {
+	var mentions []model.Mention
+	for i := 0; i < len(content); i++ {
+		if content[i] != '@' || (i > 0 && nameChar(content[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(content) && nameChar(content[end]) {
+			end++
+		}
+		for end > i+1 && (content[end-1] == '.' || content[end-1] == '-') {
+			end--
+		}
+
+		name := strings.ToLower(content[i+1 : end])
+		m := model.Mention{Offset: i, Length: end - i}
+		switch {
+		case name == Channel:
+			m.Type = model.MentionChannel
+		case name == Here:
+			m.Type = model.MentionHere
+		case len(name) >= minName && len(name) <= maxName:
+			m.Type, m.UserID = model.MentionUser, name
+		default:
+			continue
+		}
+		mentions = append(mentions, m)
+		i = end - 1
+	}
+	return mentions
+}
+
+// Users returns the users mentioned by name, each once.
+func Users(mentions []model.Mention) []string {
+	var users []string
+	seen := make(map[string]bool)
+	for _, m := range mentions {
+		if m.Type == model.MentionUser && !seen[m.UserID] {
+			seen[m.UserID] = true
+			users = append(users, m.UserID)
+		}
+	}
+	return users
+}
+
+// Has reports whether any of mentions is of type t.
+func Has(mentions []model.Mention, t model.MentionType) bool {
+	for _, m := range mentions {
+		if m.Type == t {
+			return true
+		}
+	}
+	return false
+}
@@ -9,8 +9,59 @@ const (
 	TypeTyping      MessageType = "typing"
 	TypePresence    MessageType = "presence"
 	TypeReadReceipt MessageType = "read_receipt"
+	TypeStatus      MessageType = "status"
+	TypeEdit        MessageType = "edit"
+	TypeTopic       MessageType = "topic"
+	TypeInvite      MessageType = "invite"
+
+	// Sent by the messaging service when messages are deleted by a retention
+	// policy. TargetID is the expired message, or with Content ExpireBefore
+	// the newest of all expired messages of the channel.
+	TypeExpire MessageType = "expire"
+
+	// Reminds UserID of message TargetID in TargetChannelID. Sent to the
+	// user's own channel (see UserChannel) when a reminder comes due.
+	TypeReminder MessageType = "reminder"
+
+	// Sent by the API when UserID pins or unpins message TargetID.
+	TypePin   MessageType = "pin"
+	TypeUnpin MessageType = "unpin"
+
+	// Tells a user they were mentioned in message TargetID of
+	// TargetChannelID. UserID is the author and Content the message. Sent to
+	// the user's own channel by the messaging service.
+	TypeMention MessageType = "mention"
+
+	// Sent by the messaging service once it applied an edit by the
+	// message's author. TargetID is the edited message, UserID its author
+	// and Content the new content. Clients only ever see these: TypeEdit
+	// requests are not fanned out, since nothing has checked them yet.
+	TypeEdited MessageType = "edited"
+
+	// Replies to slash commands. They are only ever sent to the caller's
+	// connection and never go through Kafka.
+	TypeEphemeral MessageType = "ephemeral"
+)
+
+// Content of TypeTyping messages.
+const (
+	TypingStart = "start"
+	TypingStop  = "stop"
 )
 
+// UserChannelPrefix starts the channel IDs of events for a single user.
+// Gateways deliver them to every connection of the user, whatever channel it
+// is on; clients cannot join or post to them.
+const UserChannelPrefix = "user:"
+
+// UserChannel returns the channel of events for one user.
+func UserChannel(userID string) string {
+	return UserChannelPrefix + userID
+}
+
+// Content of TypeExpire messages that remove every message up to TargetID.
+const ExpireBefore = "before"
+
 type Message struct {
 	ID        int64       `json:"id"`
 	ChannelID string      `json:"channel_id"`
@@ -18,4 +69,72 @@ type Message struct {
 	Content   string      `json:"content"`
 	Type      MessageType `json:"type"`
 	Timestamp time.Time   `json:"timestamp"`
+	Status    *UserStatus `json:"status,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+
+	// Message an edit applies to.
+	TargetID int64 `json:"target_id,omitempty"`
+
+	// Channel of TargetID, when it is not ChannelID.
+	TargetChannelID string `json:"target_channel_id,omitempty"`
+
+	// Name shown instead of UserID, e.g. set by incoming webhooks.
+	DisplayName string `json:"display_name,omitempty"`
+
+	// Set on messages posted by integrations rather than a person. Their
+	// DisplayName is chosen by the integration, so clients should label
+	// them.
+	Bot bool `json:"bot,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Set by the messaging service when it stores the message.
+	Mentions []Mention `json:"mentions,omitempty"`
+}
+
+type MentionType string
+
+const (
+	MentionUser MentionType = "user"
+
+	// Everyone in the channel, and everyone currently in the channel.
+	MentionChannel MentionType = "channel"
+	MentionHere    MentionType = "here"
+)
+
+// Mention is an @mention in a message's content. Offset and Length are in
+// bytes and include the @.
+type Mention struct {
+	Type   MentionType `json:"type"`
+	UserID string      `json:"user_id,omitempty"`
+	Offset int         `json:"offset"`
+	Length int         `json:"length"`
+}
+
+// Attachment is a file uploaded to a channel through the API, or a card
+// posted by an incoming webhook. Files have an ID and are served at
+// /attachments/{id}, and images also at /attachments/{id}/thumbnail. Cards
+// have no ID and only the card fields.
+type Attachment struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+
+	// Set for images.
+	Width     int  `json:"width,omitempty"`
+	Height    int  `json:"height,omitempty"`
+	Thumbnail bool `json:"thumbnail,omitempty"`
+
+	// Set for cards.
+	Title     string            `json:"title,omitempty"`
+	TitleLink string            `json:"title_link,omitempty"`
+	Text      string            `json:"text,omitempty"`
+	Fields    []AttachmentField `json:"fields,omitempty"`
+}
+
+// AttachmentField is a labelled value on a card.
+type AttachmentField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
 }
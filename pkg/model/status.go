@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+type Status string
+
+const (
+	StatusOnline  Status = "online"
+	StatusAway    Status = "away"
+	StatusDND     Status = "dnd"
+	StatusOffline Status = "offline"
+)
+
+// UserStatus is a user's global status, independent of any channel.
+// LastSeen is only set for offline users.
+type UserStatus struct {
+	UserID   string     `json:"user_id"`
+	Status   Status     `json:"status"`
+	Text     string     `json:"text,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
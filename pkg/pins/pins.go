@@ -0,0 +1,75 @@
+// Package pins keeps each channel's pinned messages and their count. The API
+// pins and unpins; the messaging service unpins the messages it removes.
+package pins
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// Max is the maximum number of pinned messages per channel.
+const Max = 50
+
+// Times a change of a channel's pin count is retried when other pins and
+// unpins of the channel change it at the same time.
+const countAttempts = 10
+
+var ErrTooMany = errors.New("too many pinned messages")
+
+// Count adds delta to the channel's pin count, or returns ErrTooMany if that
+// would take it over Max. The count is changed with a lightweight
+// transaction that only applies if nobody changed it since it was read, so
+// concurrent pins cannot both take the last one. Channels pinned before the
+// count existed start from their pins.
+func Count(session *db.Session, channelID string, delta int) error {
+	for attempt := 0; attempt < countAttempts; attempt++ {
+		var pins int
+		err := session.Query(`SELECT pins FROM channel_pin_counts WHERE channel_id = ?`, channelID).Scan(&pins)
+		if errors.Is(err, gocql.ErrNotFound) {
+			if err := session.Query(`SELECT COUNT(*) FROM channel_pins WHERE channel_id = ?`, channelID).Scan(&pins); err != nil {
+				return err
+			}
+			if _, err := session.Query(`INSERT INTO channel_pin_counts (channel_id, pins) VALUES (?, ?) IF NOT EXISTS`, channelID, pins).MapScanCAS(map[string]interface{}{}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		next := pins + delta
+		if delta > 0 && next > Max {
+			return ErrTooMany
+		}
+		if next < 0 {
+			next = 0
+		}
+		applied, err := session.Query(`UPDATE channel_pin_counts SET pins = ? WHERE channel_id = ? IF pins = ?`, next, channelID, pins).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+	}
+	return errors.New("pin count of " + channelID + " kept changing")
+}
+
+// Remove unpins a message and gives its pin back to the channel. It reports
+// whether the message was pinned; only the caller that removed the pin
+// changes the count, so unpinning a message twice at once counts it once. An
+// error with true means the pin is gone but the count was not changed.
+func Remove(session *db.Session, channelID string, messageID int64) (bool, error) {
+	applied, err := session.Query(`DELETE FROM channel_pins WHERE channel_id = ? AND message_id = ? IF EXISTS`, channelID, messageID).MapScanCAS(map[string]interface{}{})
+	if err != nil || !applied {
+		return false, err
+	}
+	if err := Count(session, channelID, -1); err != nil {
+		return true, fmt.Errorf("count pins of %s: %w", channelID, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,390 @@
+// Package prefs stores users' notification preferences: muted channels,
+// how much each channel notifies, and a do-not-disturb schedule. The API
+// and the gateway's /mute, /unmute and /notify commands edit them; the
+// gateway, the notifier and the e-mail digest consult them before alerting
+// anyone.
+package prefs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	// The runtime images ship without a zoneinfo database.
+	_ "time/tzdata"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+	"github.com/redis/go-redis/v9"
+)
+
+// Preferences are stored in Scylla:
+//
+//	notification_prefs   a row per channel not at the defaults, and the
+//	                     do-not-disturb schedule as a static column
+//	channel_notify_all   users whose level for a channel is all
+//
+// The notify_all table lets the notifier find who wants every message of a
+// channel without reading everyone's preferences. Redis caches each user's
+// preferences for cacheTTL, since the gateway and the notifier read them
+// for every mention:
+//
+//	user:{id}:prefs             JSON Prefs
+//
+// Preferences used to live in Redis alone, under the keys below, until
+// Import moved them:
+//
+//	user:{id}:notify            hash channelID -> JSON Channel
+//	user:{id}:dnd               JSON Schedule
+//	channel:{id}:notify_all     set of users whose level for the channel is all
+//	user:{id}:muted             set of channels muted before preferences existed
+
+// Writes remove the cached copy, but a read that started before a write may
+// cache what it read after that, for this long.
+const cacheTTL = time.Minute
+
+func cacheKey(userID string) string {
+	return "user:" + userID + ":prefs"
+}
+
+func notifyKey(userID string) string {
+	return "user:" + userID + ":notify"
+}
+
+func dndKey(userID string) string {
+	return "user:" + userID + ":dnd"
+}
+
+func notifyAllKey(channelID string) string {
+	return "channel:" + channelID + ":notify_all"
+}
+
+func legacyMutedKey(userID string) string {
+	return "user:" + userID + ":muted"
+}
+
+// Level is how much of a channel notifies a user.
+type Level string
+
+const (
+	LevelAll      Level = "all"
+	LevelMentions Level = "mentions"
+	LevelNone     Level = "none"
+)
+
+var (
+	ErrInvalidLevel    = errors.New("level must be all, mentions or none")
+	ErrInvalidTimeZone = errors.New("time_zone must be an IANA time zone, e.g. Europe/Berlin")
+	ErrInvalidTime     = errors.New("start and end must be different times of day as HH:MM")
+	ErrInvalidDay      = errors.New("days must be mon, tue, wed, thu, fri, sat or sun")
+)
+
+// DefaultLevel is the level of a channel the user has not set one for:
+// every DM notifies, other channels only when the user is mentioned.
+func DefaultLevel(channelID string) Level {
+	if strings.HasPrefix(channelID, "dm:") {
+		return LevelAll
+	}
+	return LevelMentions
+}
+
+// Channel is a user's preferences for one channel.
+type Channel struct {
+	ChannelID string `json:"channel_id"`
+	// Empty means DefaultLevel.
+	Level Level `json:"level,omitempty"`
+	Muted bool  `json:"muted"`
+	// A mute without an end lasts until the channel is unmuted.
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+}
+
+// MutedAt reports whether the channel is muted at t.
+func (c *Channel) MutedAt(t time.Time) bool {
+	return c.Muted && (c.MutedUntil == nil || t.Before(*c.MutedUntil))
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule is a daily do-not-disturb window in the user's time zone, e.g.
+// 22:00 to 07:00. A window that ends before it starts runs past midnight.
+type Schedule struct {
+	TimeZone string `json:"time_zone"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	// Days the window starts on; empty means every day.
+	Days []string `json:"days,omitempty"`
+}
+
+// Validate checks a schedule before it is stored.
+func (s *Schedule) Validate() error {
+	if _, err := time.LoadLocation(s.TimeZone); err != nil || s.TimeZone == "" {
+		return ErrInvalidTimeZone
+	}
+	start, err1 := minuteOfDay(s.Start)
+	end, err2 := minuteOfDay(s.End)
+	if err1 != nil || err2 != nil || start == end {
+		return ErrInvalidTime
+	}
+	for _, d := range s.Days {
+		if !slices.Contains(weekdays, d) {
+			return ErrInvalidDay
+		}
+	}
+	return nil
+}
+
+// ActiveAt reports whether t falls in the window.
+func (s *Schedule) ActiveAt(t time.Time) bool {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return false
+	}
+	start, err1 := minuteOfDay(s.Start)
+	end, err2 := minuteOfDay(s.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	if start < end {
+		return now >= start && now < end && s.on(local.Weekday())
+	}
+	// Past midnight: late on a start day, or early the day after one
+	if now >= start {
+		return s.on(local.Weekday())
+	}
+	return now < end && s.on((local.Weekday()+6)%7)
+}
+
+func (s *Schedule) on(d time.Weekday) bool {
+	return len(s.Days) == 0 || slices.Contains(s.Days, weekdays[d])
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Prefs are all of a user's notification preferences.
+type Prefs struct {
+	DND      *Schedule           `json:"dnd"`
+	Channels map[string]*Channel `json:"channels"`
+}
+
+// Channel returns the user's preferences for a channel, the defaults if
+// they have none.
+func (p *Prefs) Channel(channelID string) *Channel {
+	if c, ok := p.Channels[channelID]; ok {
+		return c
+	}
+	return &Channel{ChannelID: channelID}
+}
+
+// Level returns how much of a channel notifies the user.
+func (p *Prefs) Level(channelID string) Level {
+	if l := p.Channel(channelID).Level; l != "" {
+		return l
+	}
+	return DefaultLevel(channelID)
+}
+
+// InDND reports whether the user's do-not-disturb schedule covers t.
+func (p *Prefs) InDND(t time.Time) bool {
+	return p.DND != nil && p.DND.ActiveAt(t)
+}
+
+// Allows reports whether an event in a channel may alert the user at t,
+// given whether it mentions them. Do not disturb is checked separately with
+// InDND, since not everything that alerts interrupts.
+func (p *Prefs) Allows(channelID string, mentioned bool, t time.Time) bool {
+	if p.Channel(channelID).MutedAt(t) {
+		return false
+	}
+	switch p.Level(channelID) {
+	case LevelAll:
+		return true
+	case LevelMentions:
+		return mentioned
+	default:
+		return false
+	}
+}
+
+// Get returns a user's preferences.
+func Get(ctx context.Context, session *db.Session, rdb *redis.Client, userID string) (*Prefs, error) {
+	if data, err := rdb.Get(ctx, cacheKey(userID)).Bytes(); err == nil {
+		p := new(Prefs)
+		if json.Unmarshal(data, p) == nil {
+			if p.Channels == nil {
+				p.Channels = make(map[string]*Channel)
+			}
+			return p, nil
+		}
+	}
+
+	p := &Prefs{Channels: make(map[string]*Channel)}
+	var channelID, level, dnd string
+	var muted bool
+	var mutedUntil time.Time
+	iter := session.Query(`SELECT channel_id, level, muted, muted_until, dnd FROM notification_prefs WHERE user_id = ?`, userID).Iter()
+	for iter.Scan(&channelID, &level, &muted, &mutedUntil, &dnd) {
+		if p.DND == nil && dnd != "" {
+			s := new(Schedule)
+			if json.Unmarshal([]byte(dnd), s) == nil {
+				p.DND = s
+			}
+		}
+		// Only the schedule is set
+		if channelID == "" {
+			continue
+		}
+		c := &Channel{ChannelID: channelID, Level: Level(level), Muted: muted}
+		if !mutedUntil.IsZero() {
+			until := mutedUntil
+			c.MutedUntil = &until
+		}
+		p.Channels[channelID] = c
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	// A failed write only costs the next read a trip to Scylla
+	if data, err := json.Marshal(p); err == nil {
+		rdb.Set(ctx, cacheKey(userID), data, cacheTTL)
+	}
+	return p, nil
+}
+
+// SetChannel stores a user's preferences for a channel. Preferences at the
+// defaults are removed.
+func SetChannel(ctx context.Context, session *db.Session, rdb *redis.Client, userID string, c *Channel) error {
+	switch c.Level {
+	case "", LevelAll, LevelMentions, LevelNone:
+	default:
+		return ErrInvalidLevel
+	}
+	if !c.Muted {
+		c.MutedUntil = nil
+	}
+
+	if c.Level == "" && !c.Muted {
+		if err := session.Query(`DELETE FROM notification_prefs WHERE user_id = ? AND channel_id = ?`, userID, c.ChannelID).Exec(); err != nil {
+			return err
+		}
+	} else {
+		err := session.Query(`INSERT INTO notification_prefs (user_id, channel_id, level, muted, muted_until) VALUES (?, ?, ?, ?, ?)`,
+			userID, c.ChannelID, string(c.Level), c.Muted, c.MutedUntil).Exec()
+		if err != nil {
+			return err
+		}
+	}
+	// DMs notify their recipient anyway
+	q := `DELETE FROM channel_notify_all WHERE channel_id = ? AND user_id = ?`
+	if c.Level == LevelAll && !strings.HasPrefix(c.ChannelID, "dm:") {
+		q = `INSERT INTO channel_notify_all (channel_id, user_id) VALUES (?, ?)`
+	}
+	if err := session.Query(q, c.ChannelID, userID).Exec(); err != nil {
+		return err
+	}
+	return rdb.Del(ctx, cacheKey(userID)).Err()
+}
+
+// SetDND stores a user's do-not-disturb schedule; nil removes it.
+func SetDND(ctx context.Context, session *db.Session, rdb *redis.Client, userID string, s *Schedule) error {
+	if s == nil {
+		if err := session.Query(`DELETE dnd FROM notification_prefs WHERE user_id = ?`, userID).Exec(); err != nil {
+			return err
+		}
+		return rdb.Del(ctx, cacheKey(userID)).Err()
+	}
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := session.Query(`UPDATE notification_prefs SET dnd = ? WHERE user_id = ?`, string(data), userID).Exec(); err != nil {
+		return err
+	}
+	return rdb.Del(ctx, cacheKey(userID)).Err()
+}
+
+// NotifyAll returns the users whose level for a channel is all.
+func NotifyAll(session *db.Session, channelID string) ([]string, error) {
+	var users []string
+	var userID string
+	iter := session.Query(`SELECT user_id FROM channel_notify_all WHERE channel_id = ?`, channelID).Iter()
+	for iter.Scan(&userID) {
+		users = append(users, userID)
+	}
+	return users, iter.Close()
+}
+
+// Import moves preferences stored in Redis before they moved to Scylla,
+// returning how many users had any. It is safe to run more than once, and
+// by several services at the same time.
+func Import(ctx context.Context, session *db.Session, rdb *redis.Client) (int, error) {
+	users := make(map[string]bool)
+	for _, suffix := range []string{":notify", ":dnd", ":muted"} {
+		iter := rdb.Scan(ctx, 0, "user:*"+suffix, 100).Iterator()
+		for iter.Next(ctx) {
+			users[strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "user:"), suffix)] = true
+		}
+		if err := iter.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	for userID := range users {
+		pipe := rdb.Pipeline()
+		channels := pipe.HGetAll(ctx, notifyKey(userID))
+		dnd := pipe.Get(ctx, dndKey(userID))
+		legacy := pipe.SMembers(ctx, legacyMutedKey(userID))
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return 0, err
+		}
+
+		for _, id := range legacy.Val() {
+			if err := SetChannel(ctx, session, rdb, userID, &Channel{ChannelID: id, Muted: true}); err != nil {
+				return 0, err
+			}
+		}
+		for id, data := range channels.Val() {
+			c := new(Channel)
+			if err := json.Unmarshal([]byte(data), c); err != nil {
+				continue
+			}
+			c.ChannelID = id
+			if err := SetChannel(ctx, session, rdb, userID, c); err != nil {
+				return 0, err
+			}
+		}
+		if data, err := dnd.Bytes(); err == nil {
+			s := new(Schedule)
+			if json.Unmarshal(data, s) == nil && s.Validate() == nil {
+				if err := SetDND(ctx, session, rdb, userID, s); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if err := rdb.Del(ctx, notifyKey(userID), dndKey(userID), legacyMutedKey(userID)).Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	// Rebuilt in channel_notify_all from the levels imported above
+	iter := rdb.Scan(ctx, 0, notifyAllKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		if err := rdb.Del(ctx, iter.Val()).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return len(users), iter.Err()
+}
@@ -0,0 +1,49 @@
+package push
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+type Device struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Token     string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeviceID derives a device's ID from its token, so registering the same
+// device again does not add it twice.
+func DeviceID(provider, token string) string {
+	sum := sha256.Sum256([]byte(provider + "\x00" + token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Register stores a device of a user.
+func Register(session *db.Session, d *Device) error {
+	return session.Query(`INSERT INTO devices (user_id, device_id, provider, token, created_at) VALUES (?, ?, ?, ?, ?)`,
+		d.UserID, d.ID, d.Provider, d.Token, d.CreatedAt).Exec()
+}
+
+// List returns a user's devices.
+func List(session *db.Session, userID string) ([]*Device, error) {
+	var devices []*Device
+	iter := session.Query(`SELECT device_id, provider, token, created_at FROM devices WHERE user_id = ?`, userID).Iter()
+	for {
+		d := &Device{UserID: userID}
+		if !iter.Scan(&d.ID, &d.Provider, &d.Token, &d.CreatedAt) {
+			break
+		}
+		devices = append(devices, d)
+	}
+	return devices, iter.Close()
+}
+
+// Delete forgets one of a user's devices.
+func Delete(session *db.Session, userID, id string) error {
+	return session.Query(`DELETE FROM devices WHERE user_id = ? AND device_id = ?`, userID, id).Exec()
+}
@@ -0,0 +1,85 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// record is what the stand-in providers write for each notification.
+type record struct {
+	Token        string        `json:"token"`
+	Notification *Notification `json:"notification"`
+	SentAt       time.Time     `json:"sent_at"`
+}
+
+// File appends notifications to a file, one JSON object per line, instead
+// of sending them anywhere.
+type File struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+func (p *File) Send(ctx context.Context, token string, n *Notification) error {
+	line, err := json.Marshal(record{Token: token, Notification: n, SentAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HTTP POSTs notifications as JSON to a URL, e.g. a test server. A 410 Gone
+// response marks the token invalid.
+type HTTP struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTP(url string) *HTTP {
+	return &HTTP{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *HTTP) Send(ctx context.Context, token string, n *Notification) error {
+	body, err := json.Marshal(record{Token: token, Notification: n, SentAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return ErrInvalidToken
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push endpoint returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Package push sends notifications to users' devices through push services.
+// The API registers devices; the notifier sends to them.
+//
+// Every push service is a Provider. A device is registered with the name of
+// its provider and the token that provider gave the app: an FCM registration
+// token, an APNs device token, or a Web Push subscription as JSON.
+package push
+
+import (
+	"context"
+	"errors"
+)
+
+// Provider names.
+const (
+	ProviderFCM     = "fcm"
+	ProviderAPNs    = "apns"
+	ProviderWebPush = "webpush"
+
+	// Stand-ins for testing: append to a file, or POST to a URL.
+	ProviderFile = "file"
+	ProviderHTTP = "http"
+)
+
+// Providers lists the provider names a device can be registered with.
+var Providers = []string{ProviderFCM, ProviderAPNs, ProviderWebPush, ProviderFile, ProviderHTTP}
+
+// ErrInvalidToken means the push service no longer knows the device, e.g.
+// because the app was uninstalled. The device should be forgotten.
+var ErrInvalidToken = errors.New("device token is no longer valid")
+
+type Notification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+
+	// A notification replaces any earlier one with the same CollapseKey
+	// that the device still shows.
+	CollapseKey string `json:"collapse_key,omitempty"`
+
+	// Passed to the app, e.g. the channel to open.
+	Data map[string]string `json:"data,omitempty"`
+}
+
+type Provider interface {
+	Send(ctx context.Context, token string, n *Notification) error
+}
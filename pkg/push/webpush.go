@@ -0,0 +1,219 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mahaj/networking-minor/pkg/netguard"
+)
+
+const (
+	// Size of the one record a payload is encrypted into. Push services
+	// accept at least 4096 bytes of payload.
+	webPushRecordSize = 4096
+
+	// How long the push service keeps a notification for an offline browser.
+	webPushTTL = 24 * time.Hour
+)
+
+// WebPush sends to browsers' push subscriptions (RFC 8030), encrypting the
+// payload (RFC 8291) and identifying the server with VAPID (RFC 8292).
+type WebPush struct {
+	key     *ecdsa.PrivateKey
+	subject string
+	client  *http.Client
+}
+
+// NewWebPush takes the VAPID private key as a base64url P-256 scalar, the
+// format web-push libraries generate, and a contact URL such as
+// mailto:ops@example.com.
+func NewWebPush(privateKey, subject string) (*WebPush, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode VAPID key: %w", err)
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse VAPID key: %w", err)
+	}
+	// Endpoints come from browsers, so they must not reach internal hosts
+	return &WebPush{key: key, subject: subject, client: netguard.Client(10 * time.Second)}, nil
+}
+
+// PublicKey is the applicationServerKey browsers subscribe with.
+func (p *WebPush) PublicKey() string {
+	pub, _ := p.key.PublicKey.Bytes()
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// subscription is a browser's PushSubscription as JSON.
+type subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// WebPushEndpoint returns the endpoint of a webpush device token, or
+// ErrInvalidToken if the token is not a PushSubscription with an https
+// endpoint.
+func WebPushEndpoint(token string) (*url.URL, error) {
+	_, endpoint, err := parseSubscription(token)
+	return endpoint, err
+}
+
+func parseSubscription(token string) (*subscription, *url.URL, error) {
+	var sub subscription
+	if err := json.Unmarshal([]byte(token), &sub); err != nil || sub.Endpoint == "" {
+		return nil, nil, ErrInvalidToken
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Hostname() == "" {
+		return nil, nil, ErrInvalidToken
+	}
+	return &sub, endpoint, nil
+}
+
+func (p *WebPush) Send(ctx context.Context, token string, n *Notification) error {
+	sub, endpoint, err := parseSubscription(token)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	body, err := encryptPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+
+	vapid, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": endpoint.Scheme + "://" + endpoint.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.subject,
+	}).SignedString(p.key)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "vapid t="+vapid+", k="+p.PublicKey())
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(webPushTTL.Seconds())))
+	if n.CollapseKey != "" {
+		// Topics are at most 32 URL-safe characters
+		sum := sha256.Sum256([]byte(n.CollapseKey))
+		req.Header.Set("Topic", base64.RawURLEncoding.EncodeToString(sum[:24]))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrInvalidToken
+	case resp.StatusCode >= 300:
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("push service returned %s: %s", resp.Status, reply)
+	}
+	return nil
+}
+
+// encryptPayload encrypts a payload for a subscription as a single
+// aes128gcm record (RFC 8188), keyed as RFC 8291 describes.
+func encryptPayload(sub *subscription, payload []byte) ([]byte, error) {
+	uaPublic, err := base64.RawURLEncoding.DecodeString(sub.Keys.P256dh)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(sub.Keys.Auth)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// A record holds the payload, a delimiter byte and the AEAD tag.
+	if len(payload)+1+16 > webPushRecordSize {
+		return nil, errors.New("notification too large for web push")
+	}
+
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+	shared, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	keyInfo := "WebPush: info\x00" + string(uaPublic) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt, record size, key ID length, and our public key as ID
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+
+	// 0x02 marks the last record
+	return gcm.Seal(header, nonce, append(payload, 0x02), nil), nil
+}
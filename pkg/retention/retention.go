@@ -0,0 +1,136 @@
+// Package retention holds how long messages are kept, per channel and for
+// the whole workspace. The API edits policies; the messaging service applies
+// them when it stores messages and purges older ones.
+package retention
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// Workspace is the channel ID under which the workspace default is stored.
+// Channels without a policy of their own use it.
+const Workspace = "*"
+
+// Limits of a policy.
+const (
+	MaxRetentionDays  = 3650
+	MinDisappearAfter = 30 * time.Second
+	MaxDisappearAfter = 365 * 24 * time.Hour
+)
+
+var ErrInvalid = errors.New("retention_days must be 0-3650 and disappear_seconds 0 or 30s-365d")
+
+// Policy says how long a channel's messages are kept. Zero values keep
+// messages forever.
+type Policy struct {
+	// Messages older than this many days are deleted.
+	RetentionDays int `json:"retention_days"`
+
+	// New messages disappear this many seconds after they are sent.
+	DisappearSeconds int `json:"disappear_seconds"`
+
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate checks that a policy is within the limits.
+func (p Policy) Validate() error {
+	if p.RetentionDays < 0 || p.RetentionDays > MaxRetentionDays {
+		return ErrInvalid
+	}
+	d := p.DisappearAfter()
+	if p.DisappearSeconds < 0 || (d != 0 && (d < MinDisappearAfter || d > MaxDisappearAfter)) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Retention is how long messages are kept, or zero for forever.
+func (p Policy) Retention() time.Duration {
+	return time.Duration(p.RetentionDays) * 24 * time.Hour
+}
+
+// DisappearAfter is how long after being sent a new message disappears, or
+// zero for never.
+func (p Policy) DisappearAfter() time.Duration {
+	return time.Duration(p.DisappearSeconds) * time.Second
+}
+
+// TTL is how long a new message lives: the shorter of the retention and the
+// disappearing time, or zero for forever.
+func (p Policy) TTL() time.Duration {
+	ttl := p.Retention()
+	if d := p.DisappearAfter(); d > 0 && (ttl == 0 || d < ttl) {
+		ttl = d
+	}
+	return ttl
+}
+
+// Within returns the policy changed to keep messages no longer than limit
+// does. A policy that keeps them forever is no limit.
+func (p Policy) Within(limit Policy) Policy {
+	if keep := limit.RetentionDays; keep > 0 && (p.RetentionDays == 0 || p.RetentionDays > keep) {
+		p.RetentionDays = keep
+	}
+	if d := limit.DisappearSeconds; d > 0 && (p.DisappearSeconds == 0 || p.DisappearSeconds > d) {
+		p.DisappearSeconds = d
+	}
+	return p
+}
+
+// Get returns the policy stored for a channel, or for the workspace with
+// Workspace. ok is false if there is none.
+func Get(session *db.Session, channelID string) (p Policy, ok bool, err error) {
+	err = session.Query(`SELECT retention_days, disappear_seconds, updated_by, updated_at FROM retention_policies WHERE channel_id = ?`, channelID).
+		Scan(&p.RetentionDays, &p.DisappearSeconds, &p.UpdatedBy, &p.UpdatedAt)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return Policy{}, false, nil
+	}
+	return p, err == nil, err
+}
+
+// Save stores a channel's policy.
+func Save(session *db.Session, channelID string, p Policy) error {
+	return session.Query(`INSERT INTO retention_policies (channel_id, retention_days, disappear_seconds, updated_by, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		channelID, p.RetentionDays, p.DisappearSeconds, p.UpdatedBy, p.UpdatedAt).Exec()
+}
+
+// Delete removes a channel's policy, so the workspace default applies again.
+func Delete(session *db.Session, channelID string) error {
+	return session.Query(`DELETE FROM retention_policies WHERE channel_id = ?`, channelID).Exec()
+}
+
+// Policies holds every stored policy.
+type Policies map[string]Policy
+
+// LoadAll reads every stored policy. There is one row per configured
+// channel, so the table stays small.
+func LoadAll(session *db.Session) (Policies, error) {
+	policies := make(Policies)
+	iter := session.Query(`SELECT channel_id, retention_days, disappear_seconds FROM retention_policies`).Iter()
+	var channelID string
+	var p Policy
+	for iter.Scan(&channelID, &p.RetentionDays, &p.DisappearSeconds) {
+		policies[channelID] = p
+	}
+	return policies, iter.Close()
+}
+
+// For returns the policy that applies to a channel. DM participants set
+// their DM's policy themselves, so it can only keep messages for less time
+// than the workspace's.
+func (ps Policies) For(channelID string) Policy {
+	p, ok := ps[channelID]
+	if !ok {
+		return ps[Workspace]
+	}
+	if strings.HasPrefix(channelID, "dm:") {
+		return p.Within(ps[Workspace])
+	}
+	return p
+}
@@ -0,0 +1,157 @@
+// Package schedule stores messages to be sent later and reminders about
+// existing messages. The API creates and edits schedules; the scheduler in
+// the messaging service sends them when they come due.
+//
+// A schedule lives in scheduled_messages, keyed by its owner, and is queued
+// in schedule_queue under the minute it is due. Editing the send time queues
+// it again; the scheduler drops queue entries that no longer match.
+package schedule
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// Kinds of schedule.
+const (
+	// Sends Content to ChannelID as the owner.
+	KindMessage = "message"
+
+	// Reminds the owner of message TargetID in ChannelID, with Content as
+	// an optional note.
+	KindReminder = "reminder"
+)
+
+// Statuses of a schedule. Only pending schedules can be edited or cancelled.
+const (
+	StatusPending   = "pending"
+	StatusSending   = "sending"
+	StatusSent      = "sent"
+	StatusCancelled = "cancelled"
+)
+
+var ErrNotFound = errors.New("schedule not found")
+
+type Schedule struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Kind      string    `json:"kind"`
+	ChannelID string    `json:"channel_id"`
+	Content   string    `json:"content"`
+	TargetID  int64     `json:"target_id,omitempty"`
+	SendAt    time.Time `json:"send_at"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Set once the scheduler claims the schedule. MessageID is reused if
+	// sending has to be retried, so a retry cannot post twice.
+	MessageID int64      `json:"message_id,omitempty"`
+	ClaimedAt *time.Time `json:"-"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+}
+
+// Minute is the schedule_queue partition a send time falls in.
+func Minute(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Minute)
+}
+
+const columns = `schedule_id, user_id, kind, channel_id, content, target_id, send_at, status, created_at, message_id, claimed_at, sent_at`
+
+func fields(sc *Schedule) []interface{} {
+	return []interface{}{&sc.ID, &sc.UserID, &sc.Kind, &sc.ChannelID, &sc.Content, &sc.TargetID, &sc.SendAt, &sc.Status, &sc.CreatedAt, &sc.MessageID, &sc.ClaimedAt, &sc.SentAt}
+}
+
+// Get returns one of a user's schedules.
+func Get(session *db.Session, userID, id string) (*Schedule, error) {
+	sc := new(Schedule)
+	err := session.Query(`SELECT `+columns+` FROM scheduled_messages WHERE user_id = ? AND schedule_id = ?`, userID, id).Scan(fields(sc)...)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// List returns all of a user's schedules.
+func List(session *db.Session, userID string) ([]*Schedule, error) {
+	var schedules []*Schedule
+	iter := session.Query(`SELECT `+columns+` FROM scheduled_messages WHERE user_id = ?`, userID).Iter()
+	for {
+		sc := new(Schedule)
+		if !iter.Scan(fields(sc)...) {
+			break
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules, iter.Close()
+}
+
+// Create stores a new pending schedule and queues it. Every write to a
+// schedule is a lightweight transaction, so their order holds across
+// replicas.
+func Create(session *db.Session, sc *Schedule) error {
+	applied, err := session.Query(`INSERT INTO scheduled_messages (schedule_id, user_id, kind, channel_id, content, target_id, send_at, status, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+		sc.ID, sc.UserID, sc.Kind, sc.ChannelID, sc.Content, sc.TargetID, sc.SendAt, sc.Status, sc.CreatedAt).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return errors.New("schedule ID already in use")
+	}
+	return Enqueue(session, sc)
+}
+
+// Enqueue adds a schedule to the queue under its send time.
+func Enqueue(session *db.Session, sc *Schedule) error {
+	return session.Query(`INSERT INTO schedule_queue (minute, send_at, user_id, schedule_id) VALUES (?, ?, ?, ?)`,
+		Minute(sc.SendAt), sc.SendAt, sc.UserID, sc.ID).Exec()
+}
+
+// Update changes the content and send time of a pending schedule. It
+// returns false if the schedule is no longer pending.
+func Update(session *db.Session, sc *Schedule) (bool, error) {
+	return session.Query(`UPDATE scheduled_messages SET content = ?, send_at = ? WHERE user_id = ? AND schedule_id = ? IF status = ?`,
+		sc.Content, sc.SendAt, sc.UserID, sc.ID, StatusPending).MapScanCAS(map[string]interface{}{})
+}
+
+// Cancel cancels a pending schedule. It returns false if the schedule is no
+// longer pending.
+func Cancel(session *db.Session, userID, id string) (bool, error) {
+	return session.Query(`UPDATE scheduled_messages SET status = ? WHERE user_id = ? AND schedule_id = ? IF status = ?`,
+		StatusCancelled, userID, id, StatusPending).MapScanCAS(map[string]interface{}{})
+}
+
+// Claim takes a due schedule for sending and updates sc to match. A first
+// claim gives it messageID as the ID of what it sends. A schedule stuck in
+// StatusSending, because the replica sending it stopped, can be claimed
+// again and keeps its message ID. Only one replica's claim succeeds.
+func Claim(session *db.Session, sc *Schedule, messageID int64, now time.Time) (bool, error) {
+	var applied bool
+	var err error
+	if sc.Status == StatusSending {
+		applied, err = session.Query(`UPDATE scheduled_messages SET claimed_at = ? WHERE user_id = ? AND schedule_id = ? IF status = ? AND claimed_at = ?`,
+			now, sc.UserID, sc.ID, StatusSending, sc.ClaimedAt).MapScanCAS(map[string]interface{}{})
+	} else {
+		applied, err = session.Query(`UPDATE scheduled_messages SET status = ?, message_id = ?, claimed_at = ? WHERE user_id = ? AND schedule_id = ? IF status = ? AND send_at = ?`,
+			StatusSending, messageID, now, sc.UserID, sc.ID, StatusPending, sc.SendAt).MapScanCAS(map[string]interface{}{})
+		if applied {
+			sc.MessageID = messageID
+		}
+	}
+	if applied {
+		sc.Status, sc.ClaimedAt = StatusSending, &now
+	}
+	return applied, err
+}
+
+// MarkSent records that a claimed schedule was sent.
+func MarkSent(session *db.Session, sc *Schedule, now time.Time) error {
+	_, err := session.Query(`UPDATE scheduled_messages SET status = ?, sent_at = ? WHERE user_id = ? AND schedule_id = ? IF status = ? AND message_id = ?`,
+		StatusSent, now, sc.UserID, sc.ID, StatusSending, sc.MessageID).MapScanCAS(map[string]interface{}{})
+	return err
+}
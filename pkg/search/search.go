@@ -0,0 +1,312 @@
+// Package search is the full-text index of stored messages. The messaging
+// service writes it and answers queries for the API; it is a bleve index on
+// the messaging service's disk.
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/lang/en"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"github.com/mahaj/networking-minor/pkg/model"
+)
+
+// Public is the reader of channels everyone may read. DMs are readable by
+// their two participants instead.
+const Public = "*"
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// Sort orders.
+const (
+	SortRelevance = "relevance"
+	SortRecent    = "recent"
+)
+
+var ErrEmptyQuery = errors.New("search text is required")
+
+// SecretHeader carries the secret the API authenticates to the messaging
+// service's search endpoint with. Queries name their reader, so nobody
+// else may send them.
+const SecretHeader = "X-Search-Secret"
+
+// Development fallback, only used when SEARCH_DEV_SECRET=true. It is public,
+// so anyone could query the index as any reader with it.
+const devSecret = "dev-search-secret"
+
+// LoadSecret returns the secret shared by the API and the messaging service,
+// from SEARCH_SECRET. Without it, SEARCH_DEV_SECRET=true falls back to the
+// development secret; otherwise it is an error.
+func LoadSecret() (string, error) {
+	if secret := os.Getenv("SEARCH_SECRET"); secret != "" {
+		return secret, nil
+	}
+	if os.Getenv("SEARCH_DEV_SECRET") != "true" {
+		return "", errors.New("SEARCH_SECRET is not set; set it, or set SEARCH_DEV_SECRET=true for local development")
+	}
+	log.Println("WARNING: SEARCH_SECRET is not set, using the insecure development secret")
+	return devSecret, nil
+}
+
+// document is what is stored per message.
+type document struct {
+	ChannelID   string    `json:"channel_id"`
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name"`
+	Content     string    `json:"content"`
+	Timestamp   time.Time `json:"timestamp"`
+	Readers     []string  `json:"readers"`
+}
+
+// Readers returns who may read a channel: the participants of a DM, or
+// Public.
+func Readers(channelID string) []string {
+	if strings.HasPrefix(channelID, "dm:") {
+		if parts := strings.Split(channelID, ":"); len(parts) == 3 {
+			return []string{parts[1], parts[2]}
+		}
+		return nil
+	}
+	return []string{Public}
+}
+
+// Query is a search. Text holds terms, all of which must match, and
+// "quoted phrases". The filters are optional.
+type Query struct {
+	Text      string    `json:"q"`
+	ChannelID string    `json:"channel_id,omitempty"`
+	UserID    string    `json:"user_id,omitempty"`
+	After     time.Time `json:"after,omitempty"`
+	Before    time.Time `json:"before,omitempty"`
+	Sort      string    `json:"sort,omitempty"`
+	Limit     int       `json:"limit,omitempty"`
+	Offset    int       `json:"offset,omitempty"`
+
+	// Only channels this user can read are searched. Required.
+	Reader string `json:"reader"`
+}
+
+type Hit struct {
+	ID          int64     `json:"id"`
+	ChannelID   string    `json:"channel_id"`
+	UserID      string    `json:"user_id"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Content     string    `json:"content"`
+	Timestamp   time.Time `json:"timestamp"`
+	Score       float64   `json:"score"`
+	// Fragments of the content around the matches, HTML-escaped with the
+	// matches wrapped in <mark>.
+	Highlights []string `json:"highlights"`
+}
+
+type Results struct {
+	Total uint64 `json:"total"`
+	Hits  []Hit  `json:"hits"`
+}
+
+// Index is a message index.
+type Index struct {
+	idx bleve.Index
+}
+
+func newMapping() mapping.IndexMapping {
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = en.AnalyzerName
+
+	kw := bleve.NewKeywordFieldMapping()
+	kw.Analyzer = keyword.Name
+
+	stored := bleve.NewTextFieldMapping()
+	stored.Index = false
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("content", text)
+	doc.AddFieldMappingsAt("channel_id", kw)
+	doc.AddFieldMappingsAt("user_id", kw)
+	doc.AddFieldMappingsAt("readers", kw)
+	doc.AddFieldMappingsAt("display_name", stored)
+	doc.AddFieldMappingsAt("timestamp", bleve.NewDateTimeFieldMapping())
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = en.AnalyzerName
+	return m
+}
+
+// Open opens the index at path, creating it if it does not exist.
+func Open(path string) (*Index, error) {
+	idx, err := bleve.Open(path)
+	if errors.Is(err, bleve.ErrorIndexPathDoesNotExist) {
+		idx, err = bleve.New(path, newMapping())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Index{idx: idx}, nil
+}
+
+// Create makes a new, empty index at path, replacing anything there.
+func Create(path string) (*Index, error) {
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	idx, err := bleve.New(path, newMapping())
+	if err != nil {
+		return nil, err
+	}
+	return &Index{idx: idx}, nil
+}
+
+func (i *Index) Close() error {
+	return i.idx.Close()
+}
+
+// Count returns the number of indexed messages.
+func (i *Index) Count() (uint64, error) {
+	return i.idx.DocCount()
+}
+
+// Add indexes messages, replacing earlier versions of the same messages.
+func (i *Index) Add(msgs ...*model.Message) error {
+	b := i.idx.NewBatch()
+	for _, m := range msgs {
+		err := b.Index(strconv.FormatInt(m.ID, 10), document{
+			ChannelID:   m.ChannelID,
+			UserID:      m.UserID,
+			DisplayName: m.DisplayName,
+			Content:     m.Content,
+			Timestamp:   m.Timestamp,
+			Readers:     Readers(m.ChannelID),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return i.idx.Batch(b)
+}
+
+// Delete removes messages from the index.
+func (i *Index) Delete(ids ...int64) error {
+	b := i.idx.NewBatch()
+	for _, id := range ids {
+		b.Delete(strconv.FormatInt(id, 10))
+	}
+	return i.idx.Batch(b)
+}
+
+// parseText splits search text into "quoted phrases" and the remaining
+// terms.
+func parseText(text string) (phrases []string, terms string) {
+	var rest []string
+	for {
+		start := strings.IndexByte(text, '"')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(text[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		rest = append(rest, text[:start])
+		if p := strings.TrimSpace(text[start+1 : start+1+end]); p != "" {
+			phrases = append(phrases, p)
+		}
+		text = text[start+1+end+1:]
+	}
+	rest = append(rest, strings.ReplaceAll(text, `"`, " "))
+	return phrases, strings.Join(strings.Fields(strings.Join(rest, " ")), " ")
+}
+
+func term(field, value string) query.Query {
+	q := bleve.NewTermQuery(value)
+	q.SetField(field)
+	return q
+}
+
+// Search runs q. The results only include messages in channels q.Reader can
+// read.
+func (i *Index) Search(ctx context.Context, q *Query) (*Results, error) {
+	phrases, terms := parseText(q.Text)
+	if len(phrases) == 0 && terms == "" {
+		return nil, ErrEmptyQuery
+	}
+	if q.Reader == "" {
+		return nil, errors.New("search: reader is required")
+	}
+
+	var must []query.Query
+	if terms != "" {
+		m := bleve.NewMatchQuery(terms)
+		m.SetField("content")
+		m.SetOperator(query.MatchQueryOperatorAnd)
+		must = append(must, m)
+	}
+	for _, p := range phrases {
+		m := bleve.NewMatchPhraseQuery(p)
+		m.SetField("content")
+		must = append(must, m)
+	}
+	if q.ChannelID != "" {
+		must = append(must, term("channel_id", q.ChannelID))
+	}
+	if q.UserID != "" {
+		must = append(must, term("user_id", q.UserID))
+	}
+	if !q.After.IsZero() || !q.Before.IsZero() {
+		d := bleve.NewDateRangeQuery(q.After, q.Before)
+		d.SetField("timestamp")
+		must = append(must, d)
+	}
+	must = append(must, bleve.NewDisjunctionQuery(term("readers", Public), term("readers", q.Reader)))
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+
+	req := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(must...), limit, q.Offset, false)
+	req.Fields = []string{"channel_id", "user_id", "display_name", "content", "timestamp"}
+	req.Highlight = bleve.NewHighlightWithStyle("html")
+	req.Highlight.AddField("content")
+	if q.Sort == SortRecent {
+		req.SortBy([]string{"-timestamp", "-_score"})
+	}
+
+	res, err := i.idx.SearchInContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Results{Total: res.Total, Hits: []Hit{}}
+	for _, h := range res.Hits {
+		id, err := strconv.ParseInt(h.ID, 10, 64)
+		if err != nil {
+			continue
+		}
+		hit := Hit{ID: id, Score: h.Score, Highlights: h.Fragments["content"]}
+		hit.ChannelID, _ = h.Fields["channel_id"].(string)
+		hit.UserID, _ = h.Fields["user_id"].(string)
+		hit.DisplayName, _ = h.Fields["display_name"].(string)
+		hit.Content, _ = h.Fields["content"].(string)
+		if ts, ok := h.Fields["timestamp"].(string); ok {
+			hit.Timestamp, _ = time.Parse(time.RFC3339Nano, ts)
+		}
+		out.Hits = append(out.Hits, hit)
+	}
+	return out, nil
+}
@@ -0,0 +1,131 @@
+package snowflake
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Services that run several replicas lease their nodes through Redis, so
+// no two replicas generate IDs as the same node:
+//
+//	snowflake:node:{n}  random token of the replica holding node n
+
+// Nodes each service leases from. 1023 is left for scripts and tests.
+const (
+	FirstGatewayNode   = 0
+	LastGatewayNode    = 340
+	FirstAPINode       = 341
+	LastAPINode        = 681
+	FirstMessagingNode = 682
+	LastMessagingNode  = 1022
+)
+
+const (
+	// A lease that is not renewed for leaseTTL is free again, e.g. after
+	// its replica crashed.
+	leaseTTL           = 30 * time.Second
+	leaseRenewInterval = 10 * time.Second
+)
+
+var ErrNoFreeNode = errors.New("snowflake: every node in the range is leased")
+
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func leaseKey(node int64) string {
+	return "snowflake:node:" + strconv.FormatInt(node, 10)
+}
+
+// Lease takes the first free node from first to last and renews the lease
+// until ctx is done, then releases it. If the lease is lost, e.g. Redis was
+// unreachable for longer than leaseTTL, lost is called: another replica may
+// be generating the same IDs by then, so the caller should stop.
+func Lease(ctx context.Context, rdb *redis.Client, first, last int64, lost func(error)) (*Node, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+
+	for n := first; n <= last; n++ {
+		ok, err := rdb.SetNX(ctx, leaseKey(n), token, leaseTTL).Result()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		node, err := NewNode(n)
+		if err != nil {
+			return nil, err
+		}
+		go renew(ctx, rdb, n, token, lost)
+		return node, nil
+	}
+	return nil, ErrNoFreeNode
+}
+
+// Load returns the node SNOWFLAKE_NODE sets, or else leases one from first
+// to last as Lease does.
+func Load(ctx context.Context, rdb *redis.Client, first, last int64, lost func(error)) (*Node, error) {
+	v := os.Getenv("SNOWFLAKE_NODE")
+	if v == "" {
+		return Lease(ctx, rdb, first, last, lost)
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SNOWFLAKE_NODE %q: %w", v, err)
+	}
+	return NewNode(n)
+}
+
+func renew(ctx context.Context, rdb *redis.Client, node int64, token string, lost func(error)) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			releaseScript.Run(context.Background(), rdb, []string{leaseKey(node)}, token)
+			return
+		case <-ticker.C:
+			held, err := renewScript.Run(ctx, rdb, []string{leaseKey(node)}, token, leaseTTL.Milliseconds()).Int()
+			switch {
+			case err != nil && time.Since(renewed) >= leaseTTL:
+				lost(err)
+				return
+			case err != nil:
+				// Retried on the next tick, while the lease lasts
+			case held == 0:
+				lost(errors.New("snowflake: lease of node " + strconv.FormatInt(node, 10) + " was taken over"))
+				return
+			default:
+				renewed = time.Now()
+			}
+		}
+	}
+}
+
+// Number is the node's number.
+func (n *Node) Number() int64 {
+	return n.node
+}
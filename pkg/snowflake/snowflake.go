@@ -62,3 +62,9 @@ func (n *Node) Generate() int64 {
 
 	return ((now - n.epoch) << timeShift) | (n.node << nodeShift) | n.step
 }
+
+// MinID returns the smallest ID generated at t, so IDs below it were all
+// generated before t.
+func MinID(t time.Time) int64 {
+	return (t.UnixMilli() - epoch) << timeShift
+}
@@ -0,0 +1,130 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mahaj/networking-minor/pkg/model"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis layout shared by the gateway (writer) and the API (reader):
+//
+//	user:{id}:status    hash: online flag, chosen status, custom text, last_seen (unix ms)
+//	user:{id}:conns     zset connID -> expiry across every channel and gateway
+//	user:{id}:channels  set of channels the user is currently present in
+//	user:{id}:contacts  set of users the user has joined a DM with
+//
+// The online flag is set and cleared by the gateway's presence scripts when
+// the first connection opens and the last one closes or expires.
+
+const maxTextLength = 100
+
+var ErrInvalidStatus = errors.New("status must be online, away or dnd")
+
+func Key(userID string) string {
+	return "user:" + userID + ":status"
+}
+
+func ConnsKey(userID string) string {
+	return "user:" + userID + ":conns"
+}
+
+func ChannelsKey(userID string) string {
+	return "user:" + userID + ":channels"
+}
+
+func ContactsKey(userID string) string {
+	return "user:" + userID + ":contacts"
+}
+
+// AddContact records that two users share a DM, so each hears about the
+// other's status wherever they are connected.
+func AddContact(ctx context.Context, rdb *redis.Client, u1, u2 string) error {
+	pipe := rdb.Pipeline()
+	pipe.SAdd(ctx, ContactsKey(u1), u2)
+	pipe.SAdd(ctx, ContactsKey(u2), u1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DMChannels returns the DM channels a user shares with their contacts.
+func DMChannels(ctx context.Context, rdb *redis.Client, userID string) ([]string, error) {
+	contacts, err := rdb.SMembers(ctx, ContactsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	channels := make([]string, len(contacts))
+	for i, other := range contacts {
+		u1, u2 := userID, other
+		if u1 > u2 {
+			u1, u2 = u2, u1
+		}
+		channels[i] = "dm:" + u1 + ":" + u2
+	}
+	return channels, nil
+}
+
+// Set stores the status a user picked for themselves. It is shown while the
+// user is connected; offline is derived and cannot be chosen.
+func Set(ctx context.Context, rdb *redis.Client, userID string, status model.Status, text string) error {
+	switch status {
+	case model.StatusOnline, model.StatusAway, model.StatusDND:
+	default:
+		return ErrInvalidStatus
+	}
+	if utf8.RuneCountInString(text) > maxTextLength {
+		text = string([]rune(text)[:maxTextLength])
+	}
+	return rdb.HSet(ctx, Key(userID), "status", string(status), "text", text).Err()
+}
+
+// Get returns the effective status of each user, in the order given.
+func Get(ctx context.Context, rdb *redis.Client, userIDs ...string) ([]model.UserStatus, error) {
+	pipe := rdb.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(userIDs))
+	for i, id := range userIDs {
+		cmds[i] = pipe.HMGet(ctx, Key(id), "online", "status", "text", "last_seen")
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	statuses := make([]model.UserStatus, len(userIDs))
+	for i, id := range userIDs {
+		statuses[i] = parse(id, cmds[i].Val())
+	}
+	return statuses, nil
+}
+
+// parse turns an HMGET reply for online, status, text and last_seen into a
+// UserStatus.
+func parse(userID string, vals []interface{}) model.UserStatus {
+	field := func(i int) string {
+		if i < len(vals) {
+			if s, ok := vals[i].(string); ok {
+				return s
+			}
+		}
+		return ""
+	}
+
+	st := model.UserStatus{UserID: userID, Status: model.StatusOffline}
+	if field(0) == "" {
+		if ms, err := strconv.ParseInt(field(3), 10, 64); err == nil {
+			t := time.UnixMilli(ms).UTC()
+			st.LastSeen = &t
+		}
+		return st
+	}
+
+	st.Status = model.StatusOnline
+	if s := model.Status(field(1)); s != "" {
+		st.Status = s
+	}
+	st.Text = field(2)
+	return st
+}
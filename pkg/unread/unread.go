@@ -0,0 +1,58 @@
+// Package unread counts the DMs users have not read yet. The messaging
+// service marks every stored DM unread for its recipient in unread_messages;
+// the API moves the recipient's read cursor in conversation_reads when they
+// read, and counts the rows after it.
+package unread
+
+import (
+	"errors"
+	"log"
+
+	"github.com/gocql/gocql"
+	"github.com/mahaj/networking-minor/pkg/db"
+)
+
+// Count counts the messages from otherUserID that userID has not read:
+// those after the user's read cursor. Rows up to the cursor are deleted when
+// the user reads, but a redelivered message can write one back, so the
+// cursor is what decides.
+func Count(session *db.Session, userID, otherUserID string) (int64, error) {
+	var lastRead int64
+	err := session.Query(`SELECT last_read_id FROM conversation_reads WHERE user_id = ? AND other_user_id = ?`, userID, otherUserID).Scan(&lastRead)
+	if err != nil && !errors.Is(err, gocql.ErrNotFound) {
+		return 0, err
+	}
+
+	var count int64
+	err = session.Query(`SELECT COUNT(*) FROM unread_messages WHERE user_id = ? AND other_user_id = ? AND message_id > ?`, userID, otherUserID, lastRead).Scan(&count)
+	return count, err
+}
+
+// Read moves userID's read cursor of the DM with otherUserID to
+// lastReadID, or to the newest unread message if it is 0. The caller checks
+// that lastReadID is a message of the DM.
+func Read(session *db.Session, userID, otherUserID string, lastReadID int64) error {
+	if lastReadID == 0 {
+		err := session.Query(`SELECT message_id FROM unread_messages WHERE user_id = ? AND other_user_id = ? LIMIT 1`, userID, otherUserID).Scan(&lastReadID)
+		if errors.Is(err, gocql.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// The message ID doubles as the write timestamp, so a stale request
+	// cannot move the cursor back.
+	query := `INSERT INTO conversation_reads (user_id, other_user_id, last_read_id) VALUES (?, ?, ?) USING TIMESTAMP ?`
+	if err := session.Query(query, userID, otherUserID, lastReadID, lastReadID).Exec(); err != nil {
+		return err
+	}
+
+	// The cursor already hides these rows; deleting them keeps counts cheap.
+	query = `DELETE FROM unread_messages WHERE user_id = ? AND other_user_id = ? AND message_id <= ?`
+	if err := session.Query(query, userID, otherUserID, lastReadID).Exec(); err != nil {
+		log.Printf("Failed to clear read messages for %s: %v", userID, err)
+	}
+	return nil
+}
@@ -1,34 +0,0 @@
-package main
-
-import (
-	"log"
-
-	"github.com/gocql/gocql"
-)
-
-func main() {
-	cluster := gocql.NewCluster("localhost")
-	cluster.Keyspace = "chat"
-	cluster.Consistency = gocql.Quorum
-	session, err := cluster.CreateSession()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer session.Close()
-
-	// Create counter table
-	err = session.Query(`
-		CREATE TABLE IF NOT EXISTS conversation_counters (
-			user_id text,
-			other_user_id text,
-			unread_count counter,
-			PRIMARY KEY (user_id, other_user_id)
-		)
-	`).Exec()
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Println("Table conversation_counters created successfully")
-}
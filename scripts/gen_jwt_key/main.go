@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/mahaj/networking-minor/pkg/auth"
+)
+
+// Generates a signing key pair for JWT_PRIVATE_KEY_FILE / JWT_VERIFY_KEYS.
+//
+//	go run ./scripts/gen_jwt_key -alg ES256 -out keys/jwt-2025-01
+//
+// writes keys/jwt-2025-01.pem (private) and keys/jwt-2025-01.pub.pem (public).
+func main() {
+	alg := flag.String("alg", "ES256", "ES256 or RS256")
+	out := flag.String("out", "jwt", "output path prefix")
+	flag.Parse()
+
+	var priv interface{}
+	var pub interface{}
+	switch *alg {
+	case "ES256":
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		priv, pub = k, &k.PublicKey
+	case "RS256":
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Fatal(err)
+		}
+		priv, pub = k, &k.PublicKey
+	default:
+		log.Fatalf("Unsupported alg %q", *alg)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	privPath, pubPath := *out+".pem", *out+".pub.pem"
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	k, err := auth.LoadKeyFile(pubPath, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %s and %s (kid %s)", privPath, pubPath, k.ID)
+}
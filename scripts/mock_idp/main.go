@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mahaj/networking-minor/pkg/auth"
+)
+
+// A minimal OpenID Connect provider for local testing of the API's SSO
+// login. It approves every authorization request without a login form, for
+// the user given by -user or the login_hint parameter.
+//
+//	go run ./scripts/mock_idp -addr :9000
+//	OIDC_ISSUER=http://localhost:9000 OIDC_CLIENT_ID=chat go run ./apps/api
+//	go run ./scripts/verify_oidc
+//
+// It implements discovery, the authorization code flow with PKCE (S256) and
+// a JWKS endpoint. Nothing is persisted; the signing key changes on restart.
+
+type pendingCode struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	subject     string
+	expires     time.Time
+}
+
+type idTokenClaims struct {
+	Nonce             string `json:"nonce,omitempty"`
+	Email             string `json:"email"`
+	PreferredUsername string `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+type provider struct {
+	issuer   string
+	clientID string
+	secret   string
+	user     string
+	keys     *auth.KeySet
+
+	mu    sync.Mutex
+	codes map[string]*pendingCode
+}
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	issuer := flag.String("issuer", "http://localhost:9000", "issuer URL clients reach this server at")
+	clientID := flag.String("client", "chat", "accepted client_id")
+	secret := flag.String("secret", "", "client secret; empty accepts public clients")
+	user := flag.String("user", "alice", "subject logged in when no login_hint is given")
+	flag.Parse()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys := auth.NewKeySet()
+	keys.SetSigningKey(&auth.Key{ID: "mock-idp", Method: jwt.SigningMethodES256, Private: priv, Public: &priv.PublicKey})
+
+	p := &provider{
+		issuer:   *issuer,
+		clientID: *clientID,
+		secret:   *secret,
+		user:     *user,
+		keys:     keys,
+		codes:    make(map[string]*pendingCode),
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	http.HandleFunc("/jwks", p.jwks)
+	http.HandleFunc("/authorize", p.authorize)
+	http.HandleFunc("/token", p.token)
+
+	log.Printf("Mock IdP listening on %s as %s", *addr, *issuer)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func (p *provider) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *provider) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.keys.JWKS())
+}
+
+func (p *provider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI := q.Get("redirect_uri")
+	if q.Get("client_id") != p.clientID || redirectURI == "" {
+		http.Error(w, "unknown client or missing redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "only response_type=code with S256 PKCE is supported", http.StatusBadRequest)
+		return
+	}
+
+	subject := q.Get("login_hint")
+	if subject == "" {
+		subject = p.user
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	code := base64.RawURLEncoding.EncodeToString(buf)
+
+	p.mu.Lock()
+	p.codes[code] = &pendingCode{
+		clientID:    p.clientID,
+		redirectURI: redirectURI,
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		subject:     subject,
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := target.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	target.RawQuery = params.Encode()
+
+	log.Printf("Authorized %s, redirecting to %s", subject, redirectURI)
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func tokenError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+func (p *provider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", err.Error())
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "")
+		return
+	}
+
+	clientID := r.PostForm.Get("client_id")
+	if id, secret, ok := r.BasicAuth(); ok {
+		clientID, _ = url.QueryUnescape(id)
+		if s, _ := url.QueryUnescape(secret); s != p.secret {
+			tokenError(w, "invalid_client", "wrong client secret")
+			return
+		}
+	} else if p.secret != "" {
+		tokenError(w, "invalid_client", "client authentication required")
+		return
+	}
+
+	// Codes are single use.
+	code := r.PostForm.Get("code")
+	p.mu.Lock()
+	pending := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+
+	if pending == nil || time.Now().After(pending.expires) {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	if clientID != pending.clientID || r.PostForm.Get("redirect_uri") != pending.redirectURI {
+		tokenError(w, "invalid_grant", "client_id or redirect_uri mismatch")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge {
+		tokenError(w, "invalid_grant", "PKCE verification failed")
+		return
+	}
+
+	now := time.Now()
+	idToken, err := p.keys.Sign(&idTokenClaims{
+		Nonce:             pending.nonce,
+		Email:             pending.subject + "@example.com",
+		PreferredUsername: pending.subject,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.issuer,
+			Subject:   "mock|" + pending.subject,
+			Audience:  jwt.ClaimStrings{pending.clientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	})
+	if err != nil {
+		tokenError(w, "server_error", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "mock-" + code,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
@@ -16,9 +16,15 @@ type LoginResponse struct {
 func main() {
 	apiAddr := "http://localhost:8081"
 
-	// 1. Login
-	reqBody, _ := json.Marshal(map[string]string{"user_id": "test_user"})
-	resp, err := http.Post(apiAddr+"/login", "application/json", bytes.NewBuffer(reqBody))
+	// 1. Register (ignored if the user already exists), then login
+	reqBody, _ := json.Marshal(map[string]string{"username": "test_user", "password": "test_password"})
+	resp, err := http.Post(apiAddr+"/register", "application/json", bytes.NewBuffer(reqBody))
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Post(apiAddr+"/login", "application/json", bytes.NewBuffer(reqBody))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+)
+
+type LoginResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	UserID       string `json:"user_id"`
+}
+
+// Walks the OIDC login against the API and scripts/mock_idp the way a
+// browser would: /oidc/login redirects to the IdP, which redirects straight
+// back to /oidc/callback. The cookie jar carries the state cookie.
+func main() {
+	apiAddr := flag.String("api", "http://localhost:8081", "API address")
+	flag.Parse()
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Get(*apiAddr + "/oidc/login")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Fatalf("Login failed: %s %s", resp.Status, body)
+	}
+
+	var loginResp LoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&loginResp); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Logged in as %s. Token: %s...\n", loginResp.UserID, loginResp.Token[:10])
+
+	// The issued token works like one from /login
+	req, _ := http.NewRequest("GET", *apiAddr+"/conversations", nil)
+	req.Header.Add("Authorization", "Bearer "+loginResp.Token)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal("Conversations request failed:", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	log.Printf("Conversations (%s): %s", resp.Status, string(body))
+}